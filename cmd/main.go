@@ -2,6 +2,9 @@ package main
 
 import (
 	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/hasher"
+	"UserServiceAuth/internal/keys"
+	"UserServiceAuth/internal/mailer"
 	auth "UserServiceAuth/internal/router/auth"
 	router "UserServiceAuth/internal/router/publickeygrpc"
 	"UserServiceAuth/internal/router/repositories"
@@ -25,13 +28,17 @@ import (
 )
 
 func main() {
-	var configPath string
+	var (
+		configPath   string
+		grantAdminID uint
+	)
 	flag.StringVar(&configPath, "config", "", "path to config file")
+	flag.UintVar(&grantAdminID, "grant-admin", 0, "grant the admin role to the user with this ID and exit")
 	flag.Parse()
 
 	// Валидация аргумента "config"
 	if configPath == "" {
-		fmt.Println("Usage: ./yourapp -config <path_to_config_file>")
+		fmt.Println("Usage: ./yourapp -config <path_to_config_file> [-grant-admin <user_id>]")
 		os.Exit(1)
 	}
 
@@ -41,11 +48,46 @@ func main() {
 		slog.String("env", cfg.Env),
 		slog.Any("cfg", cfg))
 
+	// Разовое назначение администратора без запуска серверов
+	if grantAdminID != 0 {
+		if err := grantAdmin(cfg, grantAdminID); err != nil {
+			log.Error("не удалось назначить администратора", slog.Uint64("user_id", uint64(grantAdminID)), "error", err)
+			os.Exit(1)
+		}
+		log.Info("назначен администратор", slog.Uint64("user_id", uint64(grantAdminID)))
+		return
+	}
+
 	var wg sync.WaitGroup
 
+	// Загрузка ключей подписи JWT токенов
+	// Новый ключ должен провисеть в JWKS хотя бы столько, сколько его кэшируют проверяющие сервисы
+	publishAhead := max(cfg.JWT.PublishAhead, auth.JWKSMaxAge)
+	keyManager, err := keys.NewManager(cfg.JWT.KeysPath, cfg.JWT.Algorithm, cfg.SigningKeyTTL(), publishAhead)
+	if err != nil {
+		log.Error("ошибка при загрузке ключей подписи", "error", err)
+		return
+	}
+	if err := keyManager.SaveMissingMetadata(); err != nil {
+		log.Warn("не удалось сохранить метаданные ключей подписи, время создания берётся из mtime", "error", err)
+	}
+	log.Info("ключи подписи загружены",
+		slog.String("path", cfg.JWT.KeysPath),
+		slog.String("active_kid", keyManager.ActiveKey().ID))
+
+	// Плановая ротация ключей подписи, а также ротация по сигналу SIGHUP
+	rotationCtx, stopRotation := context.WithCancel(context.Background())
+	defer stopRotation()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runKeyRotation(rotationCtx, log, keyManager, cfg.JWT.RotationPeriod, cfg.JWT.RotationCheckInterval)
+	}()
+
 	// Создание gRPC сервера
 	grpcServer := grpc.NewServer()
-	routerGrpc := router.NewGrpcApi(grpcServer)
+	routerGrpc := router.NewGrpcApi(grpcServer, keyManager)
 	_ = routerGrpc
 
 	// Запуск gRPC сервера
@@ -68,18 +110,77 @@ func main() {
 
 	// Создание сервера Echo
 	e := echo.New()
+	// Адрес клиента нужен защите от перебора, поэтому заголовкам верим только от своих прокси
+	ipExtractor, err := auth.NewIPExtractor(cfg.HTTP.TrustedProxies)
+	if err != nil {
+		log.Error("ошибка в списке доверенных прокси", "error", err)
+		return
+	}
+	e.IPExtractor = ipExtractor
 
 	db := storage.InitDB(cfg)
 	userRepo := repositories.NewUserRepository(db)
+	tokenRepo := repositories.NewTokenRepository(db)
 
-	// Создание сервиса
-	userService := services.NewUserService(userRepo)
+	// Создание хэшера паролей
+	passwordHasher, err := hasher.New(cfg.Password)
+	if err != nil {
+		log.Error("ошибка при настройке хэширования паролей", "error", err)
+		return
+	}
+
+	// Защита входа от перебора паролей
+	loginGuard := services.NewLoginGuard(repositories.NewLoginAttemptRepository(db), repositories.NewAuditRepository(db), cfg)
+
+	// Создание сервисов
+	userService := services.NewUserService(userRepo, passwordHasher, loginGuard)
+	tokenService := services.NewTokenService(keyManager, tokenRepo, userRepo, cfg)
+
+	// Отправка писем для подтверждения email
+	mailSender, err := mailer.New(cfg.Mail)
+	if err != nil {
+		log.Error("ошибка при настройке отправки писем", "error", err)
+		return
+	}
+	verificationService, err := services.NewVerificationService(keyManager, tokenRepo, userRepo, mailSender, cfg)
+	if err != nil {
+		log.Error("ошибка при настройке подтверждения email", "error", err)
+		return
+	}
+	passwordResetService := services.NewPasswordResetService(repositories.NewPasswordResetRepository(db), userRepo, passwordHasher, tokenService, mailSender, cfg)
+	mfaService := services.NewMFAService(repositories.NewMFARepository(db), userRepo, tokenRepo, loginGuard, keyManager, cfg)
+	webAuthnService, err := services.NewWebAuthnService(repositories.NewWebAuthnRepository(db), userRepo, tokenRepo, keyManager, cfg)
+	if err != nil {
+		log.Error("ошибка при настройке WebAuthn", "error", err)
+		return
+	}
+
+	// Окончательная очистка удалённых пользователей и истёкших токенов
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	defer stopPurge()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runUserPurge(purgeCtx, log, userService, tokenService, loginGuard, cfg.Users.DeletedRetention, cfg.Users.PurgeInterval)
+	}()
 
 	// Создание валидатора
 	validator := validator.New()
 
+	// Письма, которые запрашиваются без входа, отправляются в фоне
+	mailQueue := auth.NewMailQueue(cfg.Mail.Queue, e.Logger)
+
 	// Создание и настройка HTTP роутера
-	authRouter := auth.NewHttpRouter(e, userService, validator)
+	authRouter := auth.NewHttpRouter(e, auth.Dependencies{
+		Users:        userService,
+		Tokens:       tokenService,
+		Verification: verificationService,
+		Resets:       passwordResetService,
+		MFA:          mfaService,
+		WebAuthn:     webAuthnService,
+		Mail:         mailQueue,
+	}, validator)
 	_ = authRouter
 
 	// Запуск сервера Echo
@@ -113,11 +214,108 @@ func main() {
 		log.Info("HTTP сервер успешно остановлен")
 	}
 
+	// Новых запросов уже нет, письма из очереди дописываются
+	if err := mailQueue.Close(ctx); err != nil {
+		log.Error("не все письма из очереди отправлены", "error", err, "dropped", mailQueue.Dropped())
+	}
+
+	stopRotation()
+	stopPurge()
+
 	// Ожидание завершения всех горутин
 	wg.Wait()
 	log.Info("Сервера успешно остановлены")
 }
 
+func grantAdmin(cfg *config.Config, id uint) error {
+	db := storage.InitDB(cfg)
+
+	passwordHasher, err := hasher.New(cfg.Password)
+	if err != nil {
+		return err
+	}
+	loginGuard := services.NewLoginGuard(repositories.NewLoginAttemptRepository(db), repositories.NewAuditRepository(db), cfg)
+	userService := services.NewUserService(repositories.NewUserRepository(db), passwordHasher, loginGuard)
+
+	return userService.GrantAdmin(id)
+}
+
+func runKeyRotation(ctx context.Context, log *slog.Logger, keyManager *keys.Manager, period, interval time.Duration) {
+	rotate := make(chan os.Signal, 1)
+	signal.Notify(rotate, syscall.SIGHUP)
+	defer signal.Stop(rotate)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if key, rotated, err := keyManager.RotateIfDue(period); err != nil {
+			log.Error("ошибка при плановой ротации ключей", "error", err)
+		} else if rotated {
+			log.Info("опубликован новый ключ подписи",
+				slog.String("kid", key.ID),
+				slog.Time("activates_at", key.ActivatesAt))
+		}
+
+		retired, err := keyManager.Prune()
+		if err != nil {
+			log.Error("ошибка при удалении устаревших ключей", "error", err)
+		}
+		for _, key := range retired {
+			log.Info("ключ подписи выведен из оборота", slog.String("kid", key.ID))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-rotate:
+			key, err := keyManager.Rotate()
+			if err != nil {
+				log.Error("ошибка при ротации ключей по запросу", "error", err)
+				continue
+			}
+			log.Info("по запросу опубликован новый ключ подписи",
+				slog.String("kid", key.ID),
+				slog.Time("activates_at", key.ActivatesAt))
+		}
+	}
+}
+
+func runUserPurge(ctx context.Context, log *slog.Logger, userService *services.UserService, tokenService *services.TokenService, loginGuard *services.LoginGuard, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := userService.PurgeDeletedUsers(retention)
+		if err != nil {
+			log.Error("ошибка при очистке удалённых пользователей", "error", err)
+		} else if purged > 0 {
+			log.Info("удалённые пользователи окончательно стёрты", slog.Int64("count", purged))
+		}
+
+		expired, err := tokenService.PurgeExpired()
+		if err != nil {
+			log.Error("ошибка при очистке истёкших токенов", "error", err)
+		} else if expired > 0 {
+			log.Info("истёкшие токены и сессии удалены", slog.Int64("count", expired))
+		}
+
+		stale, err := loginGuard.PurgeStale()
+		if err != nil {
+			log.Error("ошибка при очистке счётчиков неудачных входов", "error", err)
+		} else if stale > 0 {
+			log.Info("устаревшие счётчики неудачных входов удалены", slog.Int64("count", stale))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func setupLogger(env string) *slog.Logger {
 	var log *slog.Logger
 
@@ -1,6 +1,9 @@
 package config
 
 import (
+	"errors"
+	"log/slog"
+	"net/url"
 	"os"
 	"time"
 
@@ -8,10 +11,21 @@ import (
 )
 
 type Config struct {
-	Env  string           `yaml:"env" env-default:"local"`
-	GRPC GRPCconfig       `yaml:"grpc" env-required:"true"`
-	HTTP HttpServerConfig `yaml:"http_server" env-required:"true"`
-	DB   DBauthConfig     `yaml:"db"`
+	Env             string              `yaml:"env" env-default:"local"`
+	TokenTTL        time.Duration       `yaml:"token_ttl" env-default:"1h"`
+	RefreshTokenTTL time.Duration       `yaml:"refresh_token_ttl" env-default:"720h"`
+	GRPC            GRPCconfig          `yaml:"grpc" env-required:"true"`
+	HTTP            HttpServerConfig    `yaml:"http_server" env-required:"true"`
+	DB              DBauthConfig        `yaml:"db"`
+	JWT             JWTConfig           `yaml:"jwt"`
+	Password        PasswordConfig      `yaml:"password"`
+	Users           UsersConfig         `yaml:"users"`
+	Mail            MailConfig          `yaml:"mail"`
+	Verification    VerificationConfig  `yaml:"verification"`
+	PasswordReset   PasswordResetConfig `yaml:"password_reset"`
+	MFA             MFAConfig           `yaml:"mfa"`
+	WebAuthn        WebAuthnConfig      `yaml:"webauthn"`
+	BruteForce      BruteForceConfig    `yaml:"brute_force"`
 }
 
 type GRPCconfig struct {
@@ -23,6 +37,9 @@ type HttpServerConfig struct {
 	Address     string        `yaml:"address" env-default:"localhost:8080"`
 	Timeout     time.Duration `yaml:"timeout" env-default:"4s"`
 	IdleTimeout time.Duration `yaml:"idle_timeout" env-default:"60s"`
+	// Подсети обратных прокси (CIDR), которым можно верить в X-Forwarded-For.
+	// Пусто - адрес клиента берётся из соединения.
+	TrustedProxies []string `yaml:"trusted_proxies"`
 }
 
 type DBauthConfig struct {
@@ -33,6 +50,131 @@ type DBauthConfig struct {
 	DBName   string `yaml:"dbname"`
 }
 
+type JWTConfig struct {
+	// Публичный адрес сервиса. Попадает в claim iss и в документ обнаружения, поэтому должен быть URL.
+	Issuer    string `yaml:"issuer" env-default:"http://localhost:8080"`
+	Audience  string `yaml:"audience" env-default:"user-service"`
+	Algorithm string `yaml:"algorithm" env-default:"EdDSA"`
+	KeysPath  string `yaml:"keys_path" env-default:"./keys"`
+
+	RotationPeriod        time.Duration `yaml:"rotation_period" env-default:"720h"`
+	RotationCheckInterval time.Duration `yaml:"rotation_check_interval" env-default:"10m"`
+	// Сколько новый ключ публикуется в JWKS, прежде чем начать подписывать.
+	// Не может быть меньше времени кэширования JWKS.
+	PublishAhead time.Duration `yaml:"publish_ahead" env-default:"10m"`
+}
+
+type PasswordConfig struct {
+	Algorithm     string `yaml:"algorithm" env-default:"argon2id"`
+	BcryptCost    int    `yaml:"bcrypt_cost" env-default:"12"`
+	Argon2Time    uint32 `yaml:"argon2_time" env-default:"3"`
+	Argon2Memory  uint32 `yaml:"argon2_memory" env-default:"65536"`
+	Argon2Threads uint8  `yaml:"argon2_threads" env-default:"2"`
+}
+
+type UsersConfig struct {
+	// Сколько удалённый пользователь хранится до окончательной очистки
+	DeletedRetention time.Duration `yaml:"deleted_retention" env-default:"720h"`
+	PurgeInterval    time.Duration `yaml:"purge_interval" env-default:"1h"`
+}
+
+type MailConfig struct {
+	// smtp, file или memory
+	Driver  string          `yaml:"driver" env-default:"file"`
+	From    string          `yaml:"from" env-default:"no-reply@localhost"`
+	FileDir string          `yaml:"file_dir" env-default:"./mail"`
+	SMTP    SMTPConfig      `yaml:"smtp"`
+	Queue   MailQueueConfig `yaml:"queue"`
+}
+
+// MailQueueConfig ограничивает письма, которые можно запросить без входа: восстановление
+// пароля и повторное подтверждение email. Они отправляются в фоне из очереди.
+type MailQueueConfig struct {
+	Size    int `yaml:"size" env-default:"256"`
+	Workers int `yaml:"workers" env-default:"4"`
+	// Сколько писем можно запросить за Window на один адрес и с одного IP
+	PerEmail int           `yaml:"per_email" env-default:"3"`
+	PerIP    int           `yaml:"per_ip" env-default:"20"`
+	Window   time.Duration `yaml:"window" env-default:"1h"`
+}
+
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port" env-default:"587"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password" env:"SMTP_PASSWORD"`
+	// Ограничение на подключение и весь обмен с сервером при отправке одного письма
+	Timeout time.Duration `yaml:"timeout" env-default:"10s"`
+}
+
+type VerificationConfig struct {
+	TokenTTL time.Duration `yaml:"token_ttl" env-default:"24h"`
+	// Адрес страницы подтверждения, токен добавляется параметром token
+	URL string `yaml:"url"`
+	// Что разрешено пользователю с неподтверждённым email: allow, restrict или block
+	UnverifiedPolicy string `yaml:"unverified_policy" env-default:"restrict"`
+}
+
+type PasswordResetConfig struct {
+	TokenTTL time.Duration `yaml:"token_ttl" env-default:"1h"`
+	// Адрес страницы смены пароля, токен добавляется параметром token
+	URL string `yaml:"url"`
+}
+
+type MFAConfig struct {
+	// Название сервиса в приложении-аутентификаторе
+	Issuer       string        `yaml:"issuer" env-default:"UserServiceAuth"`
+	ChallengeTTL time.Duration `yaml:"challenge_ttl" env-default:"5m"`
+	// Роль администратора действует только в сессиях, открытых со вторым фактором
+	RequireForAdmins bool `yaml:"require_for_admins" env-default:"true"`
+}
+
+type WebAuthnConfig struct {
+	// Домен, к которому привязываются ключи: домен страницы входа или его родитель
+	RPID    string   `yaml:"rp_id" env-default:"localhost"`
+	RPName  string   `yaml:"rp_name" env-default:"UserServiceAuth"`
+	Origins []string `yaml:"origins" env-default:"http://localhost:8080"`
+	// Сколько действует вызов церемонии регистрации или входа
+	Timeout time.Duration `yaml:"timeout" env-default:"5m"`
+	// Проверка пользователя (PIN, биометрия) для ключа как второго фактора: required, preferred
+	// или discouraged. Вход только по ключу проверку требует всегда.
+	UserVerification string `yaml:"user_verification" env-default:"preferred"`
+}
+
+type BruteForceConfig struct {
+	// Сколько неудачных попыток подряд проходят без задержки, дальше она удваивается с каждой попыткой
+	FreeAttempts   int           `yaml:"free_attempts" env-default:"3"`
+	IPFreeAttempts int           `yaml:"ip_free_attempts" env-default:"20"`
+	BaseDelay      time.Duration `yaml:"base_delay" env-default:"1s"`
+	MaxDelay       time.Duration `yaml:"max_delay" env-default:"5m"`
+	// После стольких неудачных попыток аккаунт блокируется на LockoutDuration
+	LockoutThreshold int           `yaml:"lockout_threshold" env-default:"10"`
+	LockoutDuration  time.Duration `yaml:"lockout_duration" env-default:"30m"`
+	// Через сколько без неудачных попыток счётчик сбрасывается
+	Window time.Duration `yaml:"window" env-default:"1h"`
+}
+
+// SigningKeyTTL - сколько живёт самый долгий JWT, подписанный ключами сервиса.
+// Столько старый ключ остаётся в JWKS после смены активного.
+func (c *Config) SigningKeyTTL() time.Duration {
+	return max(c.TokenTTL, c.Verification.TokenTTL, c.MFA.ChallengeTTL, c.WebAuthn.Timeout)
+}
+
+// LogValue скрывает пароли, когда конфигурация попадает в лог
+func (c *Config) LogValue() slog.Value {
+	redacted := *c
+	redacted.DB.Password = redact(c.DB.Password)
+	redacted.Mail.SMTP.Password = redact(c.Mail.SMTP.Password)
+	return slog.AnyValue(redacted)
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
+
 func MustLoadByPath(configPath string) *Config {
 	// Проверка наличия файла
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
@@ -43,6 +185,24 @@ func MustLoadByPath(configPath string) *Config {
 	if err := cleanenv.ReadConfig(configPath, &cfg); err != nil {
 		panic("cannot read config: " + err.Error())
 	}
+	if err := validateIssuer(cfg.JWT.Issuer); err != nil {
+		panic("invalid jwt.issuer: " + err.Error())
+	}
 
 	return &cfg
 }
+
+// validateIssuer проверяет, что issuer - абсолютный http(s) URL без query и fragment, как требует OpenID Discovery
+func validateIssuer(issuer string) error {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return errors.New("must be an absolute http(s) URL")
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("must not contain a query or fragment")
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_LogValueRedactsSecrets(t *testing.T) {
+	cfg := &Config{
+		DB:   DBauthConfig{User: "admin", Password: "db-secret"},
+		Mail: MailConfig{SMTP: SMTPConfig{Username: "mailer", Password: "smtp-secret"}},
+	}
+
+	var buf bytes.Buffer
+	slog.New(slog.NewJSONHandler(&buf, nil)).Info("config", slog.Any("cfg", cfg))
+
+	assert.NotContains(t, buf.String(), "db-secret")
+	assert.NotContains(t, buf.String(), "smtp-secret")
+	assert.Contains(t, buf.String(), "mailer")
+	assert.Contains(t, buf.String(), "[REDACTED]")
+	// Сама конфигурация не меняется
+	assert.Equal(t, "smtp-secret", cfg.Mail.SMTP.Password)
+}
+
+func TestConfig_SigningKeyTTLCoversVerificationLinks(t *testing.T) {
+	cfg := &Config{
+		TokenTTL:     2 * time.Hour,
+		Verification: VerificationConfig{TokenTTL: 24 * time.Hour},
+		MFA:          MFAConfig{ChallengeTTL: 5 * time.Minute},
+		WebAuthn:     WebAuthnConfig{Timeout: 5 * time.Minute},
+	}
+
+	assert.Equal(t, 24*time.Hour, cfg.SigningKeyTTL())
+}
+
+func TestValidateIssuer(t *testing.T) {
+	for _, issuer := range []string{"https://auth.example.com", "http://localhost:8080", "https://example.com/auth"} {
+		assert.NoError(t, validateIssuer(issuer), issuer)
+	}
+	for _, issuer := range []string{"", "user-service-auth", "ftp://example.com", "https://", "https://example.com?tenant=1", "https://example.com#x"} {
+		assert.Error(t, validateIssuer(issuer), issuer)
+	}
+}
@@ -0,0 +1,90 @@
+package hasher_test
+
+import (
+	"strings"
+	"testing"
+
+	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/hasher"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHasher(t *testing.T, algorithm string) *hasher.Hasher {
+	h, err := hasher.New(config.PasswordConfig{
+		Algorithm:     algorithm,
+		BcryptCost:    4,
+		Argon2Time:    1,
+		Argon2Memory:  1024,
+		Argon2Threads: 1,
+	})
+	require.NoError(t, err)
+	return h
+}
+
+func TestHasher_Argon2id(t *testing.T) {
+	h := newTestHasher(t, hasher.AlgArgon2id)
+
+	hash, err := h.Hash("securePwd123")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	ok, needsRehash, err := h.Verify("securePwd123", hash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, needsRehash)
+
+	ok, _, err = h.Verify("wrong", hash)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// Одинаковые пароли дают разные хэши за счёт соли
+	other, err := h.Hash("securePwd123")
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, other)
+}
+
+func TestHasher_Bcrypt(t *testing.T) {
+	h := newTestHasher(t, hasher.AlgBcrypt)
+
+	hash, err := h.Hash("securePwd123")
+	require.NoError(t, err)
+
+	ok, needsRehash, err := h.Verify("securePwd123", hash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, needsRehash)
+}
+
+func TestHasher_LegacyFormatsNeedRehash(t *testing.T) {
+	argon := newTestHasher(t, hasher.AlgArgon2id)
+	bcryptHash, err := newTestHasher(t, hasher.AlgBcrypt).Hash("securePwd123")
+	require.NoError(t, err)
+
+	ok, needsRehash, err := argon.Verify("securePwd123", bcryptHash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, needsRehash)
+
+	ok, needsRehash, err = argon.Verify("securePwd123", "securePwd123")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, needsRehash)
+
+	ok, _, err = argon.Verify("securePwd1234", "securePwd123")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestHasher_MalformedArgon2Hash(t *testing.T) {
+	h := newTestHasher(t, hasher.AlgArgon2id)
+
+	_, _, err := h.Verify("securePwd123", "$argon2id$v=19$broken")
+	assert.ErrorIs(t, err, hasher.ErrMalformedHash)
+}
+
+func TestNew_UnsupportedAlgorithm(t *testing.T) {
+	_, err := hasher.New(config.PasswordConfig{Algorithm: "md5"})
+	assert.Error(t, err)
+}
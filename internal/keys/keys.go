@@ -0,0 +1,111 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgEdDSA = "EdDSA"
+)
+
+// Key - асимметричная пара ключей для подписи JWT токенов
+type Key struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	CreatedAt time.Time
+	// С этого момента ключ подписывает токены. До него ключ только опубликован в JWKS.
+	ActivatesAt time.Time
+
+	path string
+	// Время создания взято из mtime и ещё не записано в метаданные
+	unsavedMetadata bool
+}
+
+func (k *Key) Public() crypto.PublicKey {
+	return k.Private.Public()
+}
+
+func Generate(alg string) (*Key, error) {
+	var (
+		private crypto.Signer
+		err     error
+	)
+
+	switch alg {
+	case AlgRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKey(private, time.Now())
+}
+
+func NewKey(private crypto.Signer, createdAt time.Time) (*Key, error) {
+	alg, err := algorithmFor(private.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := KeyID(private.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{
+		ID:          id,
+		Algorithm:   alg,
+		Private:     private,
+		CreatedAt:   createdAt,
+		ActivatesAt: createdAt,
+	}, nil
+}
+
+// KeyID вычисляет стабильный идентификатор ключа по SHA-256 от его публичной части
+func KeyID(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:16]), nil
+}
+
+func algorithmFor(public crypto.PublicKey) (string, error) {
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return "", fmt.Errorf("rsa key is too short: %d bits", pub.N.BitLen())
+		}
+		return AlgRS256, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return "", fmt.Errorf("unsupported ecdsa curve: %s", pub.Curve.Params().Name)
+		}
+		return AlgES256, nil
+	case ed25519.PublicKey:
+		return AlgEdDSA, nil
+	default:
+		return "", fmt.Errorf("unsupported key type: %T", public)
+	}
+}
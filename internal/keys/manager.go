@@ -0,0 +1,442 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	privateKeySuffix = ".pem"
+	publicKeySuffix  = ".pub.pem"
+	metadataSuffix   = ".json"
+)
+
+// keyMetadata хранится рядом с ключом. Время создания нельзя брать из mtime файла:
+// копирование директории или touch переставили бы ключи местами.
+type keyMetadata struct {
+	CreatedAt   time.Time `json:"created_at"`
+	ActivatesAt time.Time `json:"activates_at"`
+}
+
+// VerificationKey - ключ, по которому можно проверять подписи токенов, и срок его действия
+type VerificationKey struct {
+	*Key
+	NotAfter time.Time
+}
+
+// Manager хранит ключи подписи, загруженные из директории с ключами.
+// Новый ключ сначала publishAhead только публикуется, чтобы проверяющие сервисы успели
+// обновить закэшированный JWKS, и лишь потом начинает подписывать. Предыдущие ключи
+// остаются доступными для проверки ещё overlap после смены - столько живут выданные ими токены.
+type Manager struct {
+	mu           sync.RWMutex
+	dir          string
+	alg          string
+	overlap      time.Duration
+	publishAhead time.Duration
+	keys         []*Key
+}
+
+func NewManager(dir, alg string, overlap, publishAhead time.Duration) (*Manager, error) {
+	m := &Manager{
+		dir:          dir,
+		alg:          alg,
+		overlap:      overlap,
+		publishAhead: publishAhead,
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create keys dir: %w", err)
+	}
+
+	loaded, err := loadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	m.keys = loaded
+
+	if len(m.keys) == 0 {
+		if _, err := m.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Rotate создаёт новый ключ. Он начинает подписывать через publishAhead,
+// а самый первый ключ - сразу, потому что подписывать больше нечем.
+func (m *Manager) Rotate() (*Key, error) {
+	key, err := Generate(m.alg)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.keys) > 0 {
+		key.ActivatesAt = key.CreatedAt.Add(m.publishAhead)
+	}
+	if err := writeKey(m.dir, key); err != nil {
+		return nil, err
+	}
+
+	m.keys = append(m.keys, key)
+	return key, nil
+}
+
+// RotateIfDue ротирует ключи, если самый новый ключ подписывает дольше period.
+// Пока опубликованный ключ ждёт активации, новая ротация не нужна.
+func (m *Manager) RotateIfDue(period time.Duration) (*Key, bool, error) {
+	m.mu.RLock()
+	newest := m.keys[len(m.keys)-1]
+	m.mu.RUnlock()
+
+	if time.Since(newest.ActivatesAt) < period {
+		return nil, false, nil
+	}
+
+	key, err := m.Rotate()
+	if err != nil {
+		return nil, false, err
+	}
+	return key, true, nil
+}
+
+// Prune удаляет ключи, которыми уже не может быть подписан ни один действующий токен
+func (m *Manager) Prune() ([]*Key, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var (
+		retired []*Key
+		kept    []*Key
+	)
+	for i, key := range m.keys {
+		notAfter := m.notAfter(i)
+		if notAfter.IsZero() || now.Before(notAfter) {
+			kept = append(kept, key)
+			continue
+		}
+
+		if err := removeKey(key); err != nil {
+			return retired, err
+		}
+		retired = append(retired, key)
+	}
+
+	m.keys = kept
+	return retired, nil
+}
+
+// SaveMissingMetadata записывает метаданные ключей, у которых их не было, чтобы время
+// создания больше не зависело от mtime. Ключи работают и без этого, поэтому ошибку
+// записи, например в директорию только для чтения, достаточно записать в журнал.
+func (m *Manager) SaveMissingMetadata() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errs []error
+	for _, key := range m.keys {
+		if !key.unsavedMetadata {
+			continue
+		}
+		err := writeMetadata(key.path, &keyMetadata{CreatedAt: key.CreatedAt.UTC(), ActivatesAt: key.ActivatesAt.UTC()})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("key %s: %w", key.ID, err))
+			continue
+		}
+		key.unsavedMetadata = false
+	}
+	return errors.Join(errs...)
+}
+
+// ActiveKey возвращает самый новый из уже активированных ключей, которым подписываются токены
+func (m *Manager) ActiveKey() *Key {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	for i := len(m.keys) - 1; i > 0; i-- {
+		if !m.keys[i].ActivatesAt.After(now) {
+			return m.keys[i]
+		}
+	}
+	return m.keys[0]
+}
+
+func (m *Manager) Key(id string) (*Key, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, key := range m.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func (m *Manager) Keys() []*Key {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]*Key, len(m.keys))
+	copy(keys, m.keys)
+	return keys
+}
+
+// VerificationKeys возвращает все ключи, которые ещё можно использовать для проверки подписи,
+// включая опубликованные, но ещё не активированные
+func (m *Manager) VerificationKeys() []VerificationKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	keys := make([]VerificationKey, 0, len(m.keys))
+	for i, key := range m.keys {
+		notAfter := m.notAfter(i)
+		if !notAfter.IsZero() && !now.Before(notAfter) {
+			continue
+		}
+		keys = append(keys, VerificationKey{Key: key, NotAfter: notAfter})
+	}
+	return keys
+}
+
+// notAfter - момент, после которого ключ с индексом i больше не нужен для проверки.
+// Ключ перестаёт подписывать в момент активации следующего, и последний выданный им токен
+// истекает через overlap. Для самого нового ключа возвращается нулевое время.
+func (m *Manager) notAfter(i int) time.Time {
+	if i == len(m.keys)-1 {
+		return time.Time{}
+	}
+	return m.keys[i+1].ActivatesAt.Add(m.overlap)
+}
+
+func loadDir(dir string) ([]*Key, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read keys dir: %w", err)
+	}
+
+	var keys []*Key
+	seen := make(map[string]string)
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, privateKeySuffix) || strings.HasSuffix(name, publicKeySuffix) {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		key, err := loadKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("load key %s: %w", name, err)
+		}
+
+		if other, ok := seen[key.ID]; ok {
+			return nil, fmt.Errorf("key %s duplicates key %s", name, other)
+		}
+		seen[key.ID] = name
+
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys, nil
+}
+
+func loadKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Публичный ключ рядом с приватным необязателен, но если он есть - он должен совпадать
+	if pubData, err := os.ReadFile(publicKeyPath(path)); err == nil {
+		public, err := parsePublicKey(pubData)
+		if err != nil {
+			return nil, fmt.Errorf("parse public key: %w", err)
+		}
+		expected, ok := public.(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !expected.Equal(private.Public()) {
+			return nil, errors.New("public key does not match private key")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	meta, missing, err := readMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := NewKey(private, meta.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if !meta.ActivatesAt.IsZero() {
+		key.ActivatesAt = meta.ActivatesAt
+	}
+	key.path = path
+	key.unsavedMetadata = missing
+
+	return key, nil
+}
+
+// readMetadata читает метаданные ключа. Для ключей без метаданных (созданных до их
+// появления или положенных вручную) время создания берётся из mtime, а missing равен true.
+// Записать такие метаданные можно через SaveMissingMetadata - директория может быть только для чтения.
+func readMetadata(privatePath string) (meta *keyMetadata, missing bool, err error) {
+	data, err := os.ReadFile(metadataPath(privatePath))
+	if err == nil {
+		meta = &keyMetadata{}
+		if err := json.Unmarshal(data, meta); err != nil {
+			return nil, false, fmt.Errorf("parse key metadata: %w", err)
+		}
+		if meta.CreatedAt.IsZero() {
+			return nil, false, errors.New("key metadata has no created_at")
+		}
+		return meta, false, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	info, err := os.Stat(privatePath)
+	if err != nil {
+		return nil, false, err
+	}
+	return &keyMetadata{CreatedAt: info.ModTime(), ActivatesAt: info.ModTime()}, true, nil
+}
+
+func writeMetadata(privatePath string, meta *keyMetadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(metadataPath(privatePath), data, 0o644); err != nil {
+		return fmt.Errorf("write key metadata: %w", err)
+	}
+	return nil
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var (
+		key interface{}
+		err error
+	)
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type: %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type: %T", key)
+	}
+	return signer, nil
+}
+
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("no PUBLIC KEY PEM block found")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// PublicKeyPEM кодирует публичную часть ключа в PEM формате
+func PublicKeyPEM(key *Key) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+func writeKey(dir string, key *Key) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return err
+	}
+	private := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	public, err := PublicKeyPEM(key)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, key.ID+privateKeySuffix)
+	if err := os.WriteFile(path, private, 0o600); err != nil {
+		return fmt.Errorf("write private key: %w", err)
+	}
+	if err := os.WriteFile(publicKeyPath(path), public, 0o644); err != nil {
+		return fmt.Errorf("write public key: %w", err)
+	}
+	if err := writeMetadata(path, &keyMetadata{CreatedAt: key.CreatedAt.UTC(), ActivatesAt: key.ActivatesAt.UTC()}); err != nil {
+		return err
+	}
+	key.path = path
+
+	return nil
+}
+
+func removeKey(key *Key) error {
+	if key.path == "" {
+		return nil
+	}
+	if err := os.Remove(key.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove private key: %w", err)
+	}
+	if err := os.Remove(publicKeyPath(key.path)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove public key: %w", err)
+	}
+	if err := os.Remove(metadataPath(key.path)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove key metadata: %w", err)
+	}
+	return nil
+}
+
+func publicKeyPath(privatePath string) string {
+	return strings.TrimSuffix(privatePath, privateKeySuffix) + publicKeySuffix
+}
+
+func metadataPath(privatePath string) string {
+	return strings.TrimSuffix(privatePath, privateKeySuffix) + metadataSuffix
+}
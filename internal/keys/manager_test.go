@@ -0,0 +1,253 @@
+package keys_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"UserServiceAuth/internal/keys"
+)
+
+func TestNewManager_GeneratesKeyInEmptyDir(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := keys.NewManager(dir, keys.AlgEdDSA, time.Hour, 0)
+	require.NoError(t, err)
+
+	active := m.ActiveKey()
+	assert.Equal(t, keys.AlgEdDSA, active.Algorithm)
+	assert.FileExists(t, filepath.Join(dir, active.ID+".pem"))
+	assert.FileExists(t, filepath.Join(dir, active.ID+".pub.pem"))
+
+	// Повторная загрузка должна вернуть тот же ключ с тем же идентификатором
+	reloaded, err := keys.NewManager(dir, keys.AlgEdDSA, time.Hour, 0)
+	require.NoError(t, err)
+	assert.Equal(t, active.ID, reloaded.ActiveKey().ID)
+	assert.Len(t, reloaded.Keys(), 1)
+}
+
+func TestNewManager_LoadsExistingECKey(t *testing.T) {
+	dir := t.TempDir()
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(private)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "signing.pem"), "EC PRIVATE KEY", der)
+
+	m, err := keys.NewManager(dir, keys.AlgEdDSA, time.Hour, 0)
+	require.NoError(t, err)
+
+	expectedID, err := keys.KeyID(&private.PublicKey)
+	require.NoError(t, err)
+	assert.Equal(t, expectedID, m.ActiveKey().ID)
+	assert.Equal(t, keys.AlgES256, m.ActiveKey().Algorithm)
+}
+
+func TestNewManager_KeepsOrderWhenFilesAreTouched(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := keys.NewManager(dir, keys.AlgEdDSA, time.Hour, 0)
+	require.NoError(t, err)
+	previous := m.ActiveKey()
+	next, err := m.Rotate()
+	require.NoError(t, err)
+
+	// Копирование или восстановление директории меняет mtime, но не время создания ключа
+	future := time.Now().Add(24 * time.Hour)
+	for _, name := range []string{previous.ID + ".pem", previous.ID + ".pub.pem"} {
+		require.NoError(t, os.Chtimes(filepath.Join(dir, name), future, future))
+	}
+
+	reloaded, err := keys.NewManager(dir, keys.AlgEdDSA, time.Hour, 0)
+	require.NoError(t, err)
+	assert.Equal(t, next.ID, reloaded.ActiveKey().ID)
+
+	loaded, ok := reloaded.Key(previous.ID)
+	require.True(t, ok)
+	assert.True(t, previous.CreatedAt.Equal(loaded.CreatedAt))
+}
+
+func TestNewManager_StoresCreationTimeOfLegacyKey(t *testing.T) {
+	dir := t.TempDir()
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+	path := filepath.Join(dir, "signing.pem")
+	writePEM(t, path, "PRIVATE KEY", der)
+
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(path, created, created))
+
+	m, err := keys.NewManager(dir, keys.AlgEdDSA, time.Hour, 0)
+	require.NoError(t, err)
+	assert.True(t, created.Equal(m.ActiveKey().CreatedAt))
+	// При загрузке в директорию ничего не пишется
+	assert.NoFileExists(t, filepath.Join(dir, "signing.json"))
+
+	require.NoError(t, m.SaveMissingMetadata())
+	assert.FileExists(t, filepath.Join(dir, "signing.json"))
+
+	// После первой загрузки mtime больше не влияет на время создания
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now()))
+	reloaded, err := keys.NewManager(dir, keys.AlgEdDSA, time.Hour, 0)
+	require.NoError(t, err)
+	assert.True(t, created.Equal(reloaded.ActiveKey().CreatedAt))
+}
+
+func TestNewManager_LoadsLegacyKeyFromReadOnlyDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root ignores directory permissions")
+	}
+	dir := t.TempDir()
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "signing.pem"), "PRIVATE KEY", der)
+	require.NoError(t, os.Chmod(dir, 0o500))
+	t.Cleanup(func() { _ = os.Chmod(dir, 0o700) })
+
+	m, err := keys.NewManager(dir, keys.AlgEdDSA, time.Hour, 0)
+	require.NoError(t, err)
+	assert.NotNil(t, m.ActiveKey())
+	assert.Error(t, m.SaveMissingMetadata())
+}
+
+func TestNewManager_RejectsMismatchedPublicKey(t *testing.T) {
+	dir := t.TempDir()
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "signing.pem"), "PRIVATE KEY", der)
+
+	pubDER, err := x509.MarshalPKIXPublicKey(&other.PublicKey)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "signing.pub.pem"), "PUBLIC KEY", pubDER)
+
+	_, err = keys.NewManager(dir, keys.AlgEdDSA, time.Hour, 0)
+	assert.Error(t, err)
+}
+
+func TestNewManager_RejectsInvalidPEM(t *testing.T) {
+	dir := t.TempDir()
+	writePEM(t, filepath.Join(dir, "broken.pem"), "PRIVATE KEY", []byte("not a key"))
+
+	_, err := keys.NewManager(dir, keys.AlgEdDSA, time.Hour, 0)
+	assert.Error(t, err)
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+}
+
+func TestManager_RotateKeepsPreviousKeyDuringOverlap(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := keys.NewManager(dir, keys.AlgEdDSA, time.Hour, 0)
+	require.NoError(t, err)
+	previous := m.ActiveKey()
+
+	next, err := m.Rotate()
+	require.NoError(t, err)
+	assert.Equal(t, next.ID, m.ActiveKey().ID)
+
+	verification := m.VerificationKeys()
+	require.Len(t, verification, 2)
+	assert.Equal(t, previous.ID, verification[0].ID)
+	assert.WithinDuration(t, next.CreatedAt.Add(time.Hour), verification[0].NotAfter, time.Second)
+	assert.True(t, verification[1].NotAfter.IsZero())
+
+	retired, err := m.Prune()
+	require.NoError(t, err)
+	assert.Empty(t, retired)
+	_, ok := m.Key(previous.ID)
+	assert.True(t, ok)
+}
+
+func TestManager_PruneRetiresExpiredKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := keys.NewManager(dir, keys.AlgEdDSA, 0, 0)
+	require.NoError(t, err)
+	previous := m.ActiveKey()
+
+	_, err = m.Rotate()
+	require.NoError(t, err)
+	assert.Len(t, m.VerificationKeys(), 1)
+
+	retired, err := m.Prune()
+	require.NoError(t, err)
+	require.Len(t, retired, 1)
+	assert.Equal(t, previous.ID, retired[0].ID)
+	assert.NoFileExists(t, filepath.Join(dir, previous.ID+".pem"))
+	assert.NoFileExists(t, filepath.Join(dir, previous.ID+".pub.pem"))
+	assert.NoFileExists(t, filepath.Join(dir, previous.ID+".json"))
+	assert.Len(t, m.Keys(), 1)
+}
+
+func TestManager_RotateIfDue(t *testing.T) {
+	m, err := keys.NewManager(t.TempDir(), keys.AlgEdDSA, time.Hour, 0)
+	require.NoError(t, err)
+
+	_, rotated, err := m.RotateIfDue(time.Hour)
+	require.NoError(t, err)
+	assert.False(t, rotated)
+
+	key, rotated, err := m.RotateIfDue(0)
+	require.NoError(t, err)
+	assert.True(t, rotated)
+	assert.Equal(t, key.ID, m.ActiveKey().ID)
+}
+
+func TestManager_RotatePublishesKeyBeforeSigning(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := keys.NewManager(dir, keys.AlgEdDSA, time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+	previous := m.ActiveKey()
+	// Первый ключ подписывает сразу
+	assert.False(t, previous.ActivatesAt.After(time.Now()))
+
+	next, err := m.Rotate()
+	require.NoError(t, err)
+	assert.WithinDuration(t, next.CreatedAt.Add(10*time.Minute), next.ActivatesAt, time.Second)
+
+	// Пока новый ключ не активирован, подписывает прежний, но в JWKS уже оба
+	assert.Equal(t, previous.ID, m.ActiveKey().ID)
+	verification := m.VerificationKeys()
+	require.Len(t, verification, 2)
+	assert.WithinDuration(t, next.ActivatesAt.Add(time.Hour), verification[0].NotAfter, time.Second)
+	assert.Equal(t, next.ID, verification[1].ID)
+
+	_, rotated, err := m.RotateIfDue(0)
+	require.NoError(t, err)
+	assert.False(t, rotated)
+
+	// Время активации переживает перезапуск
+	reloaded, err := keys.NewManager(dir, keys.AlgEdDSA, time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, previous.ID, reloaded.ActiveKey().ID)
+	loaded, ok := reloaded.Key(next.ID)
+	require.True(t, ok)
+	assert.True(t, next.ActivatesAt.Equal(loaded.ActivatesAt))
+}
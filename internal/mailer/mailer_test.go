@@ -0,0 +1,101 @@
+package mailer
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"UserServiceAuth/internal/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	m, err := New(config.MailConfig{Driver: DriverMemory})
+	require.NoError(t, err)
+	assert.IsType(t, &MemoryMailer{}, m)
+
+	m, err = New(config.MailConfig{Driver: DriverFile, From: "no-reply@example.com", FileDir: t.TempDir()})
+	require.NoError(t, err)
+	assert.IsType(t, &FileMailer{}, m)
+
+	_, err = New(config.MailConfig{Driver: DriverSMTP, From: "no-reply@example.com"})
+	assert.Error(t, err)
+
+	_, err = New(config.MailConfig{Driver: "pigeon"})
+	assert.Error(t, err)
+}
+
+func TestBuild(t *testing.T) {
+	date := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	raw := string(build("no-reply@example.com", Message{
+		To:      "john@example.com",
+		Subject: "Подтверждение",
+		Body:    "line 1\nline 2",
+	}, date))
+
+	assert.Contains(t, raw, "From: no-reply@example.com\r\n")
+	assert.Contains(t, raw, "To: john@example.com\r\n")
+	assert.Contains(t, raw, "Subject: =?utf-8?q?")
+	assert.Contains(t, raw, "Date: Sat, 01 Jun 2024 12:00:00 +0000\r\n")
+	assert.True(t, strings.HasSuffix(raw, "\r\n\r\nline 1\r\nline 2"))
+}
+
+func TestFileMailer_WritesMessage(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewFileMailer("no-reply@example.com", dir)
+	require.NoError(t, err)
+
+	require.NoError(t, m.Send(Message{To: "john@example.com", Subject: "Hello", Body: "token"}))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	raw, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), "To: john@example.com\r\n")
+}
+
+func TestMemoryMailer_RejectsHeaderInjection(t *testing.T) {
+	m := NewMemoryMailer()
+
+	assert.Error(t, m.Send(Message{To: "john@example.com\r\nBcc: all@example.com"}))
+	require.NoError(t, m.Send(Message{To: "john@example.com", Subject: "Hello"}))
+
+	assert.Equal(t, []Message{{To: "john@example.com", Subject: "Hello"}}, m.Messages())
+}
+
+func TestSMTPMailer_TimesOutOnSilentServer(t *testing.T) {
+	// Сервер принимает соединение, но так и не присылает приветствие
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	host, port, err := net.SplitHostPort(lis.Addr().String())
+	require.NoError(t, err)
+	portNumber, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	m, err := NewSMTPMailer("no-reply@example.com", config.SMTPConfig{Host: host, Port: portNumber, Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+
+	start := time.Now()
+	err = m.Send(Message{To: "john@example.com", Subject: "Hello", Body: "token"})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
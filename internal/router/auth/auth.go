@@ -2,8 +2,14 @@ package auth
 
 import (
 	"net/http"
+	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
+	"UserServiceAuth/internal/keys"
+	service "UserServiceAuth/internal/uscase"
+	"UserServiceAuth/internal/webauthn"
 	dto "UserServiceAuth/storage"
 
 	"github.com/go-playground/validator/v10"
@@ -11,138 +17,277 @@ import (
 )
 
 type IHandlerUsecase interface {
-	RegisterUser(user *dto.USERS) error
-	AuthenticateUser(login, password string) (*dto.USERS, error)
-	UpdateUserByID(id uint, user *dto.USERS) error
+	RegisterUser(login, password string, profile service.Profile) (*service.User, error)
+	AuthenticateUser(login, password string, client service.ClientInfo) (*service.User, error)
+	UpdateUserByID(id, version uint, profile service.Profile) (*service.User, bool, error)
+	GetUserByID(id uint) (*service.User, error)
+	ListUsers(filter dto.UserFilter) ([]service.User, int64, error)
+	DeleteUserByID(id uint) error
+	RestoreUserByID(id uint) error
+	UnlockUser(id, adminID uint) error
+	PatchUserByID(id, version uint, patch dto.UserPatch) (*service.User, bool, error)
+	ChangePassword(id uint, currentPassword, newPassword string, client service.ClientInfo) error
+	ConfirmPassword(id uint, password string, client service.ClientInfo) error
+}
+
+type ITokenUsecase interface {
+	IssueTokens(user *service.User, client service.ClientInfo) (*service.TokenPair, error)
+	IssueMFATokens(user *service.User, client service.ClientInfo) (*service.TokenPair, error)
+	IssueWebAuthnTokens(user *service.User, client service.ClientInfo, passwordless bool) (*service.TokenPair, error)
+	Refresh(refreshToken string, client service.ClientInfo) (*service.TokenPair, error)
+	Authenticate(token string) (*service.AccessClaims, error)
+	Sessions(userID uint) ([]dto.TOKENS, error)
+	RevokeSession(userID, sessionID uint) error
+	Logout(claims *service.AccessClaims) error
+	LogoutAll(userID uint) error
+	LogoutOthers(userID, sessionID uint) error
+	RevokeToken(token, tokenTypeHint string) error
+	IsTokenRevoked(jti string) (bool, error)
+	RevokedTokens() ([]dto.REVOKEDTOKENS, error)
+	Issuer() string
+	JWKS() (*keys.JWKS, error)
+}
+
+type IVerificationUsecase interface {
+	SendVerification(user *service.User) error
+	ResendVerification(email string) error
+	VerifyEmail(token string) error
+}
+
+type IPasswordResetUsecase interface {
+	ForgotPassword(email string) error
+	ResetPassword(token, newPassword string) error
+}
+
+type IMFAUsecase interface {
+	BeginEnrollment(userID uint) (*service.TOTPEnrollment, error)
+	ConfirmEnrollment(userID uint, code string) ([]string, error)
+	Disable(userID uint, code string) error
+	Confirm(userID uint, code string) error
+	Challenge(user *service.User) (*service.MFAChallenge, error)
+	CompleteChallenge(token, code string) (*service.User, error)
+	CompleteChallengeWith(token string, verify func(user *service.User) error) (*service.User, error)
+	PendingUser(token string) (*service.User, error)
+}
+
+type IWebAuthnUsecase interface {
+	BeginRegistration(userID uint) (*service.WebAuthnRegistration, error)
+	FinishRegistration(userID uint, token, name string, cred *webauthn.CredentialCreation) (*dto.WEBAUTHNCREDENTIALS, error)
+	BeginLogin(user *service.User) (*service.WebAuthnLogin, error)
+	FinishLogin(token string, assertion *webauthn.CredentialAssertion, user *service.User) (*service.User, error)
+	Credentials(userID uint) ([]dto.WEBAUTHNCREDENTIALS, error)
+	HasCredentials(userID uint) (bool, error)
+	BeginConfirmation(userID uint) (*service.WebAuthnLogin, error)
+	Confirm(userID uint, token string, assertion *webauthn.CredentialAssertion) error
+	DeleteCredential(userID, id uint) error
 }
 
 type HttpRouter struct {
-	validator *validator.Validate
-	usecase   IHandlerUsecase
+	validator    *validator.Validate
+	usecase      IHandlerUsecase
+	tokens       ITokenUsecase
+	verification IVerificationUsecase
+	resets       IPasswordResetUsecase
+	mfa          IMFAUsecase
+	webauthn     IWebAuthnUsecase
+	mail         *MailQueue
+}
+
+// Dependencies - сценарии, которые обслуживает HTTP роутер
+type Dependencies struct {
+	Users        IHandlerUsecase
+	Tokens       ITokenUsecase
+	Verification IVerificationUsecase
+	Resets       IPasswordResetUsecase
+	MFA          IMFAUsecase
+	WebAuthn     IWebAuthnUsecase
+	// Очередь писем, которые запрашиваются без входа
+	Mail *MailQueue
 }
 
-func NewHttpRouter(e *echo.Echo, usecase IHandlerUsecase, validator *validator.Validate) *HttpRouter {
+func NewHttpRouter(e *echo.Echo, deps Dependencies, validator *validator.Validate) *HttpRouter {
 	e.Validator = &CustomValidator{validator}
+	// В описании ошибок валидации поля называются так же, как в запросе
+	validator.RegisterTagNameFunc(requestFieldName)
 
 	router := &HttpRouter{
-		validator: validator,
-		usecase:   usecase,
+		validator:    validator,
+		usecase:      deps.Users,
+		tokens:       deps.Tokens,
+		verification: deps.Verification,
+		resets:       deps.Resets,
+		mfa:          deps.MFA,
+		webauthn:     deps.WebAuthn,
+		mail:         deps.Mail,
 	}
+	e.HTTPErrorHandler = router.handleError
 
-	e.Use(router.validateMiddleware)
+	e.POST("/login", withBody(router, router.handleLogin))
+	e.POST("/login/mfa", withBody(router, router.handleLoginMFA))
+	e.POST("/register", withBody(router, router.handleRegister))
+	e.POST("/refresh", withBody(router, router.handleRefresh))
+	e.POST("/verify-email", withBody(router, router.handleVerifyEmail))
+	e.POST("/verify-email/resend", withBody(router, router.handleResendVerification))
+	e.POST("/password/forgot", withBody(router, router.handleForgotPassword))
+	e.POST("/password/reset", withBody(router, router.handleResetPassword))
+	e.PUT("/update/:id", withBody(router, router.handleUpdateUserByID), router.requireAuth, router.requireSelfOrAdmin("id"))
 
-	e.POST("/login", router.handleLogin)
-	e.POST("/register", router.handleRegister)
-	e.PUT("/update/:id", router.handleUpdateUserByID)
+	e.GET("/users", router.handleListUsers, router.requireAuth, router.requireRole(dto.RoleAdmin))
+	e.GET("/users/me", router.handleGetMe, router.requireAuthUnverified)
+	e.POST("/users/me/password", withBody(router, router.handleChangePassword), router.requireAuth)
+	e.GET("/users/:id", router.handleGetUser, router.requireAuth, router.requireSelfOrAdmin("id"))
+	// Пользователь с неподтверждённым email может исправить адрес, если ошибся при регистрации
+	e.PATCH("/users/:id", router.handlePatchUser, router.requireAuthUnverified, router.requireSelfOrAdmin("id"))
+	e.DELETE("/users/:id", router.handleDeleteUser, router.requireAuth, router.requireSelfOrAdmin("id"))
+	e.POST("/users/:id/restore", router.handleRestoreUser, router.requireAuth, router.requireRole(dto.RoleAdmin))
+	e.POST("/users/:id/unlock", router.handleUnlockUser, router.requireAuth, router.requireRole(dto.RoleAdmin))
+
+	e.POST("/mfa/totp/enroll", router.handleEnrollTOTP, router.requireAuth)
+	e.POST("/mfa/totp/confirm", withBody(router, router.handleConfirmTOTP), router.requireAuth)
+	e.POST("/mfa/totp/disable", withBody(router, router.handleDisableTOTP), router.requireAuth)
+
+	e.POST("/webauthn/register/begin", router.handleBeginWebAuthnRegistration, router.requireAuth)
+	e.POST("/webauthn/register/finish", withBody(router, router.handleFinishWebAuthnRegistration), router.requireAuth)
+	e.GET("/webauthn/credentials", router.handleListWebAuthnCredentials, router.requireAuth)
+	e.DELETE("/webauthn/credentials/:id", withBody(router, router.handleDeleteWebAuthnCredential), router.requireAuth)
+	e.POST("/webauthn/confirm/begin", router.handleBeginWebAuthnConfirmation, router.requireAuth)
+	e.POST("/webauthn/login/begin", withBody(router, router.handleBeginWebAuthnLogin))
+	e.POST("/webauthn/login/finish", withBody(router, router.handleFinishWebAuthnLogin))
+
+	e.GET("/sessions", router.handleListSessions, router.requireAuth)
+	e.DELETE("/sessions/:id", router.handleRevokeSession, router.requireAuth)
+	e.POST("/logout", router.handleLogout, router.requireAuthUnverified)
+	e.POST("/logout/all", router.handleLogoutAll, router.requireAuthUnverified)
+	e.POST("/revoke", router.handleRevoke)
+	e.GET("/revoked", router.handleListRevoked)
+	e.GET("/revoked/:jti", router.handleCheckRevoked)
+
+	e.GET("/.well-known/jwks.json", router.handleJWKS)
+	e.GET("/.well-known/openid-configuration", router.handleOpenIDConfiguration)
 
 	return router
 }
 
+func requestFieldName(field reflect.StructField) string {
+	for _, tag := range []string{"json", "query", "form"} {
+		name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+		if name == "-" {
+			return ""
+		}
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
 type CustomValidator struct {
 	validator *validator.Validate
 }
 
 func (cv *CustomValidator) Validate(i interface{}) error {
 	if err := cv.validator.Struct(i); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, map[string]interface{}{
-			"error":   "Ошибка валидации",
-			"details": err.Error(),
-		})
+		return validationProblem(err)
 	}
 	return nil
 }
 
-func (h *HttpRouter) validateMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(ctx echo.Context) error {
-		req := ctx.Request()
-
-		contentType := req.Header.Get(echo.HeaderContentType)
-		if contentType != echo.MIMEApplicationJSON {
-			return echo.NewHTTPError(http.StatusBadRequest, "Invalid Content-Type, expected application/json")
-		}
-
-		var body interface{}
-		switch req.URL.Path {
-		case "/login":
-			body = new(dto.LoginRequest)
-		case "/register":
-			body = new(dto.RegisterRequest)
-		case "/update/:id":
-			body = new(dto.UpdateRequest)
-		}
+func (h *HttpRouter) handleLogin(ctx echo.Context, req *dto.LoginRequest) error {
+	user, err := h.usecase.AuthenticateUser(req.Login, req.Password, clientInfo(ctx))
+	if err != nil {
+		return err
+	}
 
-		if err := ctx.Bind(body); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	// С настроенным вторым фактором пароль даёт только токен для второго шага
+	methods, err := h.mfaMethods(user)
+	if err != nil {
+		return err
+	}
+	if len(methods) > 0 {
+		challenge, err := h.mfa.Challenge(user)
+		if err != nil {
+			return err
 		}
+		return ctx.JSON(http.StatusOK, map[string]interface{}{
+			"message":      "Требуется второй фактор аутентификации",
+			"mfa_required": true,
+			"mfa_methods":  methods,
+			"mfa_token":    challenge.Token,
+			"expires_in":   int64(time.Until(challenge.ExpiresAt).Seconds()),
+		})
+	}
 
-		if err := h.validator.Struct(body); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, map[string]interface{}{
-				"error":   "Validation error",
-				"details": err.Error(),
-			})
-		}
+	tokens, err := h.tokens.IssueTokens(user, clientInfo(ctx))
+	if err != nil {
+		return err
+	}
 
-		ctx.Set("validatedBody", body)
+	resp := tokenResponse("Пользователь успешно аутентифицирован", tokens)
+	resp["user"] = newUserProfileResponse(user)
 
-		return next(ctx)
-	}
+	return ctx.JSON(http.StatusOK, resp)
 }
 
-func (h *HttpRouter) handleLogin(ctx echo.Context) error {
-	req := ctx.Get("validatedBody").(*dto.LoginRequest)
-
-	user, err := h.usecase.AuthenticateUser(req.Login, req.Password)
+func (h *HttpRouter) handleRefresh(ctx echo.Context, req *dto.RefreshRequest) error {
+	tokens, err := h.tokens.Refresh(req.RefreshToken, clientInfo(ctx))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return err
 	}
-	_ = user
-	token := "jwt_token"
 
-	return ctx.JSON(http.StatusOK, map[string]interface{}{
-		"message": "Пользователь успешно аутентифицирован",
-		"user":    token,
-	})
+	return ctx.JSON(http.StatusOK, tokenResponse("Токены успешно обновлены", tokens))
 }
 
-func (h *HttpRouter) handleRegister(ctx echo.Context) error {
-	req := ctx.Get("validatedBody").(*dto.RegisterRequest)
-
-	user := &dto.USERS{
-		USERNAME: req.Username,
-		SURNAME:  req.Surname,
-		EMAIL:    req.Email,
-		LOGIN:    req.Login,
-		PASSWORD: req.Password,
+func tokenResponse(message string, tokens *service.TokenPair) map[string]interface{} {
+	return map[string]interface{}{
+		"message":            message,
+		"access_token":       tokens.Access.Token,
+		"token_type":         "Bearer",
+		"expires_in":         int64(time.Until(tokens.Access.ExpiresAt).Seconds()),
+		"refresh_token":      tokens.RefreshToken,
+		"refresh_expires_in": int64(time.Until(tokens.RefreshExpiresAt).Seconds()),
 	}
+}
 
-	if err := h.usecase.RegisterUser(user); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, map[string]string{"error": err.Error()})
+func (h *HttpRouter) handleRegister(ctx echo.Context, req *dto.RegisterRequest) error {
+	user, err := h.usecase.RegisterUser(req.Login, req.Password, service.Profile{
+		Username: req.Username,
+		Surname:  req.Surname,
+		Email:    req.Email,
+	})
+	if err != nil {
+		return err
 	}
+	h.sendVerification(ctx, user)
 
-	return ctx.JSON(http.StatusCreated, "Пользователь успешно зарегистрирован")
+	return ctx.JSON(http.StatusCreated, map[string]interface{}{
+		"message": "Пользователь успешно зарегистрирован",
+		"user":    newUserProfileResponse(user),
+	})
 }
 
-func (h *HttpRouter) handleUpdateUserByID(ctx echo.Context) error {
-	req := ctx.Get("validatedBody").(*dto.UpdateRequest)
-
+func (h *HttpRouter) handleUpdateUserByID(ctx echo.Context, req *dto.UpdateRequest) error {
 	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "Неверный ID пользователя")
+		return newProblem(http.StatusBadRequest, "invalid_id", "Неверный ID пользователя")
 	}
-
-	updatedUser := &dto.USERS{
-		USERNAME: req.Username,
-		SURNAME:  req.Surname,
-		EMAIL:    req.Email,
-		PASSWORD: req.Password,
+	version, err := ifMatchVersion(ctx)
+	if err != nil {
+		return err
 	}
 
-	if err := h.usecase.UpdateUserByID(uint(id), updatedUser); err != nil {
-		if err.Error() == "user with this id not exists" {
-			return echo.NewHTTPError(http.StatusNotFound, map[string]string{"error": err.Error()})
-		}
-		return echo.NewHTTPError(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	user, emailChanged, err := h.usecase.UpdateUserByID(uint(id), version, service.Profile{
+		Username: req.Username,
+		Surname:  req.Surname,
+		Email:    req.Email,
+	})
+	if err != nil {
+		return err
+	}
+	// Новый email сбрасывает подтверждение, и письмо уходит на него так же, как при PATCH
+	if emailChanged {
+		h.sendVerification(ctx, user)
 	}
 
+	ctx.Response().Header().Set("ETag", userETag(user))
 	return ctx.JSON(http.StatusOK, "Пользователь успешно обновлен")
 }
@@ -1,18 +1,25 @@
 package auth
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/keys"
+	service "UserServiceAuth/internal/uscase"
+	"UserServiceAuth/internal/webauthn"
 	"UserServiceAuth/storage"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
 )
 
@@ -20,207 +27,893 @@ type MockHandlerUsecase struct {
 	mock.Mock
 }
 
-func (m *MockHandlerUsecase) RegisterUser(user *storage.USERS) error {
+func (m *MockHandlerUsecase) RegisterUser(login, password string, profile service.Profile) (*service.User, error) {
+	args := m.Called(login, password, profile)
+	user, _ := args.Get(0).(*service.User)
+	return user, args.Error(1)
+}
+
+func (m *MockHandlerUsecase) AuthenticateUser(login, password string, client service.ClientInfo) (*service.User, error) {
+	args := m.Called(login, password, client)
+	return args.Get(0).(*service.User), args.Error(1)
+}
+
+func (m *MockHandlerUsecase) UpdateUserByID(id, version uint, profile service.Profile) (*service.User, bool, error) {
+	args := m.Called(id, version, profile)
+	updated, _ := args.Get(0).(*service.User)
+	return updated, args.Bool(1), args.Error(2)
+}
+
+func (m *MockHandlerUsecase) GetUserByID(id uint) (*service.User, error) {
+	args := m.Called(id)
+	user, _ := args.Get(0).(*service.User)
+	return user, args.Error(1)
+}
+
+func (m *MockHandlerUsecase) ListUsers(filter storage.UserFilter) ([]service.User, int64, error) {
+	args := m.Called(filter)
+	users, _ := args.Get(0).([]service.User)
+	return users, args.Get(1).(int64), args.Error(2)
+}
+
+func (m *MockHandlerUsecase) DeleteUserByID(id uint) error {
+	return m.Called(id).Error(0)
+}
+
+func (m *MockHandlerUsecase) RestoreUserByID(id uint) error {
+	return m.Called(id).Error(0)
+}
+
+func (m *MockHandlerUsecase) UnlockUser(id, adminID uint) error {
+	return m.Called(id, adminID).Error(0)
+}
+
+func (m *MockHandlerUsecase) PatchUserByID(id, version uint, patch storage.UserPatch) (*service.User, bool, error) {
+	args := m.Called(id, version, patch)
+	user, _ := args.Get(0).(*service.User)
+	return user, args.Bool(1), args.Error(2)
+}
+
+func (m *MockHandlerUsecase) ChangePassword(id uint, currentPassword, newPassword string, client service.ClientInfo) error {
+	return m.Called(id, currentPassword, newPassword, client).Error(0)
+}
+
+func (m *MockHandlerUsecase) ConfirmPassword(id uint, password string, client service.ClientInfo) error {
+	return m.Called(id, password, client).Error(0)
+}
+
+type MockVerificationUsecase struct {
+	mock.Mock
+}
+
+func (m *MockVerificationUsecase) SendVerification(user *service.User) error {
 	args := m.Called(user)
 	return args.Error(0)
 }
 
-func (m *MockHandlerUsecase) AuthenticateUser(login, password string) (*storage.USERS, error) {
-	args := m.Called(login, password)
-	return args.Get(0).(*storage.USERS), args.Error(1)
+func (m *MockVerificationUsecase) ResendVerification(email string) error {
+	args := m.Called(email)
+	return args.Error(0)
+}
+
+func (m *MockVerificationUsecase) VerifyEmail(token string) error {
+	args := m.Called(token)
+	return args.Error(0)
+}
+
+type MockPasswordResetUsecase struct {
+	mock.Mock
+}
+
+func (m *MockPasswordResetUsecase) ForgotPassword(email string) error {
+	return m.Called(email).Error(0)
+}
+
+func (m *MockPasswordResetUsecase) ResetPassword(token, newPassword string) error {
+	return m.Called(token, newPassword).Error(0)
+}
+
+type MockMFAUsecase struct {
+	mock.Mock
+}
+
+func (m *MockMFAUsecase) BeginEnrollment(userID uint) (*service.TOTPEnrollment, error) {
+	args := m.Called(userID)
+	enrollment, _ := args.Get(0).(*service.TOTPEnrollment)
+	return enrollment, args.Error(1)
+}
+
+func (m *MockMFAUsecase) ConfirmEnrollment(userID uint, code string) ([]string, error) {
+	args := m.Called(userID, code)
+	codes, _ := args.Get(0).([]string)
+	return codes, args.Error(1)
+}
+
+func (m *MockMFAUsecase) Disable(userID uint, code string) error {
+	return m.Called(userID, code).Error(0)
+}
+
+func (m *MockMFAUsecase) Confirm(userID uint, code string) error {
+	return m.Called(userID, code).Error(0)
+}
+
+func (m *MockMFAUsecase) Challenge(user *service.User) (*service.MFAChallenge, error) {
+	args := m.Called(user)
+	challenge, _ := args.Get(0).(*service.MFAChallenge)
+	return challenge, args.Error(1)
+}
+
+func (m *MockMFAUsecase) CompleteChallenge(token, code string) (*service.User, error) {
+	args := m.Called(token, code)
+	user, _ := args.Get(0).(*service.User)
+	return user, args.Error(1)
+}
+
+func (m *MockMFAUsecase) CompleteChallengeWith(token string, verify func(user *service.User) error) (*service.User, error) {
+	args := m.Called(token)
+	user, _ := args.Get(0).(*service.User)
+	if err := args.Error(1); err != nil {
+		return nil, err
+	}
+	// Проверка второго фактора выполняется так же, как в сервисе
+	if err := verify(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (m *MockMFAUsecase) PendingUser(token string) (*service.User, error) {
+	args := m.Called(token)
+	user, _ := args.Get(0).(*service.User)
+	return user, args.Error(1)
+}
+
+type MockWebAuthnUsecase struct {
+	mock.Mock
+}
+
+func (m *MockWebAuthnUsecase) BeginRegistration(userID uint) (*service.WebAuthnRegistration, error) {
+	args := m.Called(userID)
+	registration, _ := args.Get(0).(*service.WebAuthnRegistration)
+	return registration, args.Error(1)
+}
+
+func (m *MockWebAuthnUsecase) FinishRegistration(userID uint, token, name string, cred *webauthn.CredentialCreation) (*storage.WEBAUTHNCREDENTIALS, error) {
+	args := m.Called(userID, token, name, cred)
+	stored, _ := args.Get(0).(*storage.WEBAUTHNCREDENTIALS)
+	return stored, args.Error(1)
+}
+
+func (m *MockWebAuthnUsecase) BeginLogin(user *service.User) (*service.WebAuthnLogin, error) {
+	args := m.Called(user)
+	login, _ := args.Get(0).(*service.WebAuthnLogin)
+	return login, args.Error(1)
+}
+
+func (m *MockWebAuthnUsecase) FinishLogin(token string, assertion *webauthn.CredentialAssertion, user *service.User) (*service.User, error) {
+	args := m.Called(token, assertion, user)
+	owner, _ := args.Get(0).(*service.User)
+	return owner, args.Error(1)
+}
+
+func (m *MockWebAuthnUsecase) Credentials(userID uint) ([]storage.WEBAUTHNCREDENTIALS, error) {
+	args := m.Called(userID)
+	creds, _ := args.Get(0).([]storage.WEBAUTHNCREDENTIALS)
+	return creds, args.Error(1)
+}
+
+func (m *MockWebAuthnUsecase) HasCredentials(userID uint) (bool, error) {
+	args := m.Called(userID)
+	return args.Bool(0), args.Error(1)
 }
 
-func (m *MockHandlerUsecase) UpdateUserByID(id uint, user *storage.USERS) error {
-	args := m.Called(id, user)
+func (m *MockWebAuthnUsecase) BeginConfirmation(userID uint) (*service.WebAuthnLogin, error) {
+	args := m.Called(userID)
+	confirmation, _ := args.Get(0).(*service.WebAuthnLogin)
+	return confirmation, args.Error(1)
+}
+
+func (m *MockWebAuthnUsecase) Confirm(userID uint, token string, assertion *webauthn.CredentialAssertion) error {
+	return m.Called(userID, token, assertion).Error(0)
+}
+
+func (m *MockWebAuthnUsecase) DeleteCredential(userID, id uint) error {
+	return m.Called(userID, id).Error(0)
+}
+
+type MockTokenUsecase struct {
+	mock.Mock
+}
+
+func (m *MockTokenUsecase) IssueTokens(user *service.User, client service.ClientInfo) (*service.TokenPair, error) {
+	args := m.Called(user, client)
+	tokens, _ := args.Get(0).(*service.TokenPair)
+	return tokens, args.Error(1)
+}
+
+func (m *MockTokenUsecase) IssueMFATokens(user *service.User, client service.ClientInfo) (*service.TokenPair, error) {
+	args := m.Called(user, client)
+	tokens, _ := args.Get(0).(*service.TokenPair)
+	return tokens, args.Error(1)
+}
+
+func (m *MockTokenUsecase) IssueWebAuthnTokens(user *service.User, client service.ClientInfo, passwordless bool) (*service.TokenPair, error) {
+	args := m.Called(user, client, passwordless)
+	tokens, _ := args.Get(0).(*service.TokenPair)
+	return tokens, args.Error(1)
+}
+
+func (m *MockTokenUsecase) Refresh(refreshToken string, client service.ClientInfo) (*service.TokenPair, error) {
+	args := m.Called(refreshToken, client)
+	tokens, _ := args.Get(0).(*service.TokenPair)
+	return tokens, args.Error(1)
+}
+
+func (m *MockTokenUsecase) Authenticate(token string) (*service.AccessClaims, error) {
+	args := m.Called(token)
+	claims, _ := args.Get(0).(*service.AccessClaims)
+	return claims, args.Error(1)
+}
+
+func (m *MockTokenUsecase) Sessions(userID uint) ([]storage.TOKENS, error) {
+	args := m.Called(userID)
+	sessions, _ := args.Get(0).([]storage.TOKENS)
+	return sessions, args.Error(1)
+}
+
+func (m *MockTokenUsecase) RevokeSession(userID, sessionID uint) error {
+	args := m.Called(userID, sessionID)
 	return args.Error(0)
 }
 
+func (m *MockTokenUsecase) Logout(claims *service.AccessClaims) error {
+	return m.Called(claims).Error(0)
+}
+
+func (m *MockTokenUsecase) LogoutAll(userID uint) error {
+	return m.Called(userID).Error(0)
+}
+
+func (m *MockTokenUsecase) LogoutOthers(userID, sessionID uint) error {
+	return m.Called(userID, sessionID).Error(0)
+}
+
+func (m *MockTokenUsecase) RevokeToken(token, tokenTypeHint string) error {
+	return m.Called(token, tokenTypeHint).Error(0)
+}
+
+func (m *MockTokenUsecase) IsTokenRevoked(jti string) (bool, error) {
+	args := m.Called(jti)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockTokenUsecase) RevokedTokens() ([]storage.REVOKEDTOKENS, error) {
+	args := m.Called()
+	tokens, _ := args.Get(0).([]storage.REVOKEDTOKENS)
+	return tokens, args.Error(1)
+}
+
+func (m *MockTokenUsecase) Issuer() string {
+	return m.Called().String(0)
+}
+
+func (m *MockTokenUsecase) JWKS() (*keys.JWKS, error) {
+	args := m.Called()
+	return args.Get(0).(*keys.JWKS), args.Error(1)
+}
+
+// testRouter - роутер, у которого все сценарии заменены моками
+type testRouter struct {
+	e            *echo.Echo
+	router       *HttpRouter
+	usecase      *MockHandlerUsecase
+	tokens       *MockTokenUsecase
+	verification *MockVerificationUsecase
+	resets       *MockPasswordResetUsecase
+	mfa          *MockMFAUsecase
+	webauthn     *MockWebAuthnUsecase
+	mail         *MailQueue
+}
+
+func newTestRouter() *testRouter {
+	r := &testRouter{
+		e:            echo.New(),
+		usecase:      new(MockHandlerUsecase),
+		tokens:       new(MockTokenUsecase),
+		verification: new(MockVerificationUsecase),
+		resets:       new(MockPasswordResetUsecase),
+		mfa:          new(MockMFAUsecase),
+		webauthn:     new(MockWebAuthnUsecase),
+	}
+	r.mail = NewMailQueue(config.MailQueueConfig{Size: 32, Workers: 1, PerEmail: 3, PerIP: 20, Window: time.Hour}, r.e.Logger)
+	r.router = NewHttpRouter(r.e, Dependencies{
+		Users:        r.usecase,
+		Tokens:       r.tokens,
+		Verification: r.verification,
+		Resets:       r.resets,
+		MFA:          r.mfa,
+		WebAuthn:     r.webauthn,
+		Mail:         r.mail,
+	}, validator.New())
+	return r
+}
+
+func newTestTokenPair() *service.TokenPair {
+	return &service.TokenPair{
+		Access: &service.AccessToken{
+			Token:     "header.payload.signature",
+			ID:        "jti",
+			ExpiresAt: time.Now().Add(time.Hour),
+		},
+		RefreshToken:     "family.secret",
+		RefreshExpiresAt: time.Now().Add(24 * time.Hour),
+	}
+}
+
+func newTestJWKS(t *testing.T) *keys.JWKS {
+	keyManager, err := keys.NewManager(t.TempDir(), keys.AlgEdDSA, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("Failed to create key manager: %v", err)
+	}
+	set, err := keyManager.JWKS()
+	if err != nil {
+		t.Fatalf("Failed to build JWKS: %v", err)
+	}
+	return set
+}
+
 func TestHandleLogin_ValidRequest(t *testing.T) {
 	assert := assert.New(t)
-	e := echo.New()
-	router := NewHttpRouter(e, &MockHandlerUsecase{}, validator.New())
+	r := newTestRouter()
 
 	reqBody := `{"login": "user_login", "password": "pAssw_ord123"}`
 	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(reqBody))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	rec := httptest.NewRecorder()
-	ctx := e.NewContext(req, rec)
 
-	mockUsecase := router.usecase.(*MockHandlerUsecase)
-	user := &storage.USERS{USERID: 1}
-	mockUsecase.On("AuthenticateUser", "user_login", "pAssw_ord123").Return(user, nil)
+	user := &service.User{ID: 1, Login: "user_login"}
+	r.usecase.On("AuthenticateUser", "user_login", "pAssw_ord123", mock.Anything).Return(user, nil)
 
-	err := router.handleLogin(ctx)
+	r.webauthn.On("HasCredentials", uint(1)).Return(false, nil)
+
+	r.tokens.On("IssueTokens", user, mock.Anything).Return(newTestTokenPair(), nil)
+
+	r.e.ServeHTTP(rec, req)
 
-	assert.NoError(err)
 	assert.Equal(http.StatusOK, rec.Code)
 
-	expectedResponse := `{"message":"User authenticated successfully","user":"jwt"}`
-	assert.JSONEq(expectedResponse, rec.Body.String())
+	var resp struct {
+		AccessToken  string              `json:"access_token"`
+		TokenType    string              `json:"token_type"`
+		ExpiresIn    int64               `json:"expires_in"`
+		RefreshToken string              `json:"refresh_token"`
+		User         userProfileResponse `json:"user"`
+	}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal("header.payload.signature", resp.AccessToken)
+	assert.Equal("Bearer", resp.TokenType)
+	assert.InDelta(3600, resp.ExpiresIn, 1)
+	assert.Equal("family.secret", resp.RefreshToken)
+	assert.Equal(uint(1), resp.User.UserID)
+	assert.Equal("user_login", resp.User.Login)
+	assert.NotContains(rec.Body.String(), "password")
+	assert.NotContains(rec.Body.String(), "argon2id")
+
+	r.usecase.AssertExpectations(t)
+	r.tokens.AssertExpectations(t)
+}
+
+func TestHandleRefresh_ValidRequest(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Refresh", "family.secret", mock.Anything).Return(newTestTokenPair(), nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(`{"refresh_token": "family.secret"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"access_token":"header.payload.signature"`)
+
+	r.tokens.AssertExpectations(t)
+}
+
+func TestHandleRefresh_ReusedToken(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Refresh", "family.old", mock.Anything).Return(nil, service.ErrRefreshTokenReused)
+
+	req := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(`{"refresh_token": "family.old"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusUnauthorized, rec.Code)
 
-	mockUsecase.AssertExpectations(t)
+	r.tokens.AssertExpectations(t)
 }
 
 func TestHandleLogin_InvalidRequest(t *testing.T) {
 	assert := assert.New(t)
-	e := echo.New()
-	router := NewHttpRouter(e, &MockHandlerUsecase{}, validator.New())
+	r := newTestRouter()
 
 	reqBody := `{"password": "pAssw_ord123"}`
 	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(reqBody))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	rec := httptest.NewRecorder()
-	ctx := e.NewContext(req, rec)
 
-	err := router.handleLogin(ctx)
+	r.e.ServeHTTP(rec, req)
 
 	assert.Equal(http.StatusBadRequest, rec.Code)
 
-	expectedResponse := `{"error":"Validation error","details":"Key: 'LoginRequest.Login' Error:Field validation for 'Login' failed on the 'required' tag"}`
+	expectedResponse := `{"type":"about:blank","title":"Bad Request","status":400,"code":"validation_failed","detail":"request validation failed","instance":"/login","invalid_params":[{"name":"login","reason":"required"}]}`
 	assert.JSONEq(expectedResponse, rec.Body.String())
 
-	assert.NoError(err)
+	r.usecase.AssertNotCalled(t, "AuthenticateUser")
+}
+
+func TestHandleLogin_ContentTypeWithCharset(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	user := &service.User{ID: 1, Login: "user_login"}
+	r.usecase.On("AuthenticateUser", "user_login", "pAssw_ord123", mock.Anything).Return(user, nil)
+	r.webauthn.On("HasCredentials", uint(1)).Return(false, nil)
+	r.tokens.On("IssueTokens", user, mock.Anything).Return(newTestTokenPair(), nil)
+
+	reqBody := `{"login": "user_login", "password": "pAssw_ord123"}`
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(reqBody))
+	req.Header.Set(echo.HeaderContentType, "application/json; charset=utf-8")
+	rec := httptest.NewRecorder()
+
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+}
+
+func TestHandleLogin_UnsupportedContentType(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("login=user_login"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusUnsupportedMediaType, rec.Code)
 }
 
 func TestHandleRegister_ValidRequest(t *testing.T) {
 	assert := assert.New(t)
-	e := echo.New()
-	router := NewHttpRouter(e, &MockHandlerUsecase{}, validator.New())
+	r := newTestRouter()
 
 	reqBody := `{"username": "John", "surname": "Doe", "email": "john.doe@example.com", "login": "johndoe", "password": "securePwd123"}`
 	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(reqBody))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	rec := httptest.NewRecorder()
-	ctx := e.NewContext(req, rec)
 
-	mockUsecase := router.usecase.(*MockHandlerUsecase)
-	mockUsecase.On("RegisterUser", mock.Anything).Return(nil)
+	user := &service.User{ID: 7, Email: "john.doe@example.com", Login: "johndoe", Username: "John", Surname: "Doe", Role: storage.RoleUser}
+	r.usecase.On("RegisterUser", "johndoe", "securePwd123", service.Profile{
+		Username: "John",
+		Surname:  "Doe",
+		Email:    "john.doe@example.com",
+	}).Return(user, nil)
+	r.verification.On("SendVerification", user).Return(nil)
 
-	err := router.handleRegister(ctx)
+	r.e.ServeHTTP(rec, req)
 
-	assert.NoError(err)
 	assert.Equal(http.StatusCreated, rec.Code)
 
-	expectedResponse := `"User registered successfully"`
-	assert.Equal(strings.TrimSpace(expectedResponse), strings.TrimSpace(rec.Body.String()))
-
-	mockUsecase.AssertExpectations(t)
+	var resp struct {
+		Message string              `json:"message"`
+		User    userProfileResponse `json:"user"`
+	}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal("Пользователь успешно зарегистрирован", resp.Message)
+	assert.Equal(userProfileResponse{
+		UserID:   7,
+		Email:    "john.doe@example.com",
+		Login:    "johndoe",
+		Username: "John",
+		Surname:  "Doe",
+		Role:     storage.RoleUser,
+	}, resp.User)
+	assert.NotContains(rec.Body.String(), "password")
+	assert.NotContains(rec.Body.String(), "securePwd123")
+
+	r.usecase.AssertExpectations(t)
+	r.verification.AssertExpectations(t)
 }
 
 func TestHandleRegister_InvalidRequest(t *testing.T) {
 	assert := assert.New(t)
-	e := echo.New()
-	router := NewHttpRouter(e, &MockHandlerUsecase{}, validator.New())
+	r := newTestRouter()
 
 	reqBody := `{"surname": "Doe", "email": "john.doe@example.com", "login": "johndoe", "password": "securePwd123"}`
 	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(reqBody))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	rec := httptest.NewRecorder()
-	ctx := e.NewContext(req, rec)
 
-	err := router.handleRegister(ctx)
+	r.e.ServeHTTP(rec, req)
 
 	assert.Equal(http.StatusBadRequest, rec.Code)
 
-	expectedResponse := `{"error":"Validation error","details":"Key: 'RegisterRequest.Username' Error:Field validation for 'Username' failed on the 'required' tag"}`
-	assert.JSONEq(expectedResponse, rec.Body.String())
-
-	assert.NoError(err)
+	var problem Problem
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &problem))
+	assert.Equal("validation_failed", problem.Code)
+	assert.Equal([]InvalidParam{{Name: "username", Reason: "required"}}, problem.InvalidParams)
 }
 
 func TestHandleRegister_UsecaseError(t *testing.T) {
 	assert := assert.New(t)
-	e := echo.New()
-	router := NewHttpRouter(e, &MockHandlerUsecase{}, validator.New())
+	r := newTestRouter()
 
 	reqBody := `{"username": "John", "surname": "Doe", "email": "john.doe@example.com", "login": "johndoe", "password": "securePwd123"}`
 	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(reqBody))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	rec := httptest.NewRecorder()
-	ctx := e.NewContext(req, rec)
-
-	mockUsecase := router.usecase.(*MockHandlerUsecase)
-	mockUsecase.On("RegisterUser", mock.Anything).Return(errors.New("Database error"))
 
-	err := router.handleRegister(ctx)
-	assert.NoError(err)
+	r.usecase.On("RegisterUser", mock.Anything, mock.Anything, mock.Anything).Return(nil, errors.New("Database error"))
 
-	assert.Equal(http.StatusBadRequest, rec.Code)
+	r.e.ServeHTTP(rec, req)
 
-	expectedResponse := `{"error":"Database error"}`
-	assert.JSONEq(expectedResponse, rec.Body.String())
+	assert.Equal(http.StatusInternalServerError, rec.Code)
+	assert.NotContains(rec.Body.String(), "Database error")
 
-	mockUsecase.AssertExpectations(t)
+	r.usecase.AssertExpectations(t)
 }
 
 func TestHandleRegister_DuplicateLogin(t *testing.T) {
 	assert := assert.New(t)
-	e := echo.New()
-	router := NewHttpRouter(e, &MockHandlerUsecase{}, validator.New())
+	r := newTestRouter()
 
 	reqBody := `{"username": "John", "surname": "Doe", "email": "newuser@example.com", "login": "johndoe", "password": "securePwd123"}`
 	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(reqBody))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	rec := httptest.NewRecorder()
-	ctx := e.NewContext(req, rec)
 
-	mockUsecase := router.usecase.(*MockHandlerUsecase)
-	mockUsecase.On("RegisterUser", mock.Anything).Return(errors.New("DuplicateLogin"))
+	r.usecase.On("RegisterUser", mock.Anything, mock.Anything, mock.Anything).Return(nil, &service.ConflictError{Field: "login"})
 
-	err := router.handleRegister(ctx)
-	assert.NoError(err)
+	r.e.ServeHTTP(rec, req)
 
-	assert.Equal(http.StatusBadRequest, rec.Code)
+	assert.Equal(http.StatusConflict, rec.Code)
 
-	expectedResponse := `{"error":"DuplicateLogin"}`
-	assert.JSONEq(expectedResponse, rec.Body.String())
+	var problem Problem
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &problem))
+	assert.Equal("user_exists", problem.Code)
+	assert.Equal([]InvalidParam{{Name: "login", Reason: "unique"}}, problem.InvalidParams)
+
+	r.usecase.AssertExpectations(t)
+}
+
+func TestHandleRegister_DuplicateEmail(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	reqBody := `{"username": "John", "surname": "Doe", "email": "taken@example.com", "login": "newlogin", "password": "securePwd123"}`
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(reqBody))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	r.usecase.On("RegisterUser", mock.Anything, mock.Anything, mock.Anything).Return(nil, &service.ConflictError{Field: "email"})
+
+	r.e.ServeHTTP(rec, req)
 
-	mockUsecase.AssertExpectations(t)
+	assert.Equal(http.StatusConflict, rec.Code)
+	assert.Equal(MIMEApplicationProblemJSON, rec.Header().Get(echo.HeaderContentType))
+
+	var problem Problem
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &problem))
+	assert.Equal("email is already taken", problem.Detail)
+	assert.Equal([]InvalidParam{{Name: "email", Reason: "unique"}}, problem.InvalidParams)
 }
 
 func TestHandleUpdateUserByID_UserNotFound(t *testing.T) {
 	assert := assert.New(t)
-	e := echo.New()
-	mockUsecase := new(MockHandlerUsecase)
-	router := NewHttpRouter(e, mockUsecase, validator.New())
+	r := newTestRouter()
+
+	claims := newTestClaims("1", 2)
+	claims.Roles = []string{storage.RoleAdmin}
+	r.tokens.On("Authenticate", "access").Return(claims, nil)
 
-	reqBody := `{"login": "newlogin", "username": "John", "surname": "Doe", "email": "john.doe@example.com", "password": "newPwd123"}`
+	reqBody := `{"username": "John", "surname": "Doe", "email": "john.doe@example.com"}`
 	req := httptest.NewRequest(http.MethodPut, "/update/999", strings.NewReader(reqBody))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	req.Header.Set("If-Match", `"1"`)
 	rec := httptest.NewRecorder()
-	ctx := e.NewContext(req, rec)
-	ctx.SetParamNames("id")
-	ctx.SetParamValues("999")
 
-	mockUsecase.On("UpdateUserByID", uint(999), mock.Anything).Return(errors.New("user with this id not exists"))
+	r.usecase.On("UpdateUserByID", uint(999), uint(1), service.Profile{
+		Username: "John",
+		Surname:  "Doe",
+		Email:    "john.doe@example.com",
+	}).Return(nil, false, service.ErrUserNotFound)
 
-	err := router.handleUpdateUserByID(ctx)
+	r.e.ServeHTTP(rec, req)
 
-	assert.NoError(err)
 	assert.Equal(http.StatusNotFound, rec.Code)
 
-	expectedResponse := `{"error":"user with this id not exists"}`
-	assert.JSONEq(expectedResponse, rec.Body.String())
+	var problem Problem
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &problem))
+	assert.Equal("user_not_found", problem.Code)
+
+	r.usecase.AssertExpectations(t)
+}
+
+func TestHandleUpdateUserByID_SendsVerificationForNewEmail(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("5", 2), nil)
+	user := &service.User{ID: 5, Email: "new@example.com", Version: 2}
+	r.usecase.On("UpdateUserByID", uint(5), uint(1), mock.Anything).Return(user, true, nil)
+	r.verification.On("SendVerification", user).Return(nil)
+
+	reqBody := `{"username": "John", "surname": "Doe", "email": "new@example.com"}`
+	req := httptest.NewRequest(http.MethodPut, "/update/5", strings.NewReader(reqBody))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	req.Header.Set("If-Match", `"1"`)
+	rec := httptest.NewRecorder()
+
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(`"2"`, rec.Header().Get("ETag"))
+	r.verification.AssertExpectations(t)
+}
 
-	mockUsecase.AssertExpectations(t)
+func TestHandleUpdateUserByID_SameEmailSendsNothing(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("5", 2), nil)
+	// Адрес не подтверждён, но не менялся: письмо не отправляется при каждом обновлении профиля
+	user := &service.User{ID: 5, Email: "john.doe@example.com", Version: 3}
+	r.usecase.On("UpdateUserByID", uint(5), uint(2), mock.Anything).Return(user, false, nil)
+
+	reqBody := `{"username": "John", "surname": "Doe", "email": "john.doe@example.com"}`
+	req := httptest.NewRequest(http.MethodPut, "/update/5", strings.NewReader(reqBody))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	req.Header.Set("If-Match", `"2"`)
+	rec := httptest.NewRecorder()
+
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(`"3"`, rec.Header().Get("ETag"))
+	r.verification.AssertNotCalled(t, "SendVerification", mock.Anything)
 }
+
 func TestHandleUpdateUserByID_InvalidRequest(t *testing.T) {
 	assert := assert.New(t)
-	e := echo.New()
-	router := NewHttpRouter(e, &MockHandlerUsecase{}, validator.New())
+	r := newTestRouter()
 
-	reqBody := `{"login": "updated_login", "username": "Updated", "surname": "User", "email": "updated@example.com", "password": "updatedPassword"}`
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("5", 2), nil)
+
+	// Раньше тело /update/:id не проверялось вовсе. Пароль без текущего через PUT не меняется.
+	reqBody := `{"username": "Updated", "surname": "User", "email": "not-an-email", "password": "updatedPassword"}`
+	req := httptest.NewRequest(http.MethodPut, "/update/5", strings.NewReader(reqBody))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	req.Header.Set("If-Match", `"1"`)
+	rec := httptest.NewRecorder()
+
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusBadRequest, rec.Code)
+
+	var problem Problem
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &problem))
+	assert.Equal([]InvalidParam{{Name: "email", Reason: "email"}, {Name: "password", Reason: "isdefault"}}, problem.InvalidParams)
+
+	r.usecase.AssertNotCalled(t, "UpdateUserByID")
+}
+
+func TestHandleUpdateUserByID_InvalidID(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("5", 2), nil)
+
+	reqBody := `{"username": "Updated", "surname": "User", "email": "updated@example.com"}`
 	req := httptest.NewRequest(http.MethodPut, "/update/invalid_id", strings.NewReader(reqBody))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
 	rec := httptest.NewRecorder()
-	ctx := e.NewContext(req, rec)
 
-	err := router.handleUpdateUserByID(ctx)
+	r.e.ServeHTTP(rec, req)
 
 	assert.Equal(http.StatusBadRequest, rec.Code)
+	assert.Contains(rec.Body.String(), `"code":"invalid_id"`)
+}
 
-	expectedResponse := `{"error":"Invalid user ID"}`
-	assert.JSONEq(expectedResponse, rec.Body.String())
+func TestHandleJWKS(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("JWKS").Return(newTestJWKS(t), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("public, max-age=300", rec.Header().Get(echo.HeaderCacheControl))
+
+	var set keys.JWKS
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &set))
+	if assert.Len(set.Keys, 1) {
+		assert.Equal("OKP", set.Keys[0].Kty)
+		assert.Equal("Ed25519", set.Keys[0].Crv)
+		assert.Equal(keys.AlgEdDSA, set.Keys[0].Alg)
+	}
+
+	// Повторный запрос с тем же ETag не должен возвращать тело
+	etag := rec.Header().Get("ETag")
+	req = httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusNotModified, rec.Code)
+	assert.Empty(rec.Body.String())
+}
+
+func TestHandleOpenIDConfiguration(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Issuer").Return("https://auth.example.com")
+
+	req := httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil)
+	// Адреса берутся из issuer, а не из заголовка Host
+	req.Host = "attacker.example.com"
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var doc map[string]interface{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &doc))
+	assert.Equal(map[string]interface{}{
+		"issuer":              "https://auth.example.com",
+		"jwks_uri":            "https://auth.example.com/.well-known/jwks.json",
+		"revocation_endpoint": "https://auth.example.com/revoke",
+		"revocation_endpoint_auth_methods_supported": []interface{}{"none"},
+	}, doc)
+}
+
+func newTestClaims(userID string, sessionID uint) *service.AccessClaims {
+	return &service.AccessClaims{
+		Login:            "johndoe",
+		Roles:            []string{"user"},
+		SessionID:        sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: userID, ID: "jti"},
+	}
+}
+
+func TestHandleListSessions(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+	r.tokens.On("Sessions", uint(7)).Return([]storage.TOKENS{
+		{IDTOKENS: 2, USERID: 7, USERAGENT: "laptop", IP: "10.0.0.1"},
+		{IDTOKENS: 3, USERID: 7, USERAGENT: "phone", IP: "10.0.0.2"},
+	}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+
+	var sessions []sessionResponse
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &sessions))
+	if assert.Len(sessions, 2) {
+		assert.True(sessions[0].Current)
+		assert.Equal("phone", sessions[1].UserAgent)
+		assert.False(sessions[1].Current)
+	}
+
+	r.tokens.AssertExpectations(t)
+}
+
+func TestHandleListSessions_Unauthorized(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+}
+
+func TestHandleRevokeSession_NotFound(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+	r.tokens.On("RevokeSession", uint(7), uint(42)).Return(service.ErrSessionNotFound)
+
+	req := httptest.NewRequest(http.MethodDelete, "/sessions/42", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusNotFound, rec.Code)
+
+	r.tokens.AssertExpectations(t)
+}
+
+func TestHandleLogout(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	claims := newTestClaims("7", 2)
+	r.tokens.On("Authenticate", "access").Return(claims, nil)
+	r.tokens.On("Logout", claims).Return(nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+
+	r.tokens.AssertExpectations(t)
+}
+
+func TestHandleRevoke_FormEncoded(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("RevokeToken", "family.secret", "refresh_token").Return(nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/revoke", strings.NewReader("token=family.secret&token_type_hint=refresh_token"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Empty(rec.Body.String())
+
+	r.tokens.AssertExpectations(t)
+}
+
+func TestHandleRevoke_MissingToken(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	req := httptest.NewRequest(http.MethodPost, "/revoke", strings.NewReader("token_type_hint=refresh_token"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusBadRequest, rec.Code)
+	assert.JSONEq(`{"error":"invalid_request"}`, rec.Body.String())
+}
+
+func TestHandleCheckRevoked(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("IsTokenRevoked", "abc").Return(true, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/revoked/abc", nil)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.JSONEq(`{"jti":"abc","revoked":true}`, rec.Body.String())
 
-	assert.NoError(err)
+	r.tokens.AssertExpectations(t)
 }
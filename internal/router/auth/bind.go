@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// withBody оборачивает обработчик, которому нужно тело запроса типа T.
+// Тело разбирается и проверяется валидатором до вызова обработчика.
+func withBody[T any](h *HttpRouter, handler func(ctx echo.Context, req *T) error) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		req := new(T)
+		if err := h.bindBody(ctx, req); err != nil {
+			return err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (h *HttpRouter) bindBody(ctx echo.Context, req interface{}) error {
+	if err := requireJSON(ctx); err != nil {
+		return err
+	}
+	if err := (&echo.DefaultBinder{}).BindBody(ctx, req); err != nil {
+		return newProblem(http.StatusBadRequest, "invalid_body", "Invalid request body")
+	}
+	if err := h.validator.Struct(req); err != nil {
+		return validationProblem(err)
+	}
+	return nil
+}
+
+// requireJSON пропускает запросы без тела и JSON с параметрами, например charset
+func requireJSON(ctx echo.Context) error {
+	req := ctx.Request()
+	if req.ContentLength == 0 {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+	if err != nil || mediaType != echo.MIMEApplicationJSON {
+		return newProblem(http.StatusUnsupportedMediaType, "unsupported_media_type", "Invalid Content-Type, expected application/json")
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	service "UserServiceAuth/internal/uscase"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+)
+
+const MIMEApplicationProblemJSON = "application/problem+json"
+
+// Problem - ответ об ошибке в формате RFC 7807. Code - стабильный машиночитаемый код,
+// на который могут опираться клиенты; Detail предназначен для человека.
+type Problem struct {
+	Type          string         `json:"type"`
+	Title         string         `json:"title"`
+	Status        int            `json:"status"`
+	Code          string         `json:"code"`
+	Detail        string         `json:"detail,omitempty"`
+	Instance      string         `json:"instance,omitempty"`
+	InvalidParams []InvalidParam `json:"invalid_params,omitempty"`
+}
+
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Title
+}
+
+func newProblem(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+// validationProblem описывает ошибки валидатора по полям
+func validationProblem(err error) *Problem {
+	problem := newProblem(http.StatusBadRequest, "validation_failed", "request validation failed")
+
+	var fieldErrors validator.ValidationErrors
+	if errors.As(err, &fieldErrors) {
+		for _, fieldError := range fieldErrors {
+			problem.InvalidParams = append(problem.InvalidParams, InvalidParam{
+				Name:   fieldError.Field(),
+				Reason: fieldError.Tag(),
+			})
+		}
+	}
+	return problem
+}
+
+// Соответствие ошибок предметной области HTTP-статусам и кодам
+var domainProblems = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{service.ErrUserNotFound, http.StatusNotFound, "user_not_found"},
+	{service.ErrDeletedUserNotFound, http.StatusNotFound, "deleted_user_not_found"},
+	{service.ErrUserExists, http.StatusConflict, "user_exists"},
+	{service.ErrInvalidCredentials, http.StatusUnauthorized, "invalid_credentials"},
+	{service.ErrTooManyAttempts, http.StatusTooManyRequests, "too_many_attempts"},
+	{service.ErrInvalidCurrentPassword, http.StatusForbidden, "invalid_current_password"},
+	{service.ErrVersionConflict, http.StatusPreconditionFailed, "version_conflict"},
+	{service.ErrEmailNotVerified, http.StatusForbidden, "email_not_verified"},
+	{service.ErrEmailAlreadyVerified, http.StatusConflict, "email_already_verified"},
+	{service.ErrInvalidVerificationToken, http.StatusBadRequest, "invalid_verification_token"},
+	{service.ErrInvalidResetToken, http.StatusBadRequest, "invalid_reset_token"},
+	{service.ErrMFAAlreadyEnabled, http.StatusConflict, "mfa_already_enabled"},
+	{service.ErrMFANotEnabled, http.StatusConflict, "mfa_not_enabled"},
+	{service.ErrInvalidMFACode, http.StatusUnauthorized, "invalid_mfa_code"},
+	{service.ErrInvalidMFAToken, http.StatusUnauthorized, "invalid_mfa_token"},
+	{service.ErrInvalidWebAuthnCeremony, http.StatusBadRequest, "invalid_webauthn_ceremony"},
+	{service.ErrInvalidWebAuthnAttestation, http.StatusBadRequest, "invalid_webauthn_attestation"},
+	{service.ErrInvalidWebAuthnAssertion, http.StatusUnauthorized, "invalid_webauthn_assertion"},
+	{service.ErrCredentialExists, http.StatusConflict, "webauthn_credential_exists"},
+	{service.ErrCredentialNotFound, http.StatusNotFound, "webauthn_credential_not_found"},
+	{service.ErrLastSecondFactor, http.StatusConflict, "last_second_factor"},
+	{service.ErrConfirmationRequired, http.StatusForbidden, "confirmation_required"},
+	{service.ErrInvalidAccessToken, http.StatusUnauthorized, "invalid_token"},
+	{service.ErrAccessTokenRevoked, http.StatusUnauthorized, "token_revoked"},
+	{service.ErrInvalidRefreshToken, http.StatusUnauthorized, "invalid_refresh_token"},
+	{service.ErrRefreshTokenReused, http.StatusUnauthorized, "refresh_token_reused"},
+	{service.ErrSessionNotFound, http.StatusNotFound, "session_not_found"},
+}
+
+// toProblem переводит любую ошибку обработчика в Problem. Неизвестные ошибки
+// становятся 500 без подробностей, чтобы не раскрывать внутреннее устройство.
+func toProblem(err error) *Problem {
+	var problem *Problem
+	if errors.As(err, &problem) {
+		return problem
+	}
+
+	var conflict *service.ConflictError
+	if errors.As(err, &conflict) {
+		problem := newProblem(http.StatusConflict, "user_exists", conflict.Error())
+		problem.InvalidParams = []InvalidParam{{Name: conflict.Field, Reason: "unique"}}
+		return problem
+	}
+
+	for _, known := range domainProblems {
+		if errors.Is(err, known.err) {
+			return newProblem(known.status, known.code, known.err.Error())
+		}
+	}
+
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		detail := ""
+		if message, ok := httpErr.Message.(string); ok && message != http.StatusText(httpErr.Code) {
+			detail = message
+		}
+		return newProblem(httpErr.Code, statusCode(httpErr.Code), detail)
+	}
+
+	return newProblem(http.StatusInternalServerError, "internal_error", "")
+}
+
+// statusCode строит код из текста статуса: 404 -> "not_found"
+func statusCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// handleError - единый обработчик ошибок Echo
+func (h *HttpRouter) handleError(err error, ctx echo.Context) {
+	if ctx.Response().Committed {
+		return
+	}
+
+	problem := toProblem(err)
+	if problem.Status >= http.StatusInternalServerError {
+		ctx.Logger().Error(err)
+	}
+	problem.Instance = ctx.Request().URL.Path
+
+	var tooMany *service.TooManyAttemptsError
+	if errors.As(err, &tooMany) {
+		ctx.Response().Header().Set(echo.HeaderRetryAfter, strconv.FormatInt(int64(tooMany.RetryAfter/time.Second), 10))
+	}
+	ctx.Response().Header().Set(echo.HeaderContentType, MIMEApplicationProblemJSON)
+	if ctx.Request().Method == http.MethodHead {
+		err = ctx.NoContent(problem.Status)
+	} else {
+		err = ctx.JSON(problem.Status, problem)
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+	}
+}
@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	service "UserServiceAuth/internal/uscase"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func serveLogin(t *testing.T, body string, err error) (*httptest.ResponseRecorder, Problem) {
+	r := newTestRouter()
+	r.usecase.On("AuthenticateUser", "johndoe", "pAssw_ord123", mock.Anything).Return((*service.User)(nil), err)
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	var problem Problem
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &problem))
+	return rec, problem
+}
+
+func TestHandleError_DomainError(t *testing.T) {
+	assert := assert.New(t)
+
+	rec, problem := serveLogin(t, `{"login": "johndoe", "password": "pAssw_ord123"}`, service.ErrInvalidCredentials)
+
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+	assert.Equal(MIMEApplicationProblemJSON, rec.Header().Get(echo.HeaderContentType))
+	assert.Equal(Problem{
+		Type:     "about:blank",
+		Title:    "Unauthorized",
+		Status:   http.StatusUnauthorized,
+		Code:     "invalid_credentials",
+		Detail:   "invalid login or password",
+		Instance: "/login",
+	}, problem)
+}
+
+func TestHandleError_TooManyAttempts(t *testing.T) {
+	assert := assert.New(t)
+
+	err := &service.TooManyAttemptsError{RetryAfter: 30 * time.Second}
+	rec, problem := serveLogin(t, `{"login": "johndoe", "password": "pAssw_ord123"}`, err)
+
+	assert.Equal(http.StatusTooManyRequests, rec.Code)
+	assert.Equal("too_many_attempts", problem.Code)
+	assert.Equal("30", rec.Header().Get(echo.HeaderRetryAfter))
+}
+
+func TestHandleError_HidesInternalErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	rec, problem := serveLogin(t, `{"login": "johndoe", "password": "pAssw_ord123"}`, errors.New("pq: connection refused"))
+
+	assert.Equal(http.StatusInternalServerError, rec.Code)
+	assert.Equal("internal_error", problem.Code)
+	assert.NotContains(rec.Body.String(), "connection refused")
+}
+
+func TestHandleError_ValidationProblem(t *testing.T) {
+	assert := assert.New(t)
+
+	rec, problem := serveLogin(t, `{"login": "johndoe"}`, nil)
+
+	assert.Equal(http.StatusBadRequest, rec.Code)
+	assert.Equal("validation_failed", problem.Code)
+	assert.Equal([]InvalidParam{{Name: "password", Reason: "required"}}, problem.InvalidParams)
+}
+
+func TestHandleError_RouteNotFound(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/missing", nil)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusNotFound, rec.Code)
+	assert.Equal(MIMEApplicationProblemJSON, rec.Header().Get(echo.HeaderContentType))
+	assert.Contains(rec.Body.String(), `"code":"not_found"`)
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/labstack/echo/v4"
+)
+
+// NewIPExtractor определяет, откуда брать адрес клиента. Без доверенных прокси это адрес
+// соединения: заголовкам X-Forwarded-For и X-Real-IP нельзя верить, их задаёт сам клиент.
+// Если сервис стоит за прокси, X-Forwarded-For учитывается только до первого адреса не из
+// trustedProxies. Частные сети и loopback по умолчанию не доверяются.
+func NewIPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range trustedProxies {
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
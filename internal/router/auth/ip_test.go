@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewIPExtractor(t *testing.T) {
+	request := func(remoteAddr, forwardedFor string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(echo.HeaderXForwardedFor, forwardedFor)
+		req.Header.Set(echo.HeaderXRealIP, "203.0.113.99")
+		return req
+	}
+
+	// Без доверенных прокси заголовки клиента игнорируются
+	direct, err := NewIPExtractor(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "198.51.100.7", direct(request("198.51.100.7:5000", "203.0.113.1")))
+
+	proxied, err := NewIPExtractor([]string{"10.0.0.0/24"})
+	require.NoError(t, err)
+	// Через доверенный прокси берётся адрес, который он добавил
+	assert.Equal(t, "203.0.113.1", proxied(request("10.0.0.5:5000", "203.0.113.1")))
+	// Подставленный клиентом адрес перед адресом прокси не учитывается
+	assert.Equal(t, "198.51.100.7", proxied(request("10.0.0.5:5000", "192.0.2.50, 198.51.100.7")))
+	// В обход прокси заголовок не принимается, даже из частной сети
+	assert.Equal(t, "192.168.1.1", proxied(request("192.168.1.1:5000", "203.0.113.1")))
+
+	_, err = NewIPExtractor([]string{"10.0.0.1"})
+	assert.Error(t, err)
+}
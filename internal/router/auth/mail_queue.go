@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"UserServiceAuth/internal/config"
+	service "UserServiceAuth/internal/uscase"
+	dto "UserServiceAuth/storage"
+
+	"github.com/labstack/echo/v4"
+)
+
+// MailQueue отправляет в фоне письма, которые можно запросить без входа. Ответ на такой
+// запрос не ждёт базы и почты, поэтому по времени ответа нельзя узнать, зарегистрирован ли
+// адрес. Очередь и число обработчиков ограничены, а запросы на один адрес и с одного IP
+// ограничены по частоте, чтобы через сервис нельзя было завалить кого-то письмами.
+type MailQueue struct {
+	jobs    chan mailJob
+	logger  echo.Logger
+	emails  *requestLimiter
+	ips     *requestLimiter
+	dropped atomic.Uint64
+
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+type mailJob struct {
+	name string
+	send func() error
+}
+
+func NewMailQueue(cfg config.MailQueueConfig, logger echo.Logger) *MailQueue {
+	q := &MailQueue{
+		jobs:   make(chan mailJob, cfg.Size),
+		logger: logger,
+		emails: newRequestLimiter(cfg.PerEmail, cfg.Window),
+		ips:    newRequestLimiter(cfg.PerIP, cfg.Window),
+	}
+	for i := 0; i < max(cfg.Workers, 1); i++ {
+		q.workers.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+func (q *MailQueue) work() {
+	defer q.workers.Done()
+	for job := range q.jobs {
+		if err := job.send(); err != nil {
+			q.logger.Errorf("failed to send %s email: %v", job.name, err)
+		}
+	}
+}
+
+// Enqueue ставит письмо в очередь. Если лимит для адреса или IP исчерпан, возвращается
+// TooManyAttemptsError, а если очередь заполнена или закрыта - 503. Лимиты считаются для
+// любых адресов, поэтому и отказ ничего не говорит о том, зарегистрирован ли адрес.
+func (q *MailQueue) Enqueue(name, email, ip string, send func() error) error {
+	now := time.Now()
+	if ip != "" {
+		if wait, ok := q.ips.allow(ip, now); !ok {
+			return &service.TooManyAttemptsError{RetryAfter: wait}
+		}
+	}
+	if wait, ok := q.emails.allow(dto.NormalizeIdentifier(email), now); !ok {
+		return &service.TooManyAttemptsError{RetryAfter: wait}
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if !q.closed {
+		select {
+		case q.jobs <- mailJob{name: name, send: send}:
+			return nil
+		default:
+		}
+	}
+
+	dropped := q.dropped.Add(1)
+	q.logger.Warnf("mail queue is full, %s email dropped (%d dropped in total)", name, dropped)
+	return newProblem(http.StatusServiceUnavailable, "mail_queue_full", "too many pending emails, try again later")
+}
+
+// Dropped - сколько писем не попало в очередь с момента запуска
+func (q *MailQueue) Dropped() uint64 {
+	return q.dropped.Load()
+}
+
+// Close перестаёт принимать письма и ждёт, пока обработчики отправят уже поставленные в очередь
+func (q *MailQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// requestLimiter разрешает не больше limit запросов по ключу за окно window.
+// Счётчики живут в памяти процесса и удаляются, когда их окно закончилось.
+type requestLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	counters  map[string]*requestCounter
+	lastPurge time.Time
+}
+
+type requestCounter struct {
+	start time.Time
+	count int
+}
+
+func newRequestLimiter(limit int, window time.Duration) *requestLimiter {
+	return &requestLimiter{
+		limit:    limit,
+		window:   window,
+		counters: make(map[string]*requestCounter),
+	}
+}
+
+// allow учитывает запрос и возвращает false и время до конца окна, если лимит исчерпан.
+// Нулевой limit отключает ограничение.
+func (l *requestLimiter) allow(key string, now time.Time) (time.Duration, bool) {
+	if l.limit <= 0 {
+		return 0, true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPurge) >= l.window {
+		for k, counter := range l.counters {
+			if now.Sub(counter.start) >= l.window {
+				delete(l.counters, k)
+			}
+		}
+		l.lastPurge = now
+	}
+
+	counter, ok := l.counters[key]
+	if !ok || now.Sub(counter.start) >= l.window {
+		counter = &requestCounter{start: now}
+		l.counters[key] = counter
+	}
+	if counter.count >= l.limit {
+		return counter.start.Add(l.window).Sub(now), false
+	}
+	counter.count++
+	return 0, true
+}
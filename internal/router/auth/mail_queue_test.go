@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"UserServiceAuth/internal/config"
+	service "UserServiceAuth/internal/uscase"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailQueue_LimitsPerEmailAndIP(t *testing.T) {
+	q := NewMailQueue(config.MailQueueConfig{Size: 16, Workers: 1, PerEmail: 2, PerIP: 3, Window: time.Hour}, echo.New().Logger)
+	defer q.Close(context.Background())
+	send := func() error { return nil }
+
+	require.NoError(t, q.Enqueue("test", "john@example.com", "192.0.2.1", send))
+	// Адрес сравнивается после нормализации
+	require.NoError(t, q.Enqueue("test", " John@Example.com", "192.0.2.2", send))
+	err := q.Enqueue("test", "john@example.com", "192.0.2.3", send)
+	var tooMany *service.TooManyAttemptsError
+	require.ErrorAs(t, err, &tooMany)
+	assert.InDelta(t, time.Hour, tooMany.RetryAfter, float64(time.Second))
+
+	// С одного IP нельзя обойти лимит, перебирая адреса
+	require.NoError(t, q.Enqueue("test", "a@example.com", "192.0.2.1", send))
+	require.NoError(t, q.Enqueue("test", "b@example.com", "192.0.2.1", send))
+	assert.ErrorIs(t, q.Enqueue("test", "c@example.com", "192.0.2.1", send), service.ErrTooManyAttempts)
+}
+
+func TestMailQueue_DropsWhenFull(t *testing.T) {
+	q := NewMailQueue(config.MailQueueConfig{Size: 1, Workers: 1}, echo.New().Logger)
+
+	// Обработчик занят первым письмом, второе ждёт в очереди, третьему места нет
+	started, release := make(chan struct{}), make(chan struct{})
+	require.NoError(t, q.Enqueue("test", "a@example.com", "", func() error {
+		close(started)
+		<-release
+		return nil
+	}))
+	<-started
+	require.NoError(t, q.Enqueue("test", "b@example.com", "", func() error { return nil }))
+
+	err := q.Enqueue("test", "c@example.com", "", func() error { return nil })
+	var problem *Problem
+	require.ErrorAs(t, err, &problem)
+	assert.Equal(t, http.StatusServiceUnavailable, problem.Status)
+	assert.Equal(t, uint64(1), q.Dropped())
+
+	close(release)
+	require.NoError(t, q.Close(context.Background()))
+}
+
+func TestMailQueue_CloseWaitsForQueuedMail(t *testing.T) {
+	q := NewMailQueue(config.MailQueueConfig{Size: 4, Workers: 1}, echo.New().Logger)
+
+	sent := make(chan string, 2)
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		email := email
+		require.NoError(t, q.Enqueue("test", email, "", func() error {
+			time.Sleep(10 * time.Millisecond)
+			sent <- email
+			return errors.New("smtp: connection refused")
+		}))
+	}
+
+	require.NoError(t, q.Close(context.Background()))
+	assert.Len(t, sent, 2)
+	// После остановки письма не принимаются
+	assert.Error(t, q.Enqueue("test", "c@example.com", "", func() error { return nil }))
+}
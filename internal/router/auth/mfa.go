@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"net/http"
+
+	service "UserServiceAuth/internal/uscase"
+	dto "UserServiceAuth/storage"
+
+	"github.com/labstack/echo/v4"
+)
+
+// handleLoginMFA - второй шаг входа: обмен токена из /login и кода на пару токенов
+func (h *HttpRouter) handleLoginMFA(ctx echo.Context, req *dto.MFALoginRequest) error {
+	user, err := h.mfa.CompleteChallenge(req.MFAToken, req.Code)
+	if err != nil {
+		return err
+	}
+
+	tokens, err := h.tokens.IssueMFATokens(user, clientInfo(ctx))
+	if err != nil {
+		return err
+	}
+
+	resp := tokenResponse("Пользователь успешно аутентифицирован", tokens)
+	resp["user"] = newUserProfileResponse(user)
+
+	return ctx.JSON(http.StatusOK, resp)
+}
+
+func (h *HttpRouter) handleEnrollTOTP(ctx echo.Context) error {
+	enrollment, err := h.mfa.BeginEnrollment(principal(ctx).UserID)
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]interface{}{
+		"message":     "Добавьте ключ в приложение-аутентификатор и подтвердите кодом",
+		"secret":      enrollment.Secret,
+		"otpauth_uri": enrollment.URI,
+	})
+}
+
+func (h *HttpRouter) handleConfirmTOTP(ctx echo.Context, req *dto.MFACodeRequest) error {
+	codes, err := h.mfa.ConfirmEnrollment(principal(ctx).UserID, req.Code)
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]interface{}{
+		"message":        "Двухфакторная аутентификация включена. Сохраните коды восстановления",
+		"recovery_codes": codes,
+	})
+}
+
+func (h *HttpRouter) handleDisableTOTP(ctx echo.Context, req *dto.MFACodeRequest) error {
+	if err := h.mfa.Disable(principal(ctx).UserID, req.Code); err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, "Двухфакторная аутентификация отключена")
+}
+
+// mfaMethods - способы второго фактора, настроенные у пользователя
+func (h *HttpRouter) mfaMethods(user *service.User) ([]string, error) {
+	var methods []string
+	if user.MFAEnabled {
+		methods = append(methods, "totp")
+	}
+	hasKeys, err := h.webauthn.HasCredentials(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if hasKeys {
+		methods = append(methods, "webauthn")
+	}
+	return methods, nil
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	service "UserServiceAuth/internal/uscase"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHandleLogin_MFARequired(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	user := &service.User{ID: 1, Login: "user_login", MFAEnabled: true}
+	r.usecase.On("AuthenticateUser", "user_login", "pAssw_ord123", mock.Anything).Return(user, nil)
+	r.webauthn.On("HasCredentials", uint(1)).Return(true, nil)
+	r.mfa.On("Challenge", user).Return(&service.MFAChallenge{Token: "challenge", ExpiresAt: time.Now().Add(5 * time.Minute)}, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"login": "user_login", "password": "pAssw_ord123"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"mfa_required":true`)
+	assert.Contains(rec.Body.String(), `"mfa_token":"challenge"`)
+	assert.Contains(rec.Body.String(), `"mfa_methods":["totp","webauthn"]`)
+	assert.NotContains(rec.Body.String(), "access_token")
+	r.tokens.AssertNotCalled(t, "IssueTokens")
+}
+
+func TestHandleLoginMFA(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	user := &service.User{ID: 1, Login: "user_login", MFAEnabled: true}
+	r.mfa.On("CompleteChallenge", "challenge", "123456").Return(user, nil)
+	r.mfa.On("CompleteChallenge", "challenge", "000000").Return(nil, service.ErrInvalidMFACode)
+	r.tokens.On("IssueMFATokens", user, mock.Anything).Return(newTestTokenPair(), nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/login/mfa", strings.NewReader(`{"mfa_token": "challenge", "code": "123456"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"access_token":"header.payload.signature"`)
+	assert.Contains(rec.Body.String(), `"mfa_enabled":true`)
+
+	req = httptest.NewRequest(http.MethodPost, "/login/mfa", strings.NewReader(`{"mfa_token": "challenge", "code": "000000"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+	assert.Contains(rec.Body.String(), `"code":"invalid_mfa_code"`)
+	r.tokens.AssertNumberOfCalls(t, "IssueMFATokens", 1)
+}
+
+func TestHandleEnrollTOTP(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+	r.mfa.On("BeginEnrollment", uint(7)).Return(&service.TOTPEnrollment{Secret: "SECRET", URI: "otpauth://totp/x"}, nil)
+	r.mfa.On("ConfirmEnrollment", uint(7), "123456").Return([]string{"abcde-fghij"}, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/mfa/totp/enroll", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"secret":"SECRET"`)
+	assert.Contains(rec.Body.String(), `"otpauth_uri":"otpauth://totp/x"`)
+
+	req = httptest.NewRequest(http.MethodPost, "/mfa/totp/confirm", strings.NewReader(`{"code": "123456"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec = httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"recovery_codes":["abcde-fghij"]`)
+}
+
+func TestHandleDisableTOTP_NotEnabled(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+	r.mfa.On("Disable", uint(7), "123456").Return(service.ErrMFANotEnabled)
+
+	req := httptest.NewRequest(http.MethodPost, "/mfa/totp/disable", strings.NewReader(`{"code": "123456"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusConflict, rec.Code)
+	assert.Contains(rec.Body.String(), `"code":"mfa_not_enabled"`)
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	service "UserServiceAuth/internal/uscase"
+	dto "UserServiceAuth/storage"
+
+	"github.com/labstack/echo/v4"
+)
+
+const principalKey = "principal"
+
+// Principal - пользователь, от имени которого выполняется запрос
+type Principal struct {
+	UserID    uint
+	SessionID uint
+	TokenID   string
+	Roles     []string
+	Scopes    []string
+	// Email не подтверждён, доступны только маршруты с requireAuthUnverified
+	Restricted bool
+
+	claims *service.AccessClaims
+}
+
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// PrincipalFrom возвращает пользователя, сохранённого requireAuth
+func PrincipalFrom(ctx echo.Context) (*Principal, bool) {
+	principal, ok := ctx.Get(principalKey).(*Principal)
+	return principal, ok
+}
+
+// requireAuth проверяет access-токен из заголовка Authorization и сохраняет пользователя в контексте.
+// Маршруты, которым нужна аутентификация, подключают его при регистрации.
+func (h *HttpRouter) requireAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return h.authenticate(next, false)
+}
+
+// requireAuthUnverified - как requireAuth, но пропускает и пользователей с неподтверждённым email
+func (h *HttpRouter) requireAuthUnverified(next echo.HandlerFunc) echo.HandlerFunc {
+	return h.authenticate(next, true)
+}
+
+func (h *HttpRouter) authenticate(next echo.HandlerFunc, allowRestricted bool) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		header := ctx.Request().Header.Get(echo.HeaderAuthorization)
+		scheme, token, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer`)
+			return newProblem(http.StatusUnauthorized, "missing_token", "missing bearer token")
+		}
+
+		claims, err := h.tokens.Authenticate(token)
+		if err != nil {
+			ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return err
+		}
+		userID, err := claims.UserID()
+		if err != nil {
+			ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return err
+		}
+		if claims.Restricted && !allowRestricted {
+			return service.ErrEmailNotVerified
+		}
+
+		ctx.Set(principalKey, &Principal{
+			UserID:     userID,
+			SessionID:  claims.SessionID,
+			TokenID:    claims.ID,
+			Roles:      claims.Roles,
+			Scopes:     claims.Scopes(),
+			Restricted: claims.Restricted,
+			claims:     claims,
+		})
+
+		return next(ctx)
+	}
+}
+
+// requireSelfOrAdmin пропускает запрос, если параметр маршрута совпадает с ID пользователя
+// или пользователь - администратор. Подключается после requireAuth.
+func (h *HttpRouter) requireSelfOrAdmin(param string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			id, err := strconv.ParseUint(ctx.Param(param), 10, 32)
+			if err != nil {
+				return newProblem(http.StatusBadRequest, "invalid_id", "Неверный ID пользователя")
+			}
+			user := principal(ctx)
+			if user.UserID != uint(id) && !user.HasRole(dto.RoleAdmin) {
+				return newProblem(http.StatusForbidden, "forbidden", "access to another user is forbidden")
+			}
+			return next(ctx)
+		}
+	}
+}
+
+// requireRole пропускает запрос, только если у пользователя есть роль. Подключается после requireAuth.
+func (h *HttpRouter) requireRole(role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if !principal(ctx).HasRole(role) {
+				return newProblem(http.StatusForbidden, "insufficient_role", "insufficient role")
+			}
+			return next(ctx)
+		}
+	}
+}
+
+func principal(ctx echo.Context) *Principal {
+	p, ok := PrincipalFrom(ctx)
+	if !ok {
+		// Маршрут зарегистрирован без requireAuth
+		panic("auth: principal requested on unauthenticated route")
+	}
+	return p
+}
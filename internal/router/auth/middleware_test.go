@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	service "UserServiceAuth/internal/uscase"
+	"UserServiceAuth/storage"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireAuth_SetsPrincipal(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	claims := newTestClaims("7", 2)
+	claims.Scope = "profile sessions"
+	r.tokens.On("Authenticate", "access").Return(claims, nil)
+
+	var got *Principal
+	r.e.GET("/whoami", func(ctx echo.Context) error {
+		got, _ = PrincipalFrom(ctx)
+		return ctx.NoContent(http.StatusOK)
+	}, r.router.requireAuth)
+
+	req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	req.Header.Set(echo.HeaderAuthorization, "bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	if assert.NotNil(got) {
+		assert.Equal(uint(7), got.UserID)
+		assert.Equal(uint(2), got.SessionID)
+		assert.Equal("jti", got.TokenID)
+		assert.True(got.HasRole("user"))
+		assert.True(got.HasScope("sessions"))
+		assert.False(got.HasScope("admin"))
+	}
+}
+
+func TestRequireAuth_RejectsInvalidToken(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "expired").Return(nil, service.ErrInvalidAccessToken)
+
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer expired")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+	assert.Equal(`Bearer error="invalid_token"`, rec.Header().Get(echo.HeaderWWWAuthenticate))
+	r.tokens.AssertNotCalled(t, "Logout")
+}
+
+func TestHandleUpdateUserByID_RequiresAuth(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	reqBody := `{"username": "John", "surname": "Doe", "email": "john.doe@example.com"}`
+	req := httptest.NewRequest(http.MethodPut, "/update/1", strings.NewReader(reqBody))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+	assert.Equal("Bearer", rec.Header().Get(echo.HeaderWWWAuthenticate))
+	r.usecase.AssertNotCalled(t, "UpdateUserByID")
+}
+
+func TestHandleUpdateUserByID_AnotherUser(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+
+	reqBody := `{"username": "John", "surname": "Doe", "email": "john.doe@example.com"}`
+	req := httptest.NewRequest(http.MethodPut, "/update/1", strings.NewReader(reqBody))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusForbidden, rec.Code)
+	r.usecase.AssertNotCalled(t, "UpdateUserByID")
+}
+
+func TestRequireSelfOrAdmin_AllowsAdmin(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	claims := newTestClaims("7", 2)
+	claims.Roles = []string{storage.RoleAdmin}
+	r.tokens.On("Authenticate", "access").Return(claims, nil)
+
+	r.e.PUT("/probe/:id", func(ctx echo.Context) error {
+		return ctx.NoContent(http.StatusNoContent)
+	}, r.router.requireAuth, r.router.requireSelfOrAdmin("id"))
+
+	req := httptest.NewRequest(http.MethodPut, "/probe/1", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusNoContent, rec.Code)
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"net/http"
+
+	dto "UserServiceAuth/storage"
+
+	"github.com/labstack/echo/v4"
+)
+
+// handleForgotPassword отвечает сразу и одинаково для известных и неизвестных адресов. Письмо
+// готовится в фоне: иначе запись в базу и отправка письма выдавали бы зарегистрированный
+// адрес по времени ответа. Ошибки по той же причине только записываются в журнал.
+func (h *HttpRouter) handleForgotPassword(ctx echo.Context, req *dto.ForgotPasswordRequest) error {
+	email := req.Email
+	err := h.mail.Enqueue("password reset", email, ctx.RealIP(), func() error {
+		return h.resets.ForgotPassword(email)
+	})
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusAccepted, "Если адрес зарегистрирован, на него отправлена ссылка для смены пароля")
+}
+
+func (h *HttpRouter) handleResetPassword(ctx echo.Context, req *dto.ResetPasswordRequest) error {
+	if err := h.resets.ResetPassword(req.Token, req.NewPassword); err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, "Пароль успешно изменен")
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	service "UserServiceAuth/internal/uscase"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHandleForgotPassword_SameResponse(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	handled := make(chan string, 2)
+	r.resets.On("ForgotPassword", "john@example.com").Return(nil).
+		Run(func(args mock.Arguments) { handled <- args.String(0) })
+	r.resets.On("ForgotPassword", "broken@example.com").Return(errors.New("smtp: connection refused")).
+		Run(func(args mock.Arguments) { handled <- args.String(0) })
+
+	var bodies []string
+	for _, email := range []string{"john@example.com", "broken@example.com"} {
+		req := httptest.NewRequest(http.MethodPost, "/password/forgot", strings.NewReader(`{"email": "`+email+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		r.e.ServeHTTP(rec, req)
+
+		assert.Equal(http.StatusAccepted, rec.Code)
+		bodies = append(bodies, rec.Body.String())
+		assert.Equal(email, waitForMail(t, handled))
+	}
+	assert.Equal(bodies[0], bodies[1])
+}
+
+func TestHandleForgotPassword_DoesNotWaitForMail(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	// Отправка письма висит, пока тест её не отпустит, а ответ приходит сразу
+	release := make(chan struct{})
+	handled := make(chan string, 1)
+	r.resets.On("ForgotPassword", "john@example.com").Return(nil).Run(func(args mock.Arguments) {
+		<-release
+		handled <- args.String(0)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/password/forgot", strings.NewReader(`{"email": "john@example.com"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusAccepted, rec.Code)
+	close(release)
+	assert.Equal("john@example.com", waitForMail(t, handled))
+}
+
+func TestHandleForgotPassword_LimitsRequestsPerEmail(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	handled := make(chan string, 3)
+	r.resets.On("ForgotPassword", "john@example.com").Return(nil).
+		Run(func(args mock.Arguments) { handled <- args.String(0) })
+
+	var rec *httptest.ResponseRecorder
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/password/forgot", strings.NewReader(`{"email": "john@example.com"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec = httptest.NewRecorder()
+		r.e.ServeHTTP(rec, req)
+	}
+
+	// Лимит одинаков для любого адреса, поэтому отказ не выдаёт, зарегистрирован ли он
+	assert.Equal(http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(rec.Header().Get(echo.HeaderRetryAfter))
+	for i := 0; i < 3; i++ {
+		assert.Equal("john@example.com", waitForMail(t, handled))
+	}
+}
+
+func waitForMail(t *testing.T, handled <-chan string) string {
+	t.Helper()
+	select {
+	case email := <-handled:
+		return email
+	case <-time.After(time.Second):
+		t.Fatal("email was not processed")
+		return ""
+	}
+}
+
+func TestHandleResetPassword(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.resets.On("ResetPassword", "good", "newPwd123").Return(nil)
+	r.resets.On("ResetPassword", "used", "newPwd123").Return(service.ErrInvalidResetToken)
+
+	req := httptest.NewRequest(http.MethodPost, "/password/reset", strings.NewReader(`{"token": "good", "new_password": "newPwd123"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/password/reset", strings.NewReader(`{"token": "used", "new_password": "newPwd123"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusBadRequest, rec.Code)
+	assert.Contains(rec.Body.String(), `"code":"invalid_reset_token"`)
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	service "UserServiceAuth/internal/uscase"
+	dto "UserServiceAuth/storage"
+
+	"github.com/labstack/echo/v4"
+)
+
+type sessionResponse struct {
+	ID         uint      `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+func (h *HttpRouter) handleListSessions(ctx echo.Context) error {
+	user := principal(ctx)
+
+	sessions, err := h.tokens.Sessions(user.UserID)
+	if err != nil {
+		return err
+	}
+
+	resp := make([]sessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		resp = append(resp, sessionResponse{
+			ID:         session.IDTOKENS,
+			UserAgent:  session.USERAGENT,
+			IP:         session.IP,
+			CreatedAt:  time.Unix(session.TIMECREATE, 0).UTC(),
+			LastUsedAt: time.Unix(session.LASTUSED, 0).UTC(),
+			ExpiresAt:  time.Unix(session.EXP, 0).UTC(),
+			Current:    session.IDTOKENS == user.SessionID,
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, resp)
+}
+
+func (h *HttpRouter) handleRevokeSession(ctx echo.Context) error {
+	user := principal(ctx)
+
+	sessionID, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "invalid_id", "Неверный ID сессии")
+	}
+
+	if err := h.tokens.RevokeSession(user.UserID, uint(sessionID)); err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, "Сессия успешно завершена")
+}
+
+func (h *HttpRouter) handleLogout(ctx echo.Context) error {
+	if err := h.tokens.Logout(principal(ctx).claims); err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, "Сессия успешно завершена")
+}
+
+func (h *HttpRouter) handleLogoutAll(ctx echo.Context) error {
+	user := principal(ctx)
+
+	if err := h.tokens.LogoutAll(user.UserID); err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, "Все сессии успешно завершены")
+}
+
+// handleRevoke реализует RFC 7009: ответ не зависит от того, был ли токен действительным
+func (h *HttpRouter) handleRevoke(ctx echo.Context) error {
+	req := new(dto.RevokeRequest)
+	if err := ctx.Bind(req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+	}
+	if err := h.validator.Struct(req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+	}
+
+	if err := h.tokens.RevokeToken(req.Token, req.TokenTypeHint); err != nil {
+		return ctx.JSON(http.StatusServiceUnavailable, map[string]string{"error": "temporarily_unavailable"})
+	}
+
+	return ctx.NoContent(http.StatusOK)
+}
+
+type revokedTokenResponse struct {
+	JTI       string    `json:"jti"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// handleListRevoked отдаёт сервисам-потребителям отозванные, но ещё не истёкшие access-токены
+func (h *HttpRouter) handleListRevoked(ctx echo.Context) error {
+	revoked, err := h.tokens.RevokedTokens()
+	if err != nil {
+		return err
+	}
+
+	resp := make([]revokedTokenResponse, 0, len(revoked))
+	for _, token := range revoked {
+		resp = append(resp, revokedTokenResponse{
+			JTI:       token.JTI,
+			ExpiresAt: time.Unix(token.EXP, 0).UTC(),
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, resp)
+}
+
+func (h *HttpRouter) handleCheckRevoked(ctx echo.Context) error {
+	jti := ctx.Param("jti")
+
+	revoked, err := h.tokens.IsTokenRevoked(jti)
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]interface{}{
+		"jti":     jti,
+		"revoked": revoked,
+	})
+}
+
+func clientInfo(ctx echo.Context) service.ClientInfo {
+	return service.ClientInfo{
+		UserAgent: ctx.Request().UserAgent(),
+		IP:        ctx.RealIP(),
+	}
+}
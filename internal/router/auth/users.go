@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	service "UserServiceAuth/internal/uscase"
+	dto "UserServiceAuth/storage"
+
+	"github.com/labstack/echo/v4"
+)
+
+const defaultPerPage = 20
+
+// userProfileResponse - данные пользователя, которые видит он сам
+type userProfileResponse struct {
+	UserID   uint   `json:"user_id"`
+	Email    string `json:"email"`
+	Login    string `json:"login"`
+	Username string `json:"username"`
+	Surname  string `json:"surname"`
+	Role     string `json:"role"`
+
+	EmailVerified bool `json:"email_verified"`
+	MFAEnabled    bool `json:"mfa_enabled"`
+}
+
+// userAdminResponse - данные пользователя для администратора
+type userAdminResponse struct {
+	userProfileResponse
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+type userListResponse struct {
+	Users   []userAdminResponse `json:"users"`
+	Total   int64               `json:"total"`
+	Page    int                 `json:"page"`
+	PerPage int                 `json:"per_page"`
+}
+
+func newUserProfileResponse(user *service.User) userProfileResponse {
+	return userProfileResponse{
+		UserID:   user.ID,
+		Email:    user.Email,
+		Login:    user.Login,
+		Username: user.Username,
+		Surname:  user.Surname,
+		Role:     user.Role,
+
+		EmailVerified: user.EmailVerified,
+		MFAEnabled:    user.MFAEnabled,
+	}
+}
+
+func newUserAdminResponse(user *service.User) userAdminResponse {
+	return userAdminResponse{
+		userProfileResponse: newUserProfileResponse(user),
+		CreatedAt:           user.CreatedAt,
+		UpdatedAt:           user.UpdatedAt,
+		DeletedAt:           user.DeletedAt,
+	}
+}
+
+func (h *HttpRouter) handleGetMe(ctx echo.Context) error {
+	user, err := h.usecase.GetUserByID(principal(ctx).UserID)
+	if err != nil {
+		return err
+	}
+
+	ctx.Response().Header().Set("ETag", userETag(user))
+	return ctx.JSON(http.StatusOK, newUserProfileResponse(user))
+}
+
+func (h *HttpRouter) handleGetUser(ctx echo.Context) error {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "invalid_id", "Неверный ID пользователя")
+	}
+
+	user, err := h.usecase.GetUserByID(uint(id))
+	if err != nil {
+		return err
+	}
+
+	return userResponse(ctx, http.StatusOK, user)
+}
+
+func (h *HttpRouter) handlePatchUser(ctx echo.Context) error {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "invalid_id", "Неверный ID пользователя")
+	}
+
+	if err := requireJSON(ctx); err != nil {
+		return err
+	}
+
+	// Неизвестные поля (в том числе password) отклоняются, а не игнорируются
+	req := new(dto.PatchUserRequest)
+	decoder := json.NewDecoder(ctx.Request().Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(req); err != nil {
+		return newProblem(http.StatusBadRequest, "invalid_body", "invalid request body: "+err.Error())
+	}
+
+	version, err := ifMatchVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	patch, problem := h.userPatch(req)
+	if problem != nil {
+		return problem
+	}
+
+	user, emailChanged, err := h.usecase.PatchUserByID(uint(id), version, patch)
+	if err != nil {
+		return err
+	}
+	if emailChanged {
+		h.sendVerification(ctx, user)
+	}
+
+	return userResponse(ctx, http.StatusOK, user)
+}
+
+// userPatch проверяет переданные поля и переводит их в UserPatch. null очищает поле.
+func (h *HttpRouter) userPatch(req *dto.PatchUserRequest) (dto.UserPatch, *Problem) {
+	var patch dto.UserPatch
+
+	optionalString := func(field dto.Optional[string]) *string {
+		if !field.Set {
+			return nil
+		}
+		value := field.Value
+		if field.Null {
+			value = ""
+		}
+		return &value
+	}
+	patch.Username = optionalString(req.Username)
+	patch.Surname = optionalString(req.Surname)
+
+	if req.Email.Set {
+		if req.Email.Null {
+			problem := newProblem(http.StatusBadRequest, "validation_failed", "email cannot be cleared")
+			problem.InvalidParams = []InvalidParam{{Name: "email", Reason: "required"}}
+			return patch, problem
+		}
+		if err := h.validator.Var(req.Email.Value, "required,email"); err != nil {
+			problem := validationProblem(err)
+			for i := range problem.InvalidParams {
+				problem.InvalidParams[i].Name = "email"
+			}
+			return patch, problem
+		}
+		patch.Email = &req.Email.Value
+	}
+
+	return patch, nil
+}
+
+func (h *HttpRouter) handleChangePassword(ctx echo.Context, req *dto.ChangePasswordRequest) error {
+	user := principal(ctx)
+	if err := h.usecase.ChangePassword(user.UserID, req.CurrentPassword, req.NewPassword, clientInfo(ctx)); err != nil {
+		return err
+	}
+	// Тот, кто знал старый пароль, не должен остаться в системе через уже открытые сессии
+	if err := h.tokens.LogoutOthers(user.UserID, user.SessionID); err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, "Пароль успешно изменен")
+}
+
+// userResponse отдаёт администратору служебные поля, остальным - только профиль
+func userResponse(ctx echo.Context, code int, user *service.User) error {
+	ctx.Response().Header().Set("ETag", userETag(user))
+	if principal(ctx).HasRole(dto.RoleAdmin) {
+		return ctx.JSON(code, newUserAdminResponse(user))
+	}
+	return ctx.JSON(code, newUserProfileResponse(user))
+}
+
+func (h *HttpRouter) handleListUsers(ctx echo.Context) error {
+	req := new(dto.ListUsersRequest)
+	if err := (&echo.DefaultBinder{}).BindQueryParams(ctx, req); err != nil {
+		return newProblem(http.StatusBadRequest, "invalid_query", "Неверные параметры запроса")
+	}
+	if err := h.validator.Struct(req); err != nil {
+		return validationProblem(err)
+	}
+	if req.Page == 0 {
+		req.Page = 1
+	}
+	if req.PerPage == 0 {
+		req.PerPage = defaultPerPage
+	}
+
+	users, total, err := h.usecase.ListUsers(dto.UserFilter{
+		Email:   req.Email,
+		Login:   req.Login,
+		Name:    req.Name,
+		Deleted: req.Deleted,
+		Sort:    req.Sort,
+		Limit:   req.PerPage,
+		Offset:  (req.Page - 1) * req.PerPage,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp := userListResponse{
+		Users:   make([]userAdminResponse, 0, len(users)),
+		Total:   total,
+		Page:    req.Page,
+		PerPage: req.PerPage,
+	}
+	for i := range users {
+		resp.Users = append(resp.Users, newUserAdminResponse(&users[i]))
+	}
+
+	return ctx.JSON(http.StatusOK, resp)
+}
+
+func (h *HttpRouter) handleDeleteUser(ctx echo.Context) error {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "invalid_id", "Неверный ID пользователя")
+	}
+
+	// Сессии завершаются до удаления, чтобы выданные access-токены попали в список отозванных
+	if err := h.tokens.LogoutAll(uint(id)); err != nil {
+		return err
+	}
+
+	if err := h.usecase.DeleteUserByID(uint(id)); err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, "Пользователь успешно удален")
+}
+
+func (h *HttpRouter) handleRestoreUser(ctx echo.Context) error {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "invalid_id", "Неверный ID пользователя")
+	}
+
+	if err := h.usecase.RestoreUserByID(uint(id)); err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, "Пользователь успешно восстановлен")
+}
+
+// handleUnlockUser снимает блокировку входа после неудачных попыток
+func (h *HttpRouter) handleUnlockUser(ctx echo.Context) error {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "invalid_id", "Неверный ID пользователя")
+	}
+
+	if err := h.usecase.UnlockUser(uint(id), principal(ctx).UserID); err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, "Пользователь успешно разблокирован")
+}
+
+func userETag(user *service.User) string {
+	return strconv.Quote(strconv.FormatUint(uint64(user.Version), 10))
+}
+
+// ifMatchVersion читает ожидаемую версию из If-Match. "*" отключает проверку версии.
+func ifMatchVersion(ctx echo.Context) (uint, error) {
+	header := strings.TrimSpace(ctx.Request().Header.Get("If-Match"))
+	if header == "" {
+		return 0, newProblem(http.StatusPreconditionRequired, "precondition_required", "If-Match header is required")
+	}
+	if header == "*" {
+		return 0, nil
+	}
+
+	tag, err := strconv.Unquote(strings.TrimPrefix(header, "W/"))
+	if err != nil {
+		return 0, newProblem(http.StatusBadRequest, "invalid_if_match", "invalid If-Match header")
+	}
+	version, err := strconv.ParseUint(tag, 10, 32)
+	if err != nil || version == 0 {
+		// Такой ETag сервис не выдавал, значит он не совпадёт с текущей версией
+		return 0, service.ErrVersionConflict
+	}
+	return uint(version), nil
+}
@@ -0,0 +1,327 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	service "UserServiceAuth/internal/uscase"
+	"UserServiceAuth/storage"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHandleGetMe(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+	r.usecase.On("GetUserByID", uint(7)).Return(&service.User{ID: 7, Login: "johndoe"}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/users/me", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	var resp userProfileResponse
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal("johndoe", resp.Login)
+	assert.NotContains(rec.Body.String(), "hash")
+}
+
+func TestHandleGetUser_AnotherUserForbidden(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/users/8", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusForbidden, rec.Code)
+	r.usecase.AssertNotCalled(t, "GetUserByID")
+}
+
+func TestHandleGetUser_NotFound(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	claims := newTestClaims("7", 2)
+	claims.Roles = []string{storage.RoleAdmin}
+	r.tokens.On("Authenticate", "access").Return(claims, nil)
+	r.usecase.On("GetUserByID", uint(8)).Return(nil, service.ErrUserNotFound)
+
+	req := httptest.NewRequest(http.MethodGet, "/users/8", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusNotFound, rec.Code)
+}
+
+func TestHandleListUsers(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	claims := newTestClaims("1", 2)
+	claims.Roles = []string{storage.RoleAdmin}
+	r.tokens.On("Authenticate", "access").Return(claims, nil)
+	r.usecase.On("ListUsers", storage.UserFilter{Name: "doe", Sort: "-login", Limit: 10, Offset: 10}).
+		Return([]service.User{{ID: 7, Login: "johndoe"}}, int64(11), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/users?page=2&per_page=10&sort=-login&name=doe", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	var resp userListResponse
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(int64(11), resp.Total)
+	assert.Equal(2, resp.Page)
+	if assert.Len(resp.Users, 1) {
+		assert.Equal("johndoe", resp.Users[0].Login)
+	}
+	r.usecase.AssertExpectations(t)
+}
+
+func TestHandleListUsers_RequiresAdmin(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/users", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusForbidden, rec.Code)
+	r.usecase.AssertNotCalled(t, "ListUsers")
+}
+
+func TestHandleListUsers_InvalidSort(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	claims := newTestClaims("1", 2)
+	claims.Roles = []string{storage.RoleAdmin}
+	r.tokens.On("Authenticate", "access").Return(claims, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/users?sort=password", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusBadRequest, rec.Code)
+}
+
+func TestHandleDeleteUser(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+	r.tokens.On("LogoutAll", uint(7)).Return(nil)
+	r.usecase.On("DeleteUserByID", uint(7)).Return(nil)
+
+	req := httptest.NewRequest(http.MethodDelete, "/users/7", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	r.usecase.AssertExpectations(t)
+	r.tokens.AssertExpectations(t)
+}
+
+func TestHandleRestoreUser(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	claims := newTestClaims("1", 2)
+	claims.Roles = []string{storage.RoleAdmin}
+	r.tokens.On("Authenticate", "access").Return(claims, nil)
+	r.usecase.On("RestoreUserByID", uint(7)).Return(nil)
+	r.usecase.On("RestoreUserByID", uint(8)).Return(service.ErrDeletedUserNotFound)
+
+	for id, code := range map[string]int{"7": http.StatusOK, "8": http.StatusNotFound} {
+		req := httptest.NewRequest(http.MethodPost, "/users/"+id+"/restore", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+		rec := httptest.NewRecorder()
+		r.e.ServeHTTP(rec, req)
+
+		assert.Equal(code, rec.Code)
+	}
+}
+
+func TestHandleUnlockUser(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	claims := newTestClaims("1", 2)
+	claims.Roles = []string{storage.RoleAdmin}
+	r.tokens.On("Authenticate", "access").Return(claims, nil)
+	r.tokens.On("Authenticate", "user").Return(newTestClaims("7", 2), nil)
+	r.usecase.On("UnlockUser", uint(7), uint(1)).Return(nil)
+	r.usecase.On("UnlockUser", uint(8), uint(1)).Return(service.ErrUserNotFound)
+
+	for _, tc := range []struct {
+		token, id string
+		code      int
+	}{
+		{"access", "7", http.StatusOK},
+		{"access", "8", http.StatusNotFound},
+		{"access", "abc", http.StatusBadRequest},
+		{"user", "7", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/users/"+tc.id+"/unlock", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+tc.token)
+		rec := httptest.NewRecorder()
+		r.e.ServeHTTP(rec, req)
+
+		assert.Equal(tc.code, rec.Code, tc.token+" "+tc.id)
+	}
+	r.usecase.AssertExpectations(t)
+}
+
+func TestHandlePatchUser(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+
+	username, empty := "Johnny", ""
+	r.usecase.On("PatchUserByID", uint(7), uint(3), storage.UserPatch{Username: &username, Surname: &empty}).
+		Return(&service.User{ID: 7, Username: "Johnny", Email: "john.doe@example.com", Version: 4}, false, nil)
+
+	req := httptest.NewRequest(http.MethodPatch, "/users/7", strings.NewReader(`{"username": "Johnny", "surname": null}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	req.Header.Set("If-Match", `"3"`)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(`"4"`, rec.Header().Get("ETag"))
+	var resp userProfileResponse
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal("Johnny", resp.Username)
+	assert.Equal("john.doe@example.com", resp.Email)
+	r.usecase.AssertExpectations(t)
+}
+
+func TestHandlePatchUser_InvalidBody(t *testing.T) {
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+
+	for name, body := range map[string]string{
+		"password":      `{"password": "newPwd456"}`,
+		"null email":    `{"email": null}`,
+		"invalid email": `{"email": "not-an-email"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPatch, "/users/7", strings.NewReader(body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+			req.Header.Set("If-Match", `"3"`)
+			rec := httptest.NewRecorder()
+			r.e.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		})
+	}
+	r.usecase.AssertNotCalled(t, "PatchUserByID")
+}
+
+func TestHandleChangePassword_WrongCurrentPassword(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+	r.usecase.On("ChangePassword", uint(7), "wrong", "newPwd456", mock.Anything).Return(service.ErrInvalidCurrentPassword)
+
+	req := httptest.NewRequest(http.MethodPost, "/users/me/password",
+		strings.NewReader(`{"current_password": "wrong", "new_password": "newPwd456"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusForbidden, rec.Code)
+	r.usecase.AssertExpectations(t)
+	r.tokens.AssertNotCalled(t, "LogoutOthers", mock.Anything, mock.Anything)
+}
+
+func TestHandleChangePassword_RevokesOtherSessions(t *testing.T) {
+	r := newTestRouter()
+
+	claims := newTestClaims("7", 2)
+	r.tokens.On("Authenticate", "access").Return(claims, nil)
+	r.usecase.On("ChangePassword", uint(7), "securePwd123", "newPwd456", service.ClientInfo{IP: "192.0.2.1"}).Return(nil)
+	r.tokens.On("LogoutOthers", uint(7), claims.SessionID).Return(nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/users/me/password",
+		strings.NewReader(`{"current_password": "securePwd123", "new_password": "newPwd456"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	req.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	r.usecase.AssertExpectations(t)
+	r.tokens.AssertExpectations(t)
+}
+
+func TestHandlePatchUser_Preconditions(t *testing.T) {
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+	r.usecase.On("PatchUserByID", uint(7), uint(2), mock.Anything).Return(nil, false, service.ErrVersionConflict)
+
+	for name, tc := range map[string]struct {
+		ifMatch string
+		code    int
+	}{
+		"missing":   {"", http.StatusPreconditionRequired},
+		"stale":     {`"2"`, http.StatusPreconditionFailed},
+		"malformed": {"2", http.StatusBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPatch, "/users/7", strings.NewReader(`{"username": "Johnny"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+			if tc.ifMatch != "" {
+				req.Header.Set("If-Match", tc.ifMatch)
+			}
+			rec := httptest.NewRecorder()
+			r.e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.code, rec.Code)
+		})
+	}
+}
+
+func TestHandleGetUser_ETag(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+	r.usecase.On("GetUserByID", uint(7)).Return(&service.User{ID: 7, Version: 5}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/users/7", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(`"5"`, rec.Header().Get("ETag"))
+}
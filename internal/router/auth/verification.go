@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"net/http"
+
+	service "UserServiceAuth/internal/uscase"
+	dto "UserServiceAuth/storage"
+
+	"github.com/labstack/echo/v4"
+)
+
+func (h *HttpRouter) handleVerifyEmail(ctx echo.Context, req *dto.VerifyEmailRequest) error {
+	if err := h.verification.VerifyEmail(req.Token); err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, "Email успешно подтвержден")
+}
+
+// handleResendVerification отвечает одинаково для любого адреса, чтобы не раскрывать, зарегистрирован ли он.
+// Письмо, как и при восстановлении пароля, отправляется в фоне, иначе адрес выдавало бы время ответа.
+func (h *HttpRouter) handleResendVerification(ctx echo.Context, req *dto.ResendVerificationRequest) error {
+	email := req.Email
+	err := h.mail.Enqueue("verification", email, ctx.RealIP(), func() error {
+		return h.verification.ResendVerification(email)
+	})
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusAccepted, "Если адрес зарегистрирован и не подтвержден, письмо отправлено")
+}
+
+// sendVerification отправляет письмо для подтверждения email. Ошибка отправки не отменяет
+// регистрацию или смену адреса: письмо можно запросить повторно.
+func (h *HttpRouter) sendVerification(ctx echo.Context, user *service.User) {
+	if user.EmailVerified {
+		return
+	}
+	if err := h.verification.SendVerification(user); err != nil {
+		ctx.Logger().Errorf("failed to send verification email to user %d: %v", user.ID, err)
+	}
+}
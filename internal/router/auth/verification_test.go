@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	service "UserServiceAuth/internal/uscase"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleVerifyEmail(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.verification.On("VerifyEmail", "good").Return(nil)
+	r.verification.On("VerifyEmail", "used").Return(service.ErrInvalidVerificationToken)
+
+	req := httptest.NewRequest(http.MethodPost, "/verify-email", strings.NewReader(`{"token": "good"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/verify-email", strings.NewReader(`{"token": "used"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusBadRequest, rec.Code)
+	assert.Contains(rec.Body.String(), `"code":"invalid_verification_token"`)
+}
+
+func TestHandleResendVerification(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	// Отправка висит, пока тест её не отпустит, а ответ приходит сразу
+	release := make(chan struct{})
+	handled := make(chan string, 1)
+	r.verification.On("ResendVerification", "john@example.com").Return(nil).Run(func(args mock.Arguments) {
+		<-release
+		handled <- args.String(0)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/verify-email/resend", strings.NewReader(`{"email": "john@example.com"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusAccepted, rec.Code)
+	close(release)
+	assert.Equal("john@example.com", waitForMail(t, handled))
+}
+
+func TestHandleResendVerification_LimitsRequestsPerIP(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.verification.On("ResendVerification", mock.Anything).Return(nil)
+
+	// Каждый адрес новый, но все запросы идут с одного IP
+	var rec *httptest.ResponseRecorder
+	for i := 0; i < 21; i++ {
+		body := fmt.Sprintf(`{"email": "user%d@example.com"}`, i)
+		req := httptest.NewRequest(http.MethodPost, "/verify-email/resend", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec = httptest.NewRecorder()
+		r.e.ServeHTTP(rec, req)
+	}
+
+	assert.Equal(http.StatusTooManyRequests, rec.Code)
+	require.NoError(t, r.mail.Close(context.Background()))
+	r.verification.AssertNumberOfCalls(t, "ResendVerification", 20)
+}
+
+func TestRequireAuth_RestrictedUser(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	claims := newTestClaims("7", 2)
+	claims.Restricted = true
+	r.tokens.On("Authenticate", "access").Return(claims, nil)
+	r.usecase.On("GetUserByID", uint(7)).Return(&service.User{ID: 7, Login: "johndoe"}, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusForbidden, rec.Code)
+	assert.Contains(rec.Body.String(), `"code":"email_not_verified"`)
+	r.tokens.AssertNotCalled(t, "Sessions")
+
+	req = httptest.NewRequest(http.MethodGet, "/users/me", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec = httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"email_verified":false`)
+}
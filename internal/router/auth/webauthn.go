@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	service "UserServiceAuth/internal/uscase"
+	dto "UserServiceAuth/storage"
+
+	"github.com/labstack/echo/v4"
+)
+
+type credentialResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	// Ключ может синхронизироваться между устройствами (passkey в облаке)
+	BackupEligible bool `json:"backup_eligible"`
+}
+
+func newCredentialResponse(cred *dto.WEBAUTHNCREDENTIALS) credentialResponse {
+	resp := credentialResponse{
+		ID:             cred.IDWEBAUTHNCREDENTIALS,
+		Name:           cred.NAME,
+		CreatedAt:      time.Unix(cred.TIMECREATE, 0).UTC(),
+		BackupEligible: cred.BACKUPELIGIBLE,
+	}
+	if cred.LASTUSED != 0 {
+		lastUsed := time.Unix(cred.LASTUSED, 0).UTC()
+		resp.LastUsedAt = &lastUsed
+	}
+	return resp
+}
+
+// handleBeginWebAuthnRegistration отдаёт параметры для navigator.credentials.create()
+func (h *HttpRouter) handleBeginWebAuthnRegistration(ctx echo.Context) error {
+	registration, err := h.webauthn.BeginRegistration(principal(ctx).UserID)
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]interface{}{
+		"ceremony_token": registration.Token,
+		"public_key":     registration.Options,
+	})
+}
+
+func (h *HttpRouter) handleFinishWebAuthnRegistration(ctx echo.Context, req *dto.WebAuthnRegisterRequest) error {
+	cred, err := h.webauthn.FinishRegistration(principal(ctx).UserID, req.CeremonyToken, req.Name, req.Credential)
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusCreated, map[string]interface{}{
+		"message":    "Ключ безопасности добавлен",
+		"credential": newCredentialResponse(cred),
+	})
+}
+
+func (h *HttpRouter) handleListWebAuthnCredentials(ctx echo.Context) error {
+	creds, err := h.webauthn.Credentials(principal(ctx).UserID)
+	if err != nil {
+		return err
+	}
+
+	resp := make([]credentialResponse, 0, len(creds))
+	for i := range creds {
+		resp = append(resp, newCredentialResponse(&creds[i]))
+	}
+	return ctx.JSON(http.StatusOK, resp)
+}
+
+// handleDeleteWebAuthnCredential удаляет ключ. Украденного access-токена для этого недостаточно:
+// нужно подтверждение другим ключом, кодом второго фактора или паролем.
+func (h *HttpRouter) handleDeleteWebAuthnCredential(ctx echo.Context, req *dto.ConfirmationRequest) error {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, "invalid_id", "Неверный ID ключа")
+	}
+
+	userID := principal(ctx).UserID
+	if err := h.confirm(ctx, userID, req); err != nil {
+		return err
+	}
+	if err := h.webauthn.DeleteCredential(userID, uint(id)); err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, "Ключ безопасности удалён")
+}
+
+// handleBeginWebAuthnConfirmation отдаёт параметры navigator.credentials.get() для подтверждения
+// ключом перед изменением вторых факторов
+func (h *HttpRouter) handleBeginWebAuthnConfirmation(ctx echo.Context) error {
+	confirmation, err := h.webauthn.BeginConfirmation(principal(ctx).UserID)
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]interface{}{
+		"ceremony_token": confirmation.Token,
+		"public_key":     confirmation.Options,
+	})
+}
+
+// confirm проверяет подтверждение из запроса: ключ WebAuthn, код второго фактора или пароль
+func (h *HttpRouter) confirm(ctx echo.Context, userID uint, req *dto.ConfirmationRequest) error {
+	switch {
+	case req.Credential != nil:
+		return h.webauthn.Confirm(userID, req.CeremonyToken, req.Credential)
+	case req.Code != "":
+		return h.mfa.Confirm(userID, req.Code)
+	case req.Password != "":
+		return h.usecase.ConfirmPassword(userID, req.Password, clientInfo(ctx))
+	}
+	return service.ErrConfirmationRequired
+}
+
+// handleBeginWebAuthnLogin отдаёт параметры для navigator.credentials.get(). С mfa_token
+// ключ проверяется вторым фактором после пароля, без него - вход только по ключу.
+func (h *HttpRouter) handleBeginWebAuthnLogin(ctx echo.Context, req *dto.WebAuthnLoginBeginRequest) error {
+	var user *service.User
+	if req.MFAToken != "" {
+		pending, err := h.mfa.PendingUser(req.MFAToken)
+		if err != nil {
+			return err
+		}
+		user = pending
+	}
+
+	login, err := h.webauthn.BeginLogin(user)
+	if err != nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]interface{}{
+		"ceremony_token": login.Token,
+		"public_key":     login.Options,
+	})
+}
+
+func (h *HttpRouter) handleFinishWebAuthnLogin(ctx echo.Context, req *dto.WebAuthnLoginRequest) error {
+	var (
+		user *service.User
+		err  error
+	)
+	passwordless := req.MFAToken == ""
+	if passwordless {
+		user, err = h.webauthn.FinishLogin(req.CeremonyToken, req.Credential, nil)
+	} else {
+		user, err = h.mfa.CompleteChallengeWith(req.MFAToken, func(pending *service.User) error {
+			_, err := h.webauthn.FinishLogin(req.CeremonyToken, req.Credential, pending)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	tokens, err := h.tokens.IssueWebAuthnTokens(user, clientInfo(ctx), passwordless)
+	if err != nil {
+		return err
+	}
+
+	resp := tokenResponse("Пользователь успешно аутентифицирован", tokens)
+	resp["user"] = newUserProfileResponse(user)
+
+	return ctx.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	service "UserServiceAuth/internal/uscase"
+	"UserServiceAuth/internal/webauthn"
+	"UserServiceAuth/internal/webauthn/webauthntest"
+	"UserServiceAuth/storage"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var testRP = &webauthn.RelyingParty{ID: "localhost", Name: "UserServiceAuth", Origins: []string{"http://localhost:8080"}, Timeout: time.Minute}
+
+func TestHandleWebAuthnRegistration(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+	options := testRP.CreationOptions([]byte("challenge"), webauthn.UserEntity{ID: []byte("7"), Name: "john"}, nil, webauthn.UserVerificationPreferred)
+	r.webauthn.On("BeginRegistration", uint(7)).Return(&service.WebAuthnRegistration{Options: options, Token: "ceremony"}, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/webauthn/register/begin", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	var begin struct {
+		CeremonyToken string                   `json:"ceremony_token"`
+		PublicKey     webauthn.CreationOptions `json:"public_key"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &begin))
+	assert.Equal("ceremony", begin.CeremonyToken)
+	assert.Equal([]byte("challenge"), []byte(begin.PublicKey.Challenge))
+
+	// Ответ аутентификатора проходит через JSON так же, как от браузера
+	creation, err := webauthntest.New("http://localhost:8080").Create(&begin.PublicKey)
+	require.NoError(t, err)
+	r.webauthn.On("FinishRegistration", uint(7), "ceremony", "YubiKey", mock.MatchedBy(func(cred *webauthn.CredentialCreation) bool {
+		return cred.ID == creation.ID && string(cred.Response.AttestationObject) == string(creation.Response.AttestationObject)
+	})).Return(&storage.WEBAUTHNCREDENTIALS{IDWEBAUTHNCREDENTIALS: 3, NAME: "YubiKey"}, nil)
+
+	body, _ := json.Marshal(map[string]interface{}{"ceremony_token": "ceremony", "name": "YubiKey", "credential": creation})
+	req = httptest.NewRequest(http.MethodPost, "/webauthn/register/finish", strings.NewReader(string(body)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec = httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusCreated, rec.Code)
+	assert.Contains(rec.Body.String(), `"id":3`)
+	assert.Contains(rec.Body.String(), `"name":"YubiKey"`)
+}
+
+func TestHandleWebAuthnRegistration_MissingCredential(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/webauthn/register/finish", strings.NewReader(`{"ceremony_token": "ceremony"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusBadRequest, rec.Code)
+	assert.Contains(rec.Body.String(), `"name":"credential"`)
+	r.webauthn.AssertNotCalled(t, "FinishRegistration")
+}
+
+func testAssertion(t *testing.T) *webauthn.CredentialAssertion {
+	authenticator := webauthntest.New("http://localhost:8080")
+	_, err := authenticator.Create(testRP.CreationOptions([]byte("challenge"), webauthn.UserEntity{ID: []byte("1")}, nil, webauthn.UserVerificationRequired))
+	require.NoError(t, err)
+	assertion, err := authenticator.Get(testRP.RequestOptions([]byte("challenge"), nil, webauthn.UserVerificationRequired))
+	require.NoError(t, err)
+	return assertion
+}
+
+func TestHandleWebAuthnLogin_Passwordless(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	user := &service.User{ID: 1, Login: "user_login"}
+	r.webauthn.On("BeginLogin", (*service.User)(nil)).Return(&service.WebAuthnLogin{
+		Options: testRP.RequestOptions([]byte("challenge"), nil, webauthn.UserVerificationRequired),
+		Token:   "ceremony",
+	}, nil)
+	r.webauthn.On("FinishLogin", "ceremony", mock.Anything, (*service.User)(nil)).Return(user, nil)
+	r.tokens.On("IssueWebAuthnTokens", user, mock.Anything, true).Return(newTestTokenPair(), nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/webauthn/login/begin", nil)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"allowCredentials":[]`)
+
+	body, _ := json.Marshal(map[string]interface{}{"ceremony_token": "ceremony", "credential": testAssertion(t)})
+	req = httptest.NewRequest(http.MethodPost, "/webauthn/login/finish", strings.NewReader(string(body)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec = httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"access_token":"header.payload.signature"`)
+	r.mfa.AssertNotCalled(t, "CompleteChallengeWith")
+}
+
+func TestHandleWebAuthnLogin_SecondFactor(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	user := &service.User{ID: 1, Login: "user_login"}
+	r.mfa.On("PendingUser", "challenge").Return(user, nil)
+	r.mfa.On("CompleteChallengeWith", "challenge").Return(user, nil)
+	r.webauthn.On("BeginLogin", user).Return(&service.WebAuthnLogin{
+		Options: testRP.RequestOptions([]byte("challenge"), [][]byte{[]byte("id")}, webauthn.UserVerificationPreferred),
+		Token:   "ceremony",
+	}, nil)
+	r.webauthn.On("FinishLogin", "ceremony", mock.Anything, user).Return(user, nil).Once()
+	r.webauthn.On("FinishLogin", "ceremony", mock.Anything, user).Return(nil, service.ErrInvalidWebAuthnAssertion)
+	r.tokens.On("IssueWebAuthnTokens", user, mock.Anything, false).Return(newTestTokenPair(), nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/webauthn/login/begin", strings.NewReader(`{"mfa_token": "challenge"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"allowCredentials":[{"type":"public-key","id":"aWQ"}]`)
+
+	body, _ := json.Marshal(map[string]interface{}{"ceremony_token": "ceremony", "mfa_token": "challenge", "credential": testAssertion(t)})
+	for _, status := range []int{http.StatusOK, http.StatusUnauthorized} {
+		req = httptest.NewRequest(http.MethodPost, "/webauthn/login/finish", strings.NewReader(string(body)))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec = httptest.NewRecorder()
+		r.e.ServeHTTP(rec, req)
+
+		assert.Equal(status, rec.Code)
+	}
+	assert.Contains(rec.Body.String(), `"code":"invalid_webauthn_assertion"`)
+	r.tokens.AssertNumberOfCalls(t, "IssueWebAuthnTokens", 1)
+}
+
+func deleteCredential(r *testRouter, id, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodDelete, "/webauthn/credentials/"+id, strings.NewReader(body))
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandleDeleteWebAuthnCredential(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+	r.mfa.On("Confirm", uint(7), "123456").Return(nil)
+	r.webauthn.On("DeleteCredential", uint(7), uint(3)).Return(service.ErrCredentialNotFound)
+
+	rec := deleteCredential(r, "3", `{"code":"123456"}`)
+	assert.Equal(http.StatusNotFound, rec.Code)
+	assert.Contains(rec.Body.String(), `"code":"webauthn_credential_not_found"`)
+}
+
+func TestHandleDeleteWebAuthnCredential_RequiresConfirmation(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+	r.usecase.On("ConfirmPassword", uint(7), "wrong", mock.Anything).Return(service.ErrInvalidCurrentPassword)
+	r.usecase.On("ConfirmPassword", uint(7), "securePwd123", mock.Anything).Return(nil)
+	r.webauthn.On("DeleteCredential", uint(7), uint(3)).Return(nil)
+
+	// Одного access-токена недостаточно
+	rec := deleteCredential(r, "3", `{}`)
+	assert.Equal(http.StatusForbidden, rec.Code)
+	assert.Contains(rec.Body.String(), `"code":"confirmation_required"`)
+
+	// Токен церемонии без ответа ключа не принимается
+	rec = deleteCredential(r, "3", `{"ceremony_token":"ceremony"}`)
+	assert.Equal(http.StatusBadRequest, rec.Code)
+
+	rec = deleteCredential(r, "3", `{"password":"wrong"}`)
+	assert.Equal(http.StatusForbidden, rec.Code)
+	assert.Contains(rec.Body.String(), `"code":"invalid_current_password"`)
+	r.webauthn.AssertNotCalled(t, "DeleteCredential", mock.Anything, mock.Anything)
+
+	rec = deleteCredential(r, "3", `{"password":"securePwd123"}`)
+	assert.Equal(http.StatusOK, rec.Code)
+	r.webauthn.AssertNumberOfCalls(t, "DeleteCredential", 1)
+}
+
+func TestHandleDeleteWebAuthnCredential_ConfirmsWithKey(t *testing.T) {
+	assert := assert.New(t)
+	r := newTestRouter()
+	authenticator := webauthntest.New("http://localhost:8080")
+	opts := testRP.CreationOptions([]byte("challenge"), webauthn.UserEntity{ID: []byte("7"), Name: "john"}, nil, webauthn.UserVerificationPreferred)
+	_, err := authenticator.Create(opts)
+	require.NoError(t, err)
+	requestOptions := testRP.RequestOptions([]byte("confirm"), nil, webauthn.UserVerificationPreferred)
+
+	r.tokens.On("Authenticate", "access").Return(newTestClaims("7", 2), nil)
+	r.webauthn.On("BeginConfirmation", uint(7)).Return(&service.WebAuthnLogin{Options: requestOptions, Token: "ceremony"}, nil)
+	r.webauthn.On("Confirm", uint(7), "ceremony", mock.Anything).Return(nil)
+	r.webauthn.On("DeleteCredential", uint(7), uint(3)).Return(service.ErrLastSecondFactor)
+
+	req := httptest.NewRequest(http.MethodPost, "/webauthn/confirm/begin", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer access")
+	rec := httptest.NewRecorder()
+	r.e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"ceremony_token":"ceremony"`)
+
+	assertion, err := authenticator.Get(requestOptions)
+	require.NoError(t, err)
+	body, err := json.Marshal(map[string]interface{}{"ceremony_token": "ceremony", "credential": assertion})
+	require.NoError(t, err)
+
+	// Администратору нельзя удалить последний второй фактор
+	rec = deleteCredential(r, "3", string(body))
+	assert.Equal(http.StatusConflict, rec.Code)
+	assert.Contains(rec.Body.String(), `"code":"last_second_factor"`)
+	r.webauthn.AssertNumberOfCalls(t, "Confirm", 1)
+}
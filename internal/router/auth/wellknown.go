@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// JWKSMaxAge - сколько проверяющие сервисы могут держать JWKS в кэше.
+// Новый ключ начинает подписывать не раньше, чем через это время после публикации,
+// иначе сервисы со старой копией JWKS отклоняли бы свежие токены.
+const JWKSMaxAge = 5 * time.Minute
+
+var wellKnownMaxAge = fmt.Sprintf("public, max-age=%d", int(JWKSMaxAge.Seconds()))
+
+func (h *HttpRouter) handleJWKS(ctx echo.Context) error {
+	set, err := h.tokens.JWKS()
+	if err != nil {
+		return err
+	}
+
+	return writeCacheableJSON(ctx, set)
+}
+
+// handleOpenIDConfiguration отдаёт документ обнаружения. Сервис не является OpenID Provider:
+// он не выдаёт ID-токены и не поддерживает authorization code flow, поэтому в документе
+// только то, что нужно шлюзам для проверки access-токенов.
+func (h *HttpRouter) handleOpenIDConfiguration(ctx echo.Context) error {
+	issuer := h.tokens.Issuer()
+	baseURL := strings.TrimSuffix(issuer, "/")
+
+	return writeCacheableJSON(ctx, map[string]interface{}{
+		"issuer":              issuer,
+		"jwks_uri":            baseURL + "/.well-known/jwks.json",
+		"revocation_endpoint": baseURL + "/revoke",
+		// /revoke не требует аутентификации клиента
+		"revocation_endpoint_auth_methods_supported": []string{"none"},
+	})
+}
+
+func writeCacheableJSON(ctx echo.Context, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+
+	header := ctx.Response().Header()
+	header.Set(echo.HeaderCacheControl, wellKnownMaxAge)
+	header.Set("ETag", etag)
+
+	if match := ctx.Request().Header.Get("If-None-Match"); match != "" && match == etag {
+		return ctx.NoContent(http.StatusNotModified)
+	}
+
+	return ctx.JSONBlob(http.StatusOK, data)
+}
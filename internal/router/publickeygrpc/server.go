@@ -4,20 +4,75 @@ import (
 	"context"
 
 	ssov1 "UserServiceAuth/gen/go"
+	"UserServiceAuth/internal/keys"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func NewGrpcApi(server *grpc.Server) *GrpcApi {
-	router := &GrpcApi{}
+type IPublicKeys interface {
+	ActiveKey() *keys.Key
+	VerificationKeys() []keys.VerificationKey
+}
+
+func NewGrpcApi(server *grpc.Server, publicKeys IPublicKeys) *GrpcApi {
+	router := &GrpcApi{
+		keys: publicKeys,
+	}
 	ssov1.RegisterGetPublicKeyServer(server, router)
 	return router
 }
 
 type GrpcApi struct {
 	ssov1.UnimplementedGetPublicKeyServer
+	keys IPublicKeys
 }
 
 func (s *GrpcApi) PublicKey(ctx context.Context, req *ssov1.PublicKeyRequest) (*ssov1.PublicKeyResponse, error) {
-	return &ssov1.PublicKeyResponse{PublicKey: "publickey12731723929381"}, nil
+	active := s.keys.ActiveKey()
+
+	for _, key := range s.keys.VerificationKeys() {
+		if key.ID == active.ID {
+			return toPublicKeyResponse(key)
+		}
+	}
+
+	return toPublicKeyResponse(keys.VerificationKey{Key: active})
+}
+
+func (s *GrpcApi) ListPublicKeys(ctx context.Context, req *ssov1.ListPublicKeysRequest) (*ssov1.ListPublicKeysResponse, error) {
+	verificationKeys := s.keys.VerificationKeys()
+
+	resp := &ssov1.ListPublicKeysResponse{
+		Keys: make([]*ssov1.PublicKeyResponse, 0, len(verificationKeys)),
+	}
+	for _, key := range verificationKeys {
+		item, err := toPublicKeyResponse(key)
+		if err != nil {
+			return nil, err
+		}
+		resp.Keys = append(resp.Keys, item)
+	}
+
+	return resp, nil
+}
+
+func toPublicKeyResponse(key keys.VerificationKey) (*ssov1.PublicKeyResponse, error) {
+	pemBytes, err := keys.PublicKeyPEM(key.Key)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "encode public key: %v", err)
+	}
+
+	resp := &ssov1.PublicKeyResponse{
+		PublicKey: string(pemBytes),
+		KeyId:     key.ID,
+		Algorithm: key.Algorithm,
+		NotBefore: key.ActivatesAt.Unix(),
+	}
+	if !key.NotAfter.IsZero() {
+		resp.NotAfter = key.NotAfter.Unix()
+	}
+
+	return resp, nil
 }
@@ -12,13 +12,14 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 
 	ssov1 "UserServiceAuth/gen/go"
+	"UserServiceAuth/internal/keys"
 	"UserServiceAuth/internal/router/publickeygrpc"
 )
 
 // startTestGRPCServer запускает тестовый gRPC сервер
-func startTestGRPCServer(t *testing.T, port int) (*grpc.Server, net.Listener, chan struct{}) {
+func startTestGRPCServer(t *testing.T, port int, keyManager *keys.Manager) (*grpc.Server, net.Listener, chan struct{}) {
 	server := grpc.NewServer()
-	publickeygrpc.NewGrpcApi(server)
+	publickeygrpc.NewGrpcApi(server, keyManager)
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
@@ -40,8 +41,13 @@ func startTestGRPCServer(t *testing.T, port int) (*grpc.Server, net.Listener, ch
 func TestGRPCServer(t *testing.T) {
 	port := 44044
 
+	keyManager, err := keys.NewManager(t.TempDir(), keys.AlgEdDSA, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create key manager: %v", err)
+	}
+
 	// Запуск тестового сервера
-	server, lis, done := startTestGRPCServer(t, port)
+	server, lis, done := startTestGRPCServer(t, port, keyManager)
 	defer func() {
 		server.GracefulStop()
 		<-done
@@ -69,6 +75,37 @@ func TestGRPCServer(t *testing.T) {
 	}
 
 	// Проверка ответа
-	expectedPublicKey := "publickey12731723929381"
-	assert.Equal(t, expectedPublicKey, resp.PublicKey, "PublicKey should match")
+	active := keyManager.ActiveKey()
+	expectedPublicKey, err := keys.PublicKeyPEM(active)
+	if err != nil {
+		t.Fatalf("Failed to encode public key: %v", err)
+	}
+	assert.Equal(t, string(expectedPublicKey), resp.PublicKey, "PublicKey should match")
+	assert.Equal(t, active.ID, resp.KeyId)
+	assert.Equal(t, keys.AlgEdDSA, resp.Algorithm)
+	assert.Equal(t, active.ActivatesAt.Unix(), resp.NotBefore)
+
+	// Список ключей для проверки подписи содержит активный ключ
+	list, err := client.ListPublicKeys(ctx, &ssov1.ListPublicKeysRequest{})
+	if err != nil {
+		t.Fatalf("ListPublicKeys request failed: %v", err)
+	}
+	if assert.Len(t, list.Keys, 1) {
+		assert.Equal(t, active.ID, list.Keys[0].KeyId)
+	}
+
+	// Опубликованный заранее ключ действителен только с момента активации, а не создания
+	pending, err := keyManager.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	list, err = client.ListPublicKeys(ctx, &ssov1.ListPublicKeysRequest{})
+	if err != nil {
+		t.Fatalf("ListPublicKeys request failed: %v", err)
+	}
+	if assert.Len(t, list.Keys, 2) {
+		assert.Equal(t, pending.ID, list.Keys[1].KeyId)
+		assert.Equal(t, pending.ActivatesAt.Unix(), list.Keys[1].NotBefore)
+		assert.Greater(t, list.Keys[1].NotBefore, pending.CreatedAt.Unix())
+	}
 }
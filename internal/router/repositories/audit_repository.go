@@ -0,0 +1,22 @@
+package repositories
+
+import (
+	models "UserServiceAuth/storage"
+
+	"gorm.io/gorm"
+)
+
+type AuditRepository struct {
+	db *gorm.DB
+}
+
+func NewAuditRepository(db *gorm.DB) *AuditRepository {
+	router := &AuditRepository{
+		db: db,
+	}
+	return router
+}
+
+func (r *AuditRepository) Record(event *models.AUDITEVENTS) error {
+	return r.db.Create(event).Error
+}
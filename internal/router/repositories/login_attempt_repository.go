@@ -0,0 +1,74 @@
+package repositories
+
+import (
+	models "UserServiceAuth/storage"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type LoginAttemptRepository struct {
+	db *gorm.DB
+}
+
+func NewLoginAttemptRepository(db *gorm.DB) *LoginAttemptRepository {
+	router := &LoginAttemptRepository{
+		db: db,
+	}
+	return router
+}
+
+func (r *LoginAttemptRepository) GetLoginAttempts(keys []string) ([]models.LOGINATTEMPTS, error) {
+	var attempts []models.LOGINATTEMPTS
+	err := r.db.Where("attemptkey IN ?", keys).Find(&attempts).Error
+	return attempts, err
+}
+
+// ReserveLoginAttempt увеличивает счётчик, только если запись не изменилась с момента чтения.
+// observed равен nil, если записи не было. Если последняя неудача была раньше staleBefore,
+// счётчик начинается заново. false означает, что запись успела изменить параллельная попытка.
+func (r *LoginAttemptRepository) ReserveLoginAttempt(key string, observed *models.LOGINATTEMPTS, now, staleBefore int64) (bool, error) {
+	if observed == nil {
+		result := r.db.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&models.LOGINATTEMPTS{ATTEMPTKEY: key, FAILURES: 1, LASTFAILURE: now})
+		return result.RowsAffected == 1, result.Error
+	}
+
+	result := r.db.Model(&models.LOGINATTEMPTS{}).
+		Where("attemptkey = ? AND failures = ? AND lastfailure = ? AND lockeduntil = ?",
+			key, observed.FAILURES, observed.LASTFAILURE, observed.LOCKEDUNTIL).
+		Updates(map[string]interface{}{
+			"failures":    gorm.Expr("CASE WHEN lastfailure < ? THEN 1 ELSE failures + 1 END", staleBefore),
+			"lastfailure": now,
+		})
+	return result.RowsAffected == 1, result.Error
+}
+
+// ReleaseLoginAttempt возвращает попытку, занятую до проверки пароля
+func (r *LoginAttemptRepository) ReleaseLoginAttempt(key string) error {
+	return r.db.Model(&models.LOGINATTEMPTS{}).
+		Where("attemptkey = ? AND failures > 0", key).
+		Update("failures", gorm.Expr("failures - 1")).Error
+}
+
+// LockLoginAttempts блокирует ключ до until и начинает счёт неудач заново, если неудач
+// набралось не меньше threshold. false означает, что ключ уже заблокировала другая попытка.
+func (r *LoginAttemptRepository) LockLoginAttempts(key string, threshold int, until int64) (bool, error) {
+	result := r.db.Model(&models.LOGINATTEMPTS{}).
+		Where("attemptkey = ? AND failures >= ?", key, threshold).
+		Updates(map[string]interface{}{
+			"failures":    0,
+			"lockeduntil": until,
+		})
+	return result.RowsAffected == 1, result.Error
+}
+
+func (r *LoginAttemptRepository) ResetLoginAttempts(key string) error {
+	return r.db.Where("attemptkey = ?", key).Delete(&models.LOGINATTEMPTS{}).Error
+}
+
+// PurgeLoginAttempts удаляет устаревшие записи без действующей блокировки
+func (r *LoginAttemptRepository) PurgeLoginAttempts(staleBefore, now int64) (int64, error) {
+	result := r.db.Where("lastfailure < ? AND lockeduntil < ?", staleBefore, now).Delete(&models.LOGINATTEMPTS{})
+	return result.RowsAffected, result.Error
+}
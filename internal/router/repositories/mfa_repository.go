@@ -0,0 +1,97 @@
+package repositories
+
+import (
+	models "UserServiceAuth/storage"
+
+	"gorm.io/gorm"
+)
+
+type MFARepository struct {
+	db *gorm.DB
+}
+
+func NewMFARepository(db *gorm.DB) *MFARepository {
+	router := &MFARepository{
+		db: db,
+	}
+	return router
+}
+
+// SetPendingTOTP сохраняет новый секрет, пока второй фактор ещё не включён
+func (r *MFARepository) SetPendingTOTP(userID uint, secret string) error {
+	result := r.db.Model(&models.USERS{}).
+		Where("user_id = ? AND totpenabled = ?", userID, false).
+		Updates(map[string]interface{}{
+			"totpsecret":   secret,
+			"totplaststep": 0,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// EnableTOTP включает второй фактор и заменяет коды восстановления
+func (r *MFARepository) EnableTOTP(userID uint, step int64, codeHashes []string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.USERS{}).
+			Where("user_id = ? AND totpenabled = ?", userID, false).
+			Updates(map[string]interface{}{
+				"totpenabled":  true,
+				"totplaststep": step,
+				"version":      gorm.Expr("version + 1"),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RECOVERYCODES{}).Error; err != nil {
+			return err
+		}
+		codes := make([]models.RECOVERYCODES, 0, len(codeHashes))
+		for _, hash := range codeHashes {
+			codes = append(codes, models.RECOVERYCODES{USERID: userID, CODEHASH: hash})
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+// DisableTOTP выключает второй фактор и удаляет коды восстановления
+func (r *MFARepository) DisableTOTP(userID uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.USERS{}).Where("user_id = ?", userID).
+			Updates(map[string]interface{}{
+				"totpsecret":   "",
+				"totpenabled":  false,
+				"totplaststep": 0,
+				"version":      gorm.Expr("version + 1"),
+			}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.RECOVERYCODES{}).Error
+	})
+}
+
+// AdvanceTOTPStep запоминает принятый интервал. Возвращает false, если этот или более поздний
+// интервал уже был принят - код использован повторно или параллельным запросом.
+func (r *MFARepository) AdvanceTOTPStep(userID uint, step int64) (bool, error) {
+	result := r.db.Model(&models.USERS{}).
+		Where("user_id = ? AND totplaststep < ?", userID, step).
+		Update("totplaststep", step)
+	return result.RowsAffected > 0, result.Error
+}
+
+// UseRecoveryCode погашает код восстановления. Возвращает false, если кода нет или он уже использован.
+func (r *MFARepository) UseRecoveryCode(userID uint, codeHash string) (bool, error) {
+	result := r.db.Model(&models.RECOVERYCODES{}).
+		Where("user_id = ? AND codehash = ? AND used = ?", userID, codeHash, false).
+		Update("used", true)
+	return result.RowsAffected > 0, result.Error
+}
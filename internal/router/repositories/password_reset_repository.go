@@ -0,0 +1,47 @@
+package repositories
+
+import (
+	models "UserServiceAuth/storage"
+
+	"gorm.io/gorm"
+)
+
+type PasswordResetRepository struct {
+	db *gorm.DB
+}
+
+func NewPasswordResetRepository(db *gorm.DB) *PasswordResetRepository {
+	router := &PasswordResetRepository{
+		db: db,
+	}
+	return router
+}
+
+func (r *PasswordResetRepository) CreatePasswordReset(reset *models.PASSWORDRESETS) error {
+	return r.db.Create(reset).Error
+}
+
+// ConsumePasswordReset помечает токен использованным, только если он ещё не использован и не истёк,
+// поэтому один токен не может сработать дважды даже при параллельных запросах
+func (r *PasswordResetRepository) ConsumePasswordReset(tokenHash string, now int64) (*models.PASSWORDRESETS, error) {
+	result := r.db.Model(&models.PASSWORDRESETS{}).
+		Where("tokenhash = ? AND used = ? AND exp > ?", tokenHash, false, now).
+		Update("used", true)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var reset models.PASSWORDRESETS
+	if err := r.db.Where("tokenhash = ?", tokenHash).First(&reset).Error; err != nil {
+		return nil, err
+	}
+	return &reset, nil
+}
+
+// DeletePasswordResetsByUserID удаляет все токены сброса пароля пользователя
+func (r *PasswordResetRepository) DeletePasswordResetsByUserID(userID uint) error {
+	return r.db.Where("user_id = ?", userID).Delete(&models.PASSWORDRESETS{}).Error
+}
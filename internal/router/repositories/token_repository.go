@@ -0,0 +1,157 @@
+package repositories
+
+import (
+	models "UserServiceAuth/storage"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type TokenRepository struct {
+	db *gorm.DB
+}
+
+func NewTokenRepository(db *gorm.DB) *TokenRepository {
+	router := &TokenRepository{
+		db: db,
+	}
+	return router
+}
+
+func (r *TokenRepository) CreateToken(token *models.TOKENS) error {
+	return r.db.Create(token).Error
+}
+
+func (r *TokenRepository) GetTokenByFamily(family string) (*models.TOKENS, error) {
+	var token models.TOKENS
+	if err := r.db.Where("family = ?", family).First(&token).Error; err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// RotateToken заменяет refresh-токен только если в базе всё ещё лежит oldHash,
+// поэтому один и тот же токен не может быть обновлён дважды
+func (r *TokenRepository) RotateToken(family, oldHash string, next *models.TOKENS) (bool, error) {
+	result := r.db.Model(&models.TOKENS{}).
+		Where("family = ? AND refreshtoken = ? AND revoked = ?", family, oldHash, false).
+		Updates(map[string]interface{}{
+			"refreshtoken": next.REFRESHTOKEN,
+			"accesstocken": next.ACCESSTOCKEN,
+			"useragent":    next.USERAGENT,
+			"ip":           next.IP,
+			"exp":          next.EXP,
+			"lastused":     next.LASTUSED,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// RevokeFamily отзывает семейство и возвращает отозванную сессию, если она ещё была активна
+func (r *TokenRepository) RevokeFamily(family string) ([]models.TOKENS, error) {
+	var tokens []models.TOKENS
+	err := r.db.Model(&tokens).Clauses(clause.Returning{}).
+		Where("family = ? AND revoked = ?", family, false).
+		Update("revoked", true).Error
+	return tokens, err
+}
+
+func (r *TokenRepository) GetActiveTokensByUserID(userID uint, now int64) ([]models.TOKENS, error) {
+	var tokens []models.TOKENS
+	err := r.db.Where("user_id = ? AND revoked = ? AND exp > ?", userID, false, now).
+		Order("lastused DESC").
+		Find(&tokens).Error
+	return tokens, err
+}
+
+// RevokeTokenByID отзывает сессию, только если она принадлежит пользователю userID
+func (r *TokenRepository) RevokeTokenByID(userID, id uint) ([]models.TOKENS, error) {
+	var tokens []models.TOKENS
+	err := r.db.Model(&tokens).Clauses(clause.Returning{}).
+		Where("id_tokens = ? AND user_id = ? AND revoked = ?", id, userID, false).
+		Update("revoked", true).Error
+	return tokens, err
+}
+
+func (r *TokenRepository) RevokeTokensByUserID(userID uint) ([]models.TOKENS, error) {
+	var tokens []models.TOKENS
+	err := r.db.Model(&tokens).Clauses(clause.Returning{}).
+		Where("user_id = ? AND revoked = ?", userID, false).
+		Update("revoked", true).Error
+	return tokens, err
+}
+
+// RevokeOtherTokensByUserID отзывает все сессии пользователя, кроме keepID
+func (r *TokenRepository) RevokeOtherTokensByUserID(userID, keepID uint) ([]models.TOKENS, error) {
+	var tokens []models.TOKENS
+	err := r.db.Model(&tokens).Clauses(clause.Returning{}).
+		Where("user_id = ? AND id_tokens <> ? AND revoked = ?", userID, keepID, false).
+		Update("revoked", true).Error
+	return tokens, err
+}
+
+// IsSessionActive - сессия существует, не отозвана и принадлежит пользователю userID
+func (r *TokenRepository) IsSessionActive(userID, id uint) (bool, error) {
+	var count int64
+	err := r.db.Model(&models.TOKENS{}).
+		Where("id_tokens = ? AND user_id = ? AND revoked = ?", id, userID, false).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// PurgeTokens удаляет истёкшие записи об отозванных и использованных токенах, а также отозванные
+// и истёкшие сессии, последний access-токен которых выдан до staleBefore
+func (r *TokenRepository) PurgeTokens(now, staleBefore int64) (int64, error) {
+	var purged int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("exp <= ?", now).Delete(&models.REVOKEDTOKENS{})
+		if result.Error != nil {
+			return result.Error
+		}
+		purged += result.RowsAffected
+
+		result = tx.Where("exp <= ?", now).Delete(&models.USEDTOKENS{})
+		if result.Error != nil {
+			return result.Error
+		}
+		purged += result.RowsAffected
+
+		result = tx.Where("(revoked = ? OR exp <= ?) AND lastused <= ?", true, now, staleBefore).Delete(&models.TOKENS{})
+		if result.Error != nil {
+			return result.Error
+		}
+		purged += result.RowsAffected
+		return nil
+	})
+	return purged, err
+}
+
+func (r *TokenRepository) CreateRevokedToken(token *models.REVOKEDTOKENS) error {
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(token).Error
+}
+
+func (r *TokenRepository) IsTokenRevoked(jti string) (bool, error) {
+	var count int64
+	err := r.db.Model(&models.REVOKEDTOKENS{}).Where("jti = ?", jti).Count(&count).Error
+	return count > 0, err
+}
+
+// UseToken гасит одноразовый токен. false - токен уже был использован.
+func (r *TokenRepository) UseToken(token *models.USEDTOKENS) (bool, error) {
+	result := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(token)
+	return result.RowsAffected == 1, result.Error
+}
+
+func (r *TokenRepository) IsTokenUsed(jti string) (bool, error) {
+	var count int64
+	err := r.db.Model(&models.USEDTOKENS{}).Where("jti = ?", jti).Count(&count).Error
+	return count > 0, err
+}
+
+func (r *TokenRepository) GetRevokedTokens(now int64) ([]models.REVOKEDTOKENS, error) {
+	var tokens []models.REVOKEDTOKENS
+	err := r.db.Where("exp > ?", now).Order("exp").Find(&tokens).Error
+	return tokens, err
+}
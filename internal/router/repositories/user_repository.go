@@ -2,10 +2,31 @@ package repositories
 
 import (
 	models "UserServiceAuth/storage"
+	"errors"
+	"strings"
+	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// Код ошибки PostgreSQL unique_violation
+const pgUniqueViolation = "23505"
+
+// Уникальные поля пользователя. Имя поля извлекается из имени ограничения.
+var userUniqueFields = []string{"login", "email"}
+
+// Поля, по которым разрешена сортировка списка пользователей
+var userSortColumns = map[string]string{
+	"user_id":    "user_id",
+	"login":      "login",
+	"email":      "email",
+	"username":   "username",
+	"surname":    "surname",
+	"created_at": "timecreate",
+}
+
 type UserRepository struct {
 	db *gorm.DB
 }
@@ -18,16 +39,26 @@ func NewUserRepository(db *gorm.DB) *UserRepository {
 }
 
 func (r *UserRepository) CreateUser(user *models.USERS) error {
-	return r.db.Create(user).Error
+	user.LOGIN = models.NormalizeIdentifier(user.LOGIN)
+	user.EMAIL = models.NormalizeIdentifier(user.EMAIL)
+	return uniqueViolation(r.db.Create(user).Error)
 }
 
 func (r *UserRepository) GetUserByLogin(login string) (*models.USERS, error) {
 	var user models.USERS
-	if err := r.db.Where("login = ?", login).First(&user).Error; err != nil {
+	if err := r.db.Where("login = ?", models.NormalizeIdentifier(login)).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+func (r *UserRepository) GetUserByEmail(email string) (*models.USERS, error) {
+	var user models.USERS
+	if err := r.db.Where("email = ?", models.NormalizeIdentifier(email)).First(&user).Error; err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
+
 func (r *UserRepository) GetUserByID(id uint) (*models.USERS, error) {
 	var user models.USERS
 	if err := r.db.Where("user_id = ?", id).First(&user).Error; err != nil {
@@ -36,6 +67,217 @@ func (r *UserRepository) GetUserByID(id uint) (*models.USERS, error) {
 	return &user, nil
 }
 
-func (r *UserRepository) UpdateUserByID(id uint, updatedUser *models.USERS) error {
-	return r.db.Model(&models.USERS{}).Where("user_id = ?", id).Updates(updatedUser).Error
+// UpdateUserByID обновляет непустые поля, если версия строки совпадает с version
+func (r *UserRepository) UpdateUserByID(id, version uint, updatedUser *models.USERS) error {
+	fields := make(map[string]interface{})
+	if updatedUser.USERNAME != "" {
+		fields["username"] = updatedUser.USERNAME
+	}
+	if updatedUser.SURNAME != "" {
+		fields["surname"] = updatedUser.SURNAME
+	}
+	if updatedUser.EMAIL != "" {
+		setEmail(fields, updatedUser.EMAIL)
+	}
+	return r.updateVersioned(id, version, fields)
+}
+
+func (r *UserRepository) UpdateRoleByID(id uint, role string) error {
+	result := r.db.Model(&models.USERS{}).Where("user_id = ?", id).Updates(map[string]interface{}{
+		"role":    role,
+		"version": gorm.Expr("version + 1"),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// PatchUserByID обновляет только заданные поля, в том числе пустыми значениями
+func (r *UserRepository) PatchUserByID(id, version uint, patch models.UserPatch) error {
+	fields := make(map[string]interface{})
+	if patch.Username != nil {
+		fields["username"] = *patch.Username
+	}
+	if patch.Surname != nil {
+		fields["surname"] = *patch.Surname
+	}
+	if patch.Email != nil {
+		setEmail(fields, *patch.Email)
+	}
+	return r.updateVersioned(id, version, fields)
+}
+
+// setEmail меняет email и сбрасывает подтверждение, если адрес действительно другой.
+// В SET PostgreSQL видит старые значения строки, поэтому сравнение идёт с прежним email.
+func setEmail(fields map[string]interface{}, email string) {
+	email = models.NormalizeIdentifier(email)
+	fields["email"] = email
+	fields["emailverifiedat"] = gorm.Expr("CASE WHEN email = ? THEN emailverifiedat ELSE NULL END", email)
+}
+
+// MarkEmailVerified подтверждает email, если он всё ещё совпадает с адресом, на который ушло письмо
+func (r *UserRepository) MarkEmailVerified(id uint, email string) error {
+	result := r.db.Model(&models.USERS{}).
+		Where("user_id = ? AND email = ? AND emailverifiedat IS NULL", id, models.NormalizeIdentifier(email)).
+		Updates(map[string]interface{}{
+			"emailverifiedat": time.Now(),
+			"version":         gorm.Expr("version + 1"),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// updateVersioned обновляет строку и увеличивает её версию. Нулевая version отключает проверку.
+// Если версия уже другая, строка не меняется и возвращается ErrVersionConflict.
+func (r *UserRepository) updateVersioned(id, version uint, fields map[string]interface{}) error {
+	fields["version"] = gorm.Expr("version + 1")
+
+	query := r.db.Model(&models.USERS{}).Where("user_id = ?", id)
+	if version != 0 {
+		query = query.Where("version = ?", version)
+	}
+	result := query.Updates(fields)
+	if result.Error != nil {
+		return uniqueViolation(result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+
+	var count int64
+	if err := r.db.Model(&models.USERS{}).Where("user_id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return models.ErrVersionConflict
+}
+
+func (r *UserRepository) UpdatePasswordByID(id uint, password string) error {
+	return r.db.Model(&models.USERS{}).Where("user_id = ?", id).Update("password", password).Error
+}
+
+func (r *UserRepository) ListUsers(filter models.UserFilter) ([]models.USERS, int64, error) {
+	query := r.db.Model(&models.USERS{})
+	if filter.Deleted {
+		query = query.Unscoped().Where("deletedat IS NOT NULL")
+	}
+	if filter.Email != "" {
+		query = query.Where("email ILIKE ?", containsPattern(filter.Email))
+	}
+	if filter.Login != "" {
+		query = query.Where("login ILIKE ?", containsPattern(filter.Login))
+	}
+	if filter.Name != "" {
+		pattern := containsPattern(filter.Name)
+		query = query.Where("username ILIKE ? OR surname ILIKE ?", pattern, pattern)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	field, desc := strings.TrimPrefix(filter.Sort, "-"), strings.HasPrefix(filter.Sort, "-")
+	column, ok := userSortColumns[field]
+	if !ok {
+		column = "user_id"
+	}
+
+	var users []models.USERS
+	err := query.
+		Order(clause.OrderByColumn{Column: clause.Column{Name: column}, Desc: desc}).
+		Limit(filter.Limit).
+		Offset(filter.Offset).
+		Find(&users).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// DeleteUserByID помечает пользователя удалённым. Его сессии остаются в базе до PurgeDeletedUsers.
+func (r *UserRepository) DeleteUserByID(id uint) error {
+	result := r.db.Where("user_id = ?", id).Delete(&models.USERS{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *UserRepository) RestoreUserByID(id uint) error {
+	result := r.db.Unscoped().Model(&models.USERS{}).
+		Where("user_id = ? AND deletedat IS NOT NULL", id).
+		Update("deletedat", nil)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// PurgeDeletedUsers окончательно удаляет пользователей, помеченных удалёнными раньше before, вместе с их сессиями, токенами сброса пароля и кодами восстановления
+func (r *UserRepository) PurgeDeletedUsers(before time.Time) (int64, error) {
+	var purged int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		err := tx.Unscoped().Model(&models.USERS{}).
+			Where("deletedat IS NOT NULL AND deletedat < ?", before).
+			Pluck("user_id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+
+		if err := tx.Where("user_id IN ?", ids).Delete(&models.TOKENS{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id IN ?", ids).Delete(&models.PASSWORDRESETS{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id IN ?", ids).Delete(&models.RECOVERYCODES{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id IN ?", ids).Delete(&models.WEBAUTHNCREDENTIALS{}).Error; err != nil {
+			return err
+		}
+		result := tx.Unscoped().Where("user_id IN ?", ids).Delete(&models.USERS{})
+		purged = result.RowsAffected
+		return result.Error
+	})
+	return purged, err
+}
+
+// uniqueViolation переводит нарушение уникального ограничения в UniqueViolation с именем поля
+func uniqueViolation(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != pgUniqueViolation {
+		return err
+	}
+	for _, field := range userUniqueFields {
+		if strings.Contains(pgErr.ConstraintName, field) {
+			return &models.UniqueViolation{Field: field}
+		}
+	}
+	return err
+}
+
+// containsPattern строит шаблон ILIKE для поиска подстроки, экранируя спецсимволы
+func containsPattern(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return "%" + replacer.Replace(s) + "%"
 }
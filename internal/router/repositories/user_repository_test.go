@@ -0,0 +1,32 @@
+package repositories
+
+import (
+	"sync"
+	"testing"
+
+	models "UserServiceAuth/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+func TestUsersPrimaryKeyColumn(t *testing.T) {
+	s, err := schema.Parse(&models.USERS{}, &sync.Map{}, schema.NamingStrategy{})
+	require.NoError(t, err)
+	require.NotNil(t, s.PrioritizedPrimaryField)
+	assert.Equal(t, "user_id", s.PrioritizedPrimaryField.DBName)
+}
+
+func TestUpdateRoleByID_FiltersByUserID(t *testing.T) {
+	db, recorder := newDryRunDB(t)
+
+	// В холостом режиме строки не меняются, поэтому репозиторий считает пользователя ненайденным
+	err := NewUserRepository(db).UpdateRoleByID(7, models.RoleAdmin)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	require.Len(t, recorder.statements, 1)
+	assert.Contains(t, recorder.statements[0], `UPDATE "users" SET "role"='admin'`)
+	assert.Contains(t, recorder.statements[0], "WHERE user_id = 7")
+}
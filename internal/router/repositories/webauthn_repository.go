@@ -0,0 +1,92 @@
+package repositories
+
+import (
+	models "UserServiceAuth/storage"
+	"errors"
+	"slices"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type WebAuthnRepository struct {
+	db *gorm.DB
+}
+
+func NewWebAuthnRepository(db *gorm.DB) *WebAuthnRepository {
+	router := &WebAuthnRepository{
+		db: db,
+	}
+	return router
+}
+
+func (r *WebAuthnRepository) CreateCredential(cred *models.WEBAUTHNCREDENTIALS) error {
+	err := r.db.Create(cred).Error
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+		return &models.UniqueViolation{Field: "credential_id"}
+	}
+	return err
+}
+
+func (r *WebAuthnRepository) GetCredentialsByUserID(userID uint) ([]models.WEBAUTHNCREDENTIALS, error) {
+	var creds []models.WEBAUTHNCREDENTIALS
+	err := r.db.Where("user_id = ?", userID).Order("id_webauthncredentials").Find(&creds).Error
+	return creds, err
+}
+
+func (r *WebAuthnRepository) GetCredentialByCredentialID(credentialID string) (*models.WEBAUTHNCREDENTIALS, error) {
+	var cred models.WEBAUTHNCREDENTIALS
+	if err := r.db.Where("credential_id = ?", credentialID).First(&cred).Error; err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+func (r *WebAuthnRepository) CountCredentialsByUserID(userID uint) (int64, error) {
+	var count int64
+	err := r.db.Model(&models.WEBAUTHNCREDENTIALS{}).Where("user_id = ?", userID).Count(&count).Error
+	return count, err
+}
+
+// UpdateSignCount сохраняет новый счётчик подписей, только если он не изменился с момента чтения.
+// Возвращает false, если ключ параллельно использовали другим запросом.
+func (r *WebAuthnRepository) UpdateSignCount(id uint, old, next uint32, lastUsed int64) (bool, error) {
+	result := r.db.Model(&models.WEBAUTHNCREDENTIALS{}).
+		Where("id_webauthncredentials = ? AND signcount = ?", id, old).
+		Updates(map[string]interface{}{
+			"signcount": next,
+			"lastused":  lastUsed,
+		})
+	return result.RowsAffected > 0, result.Error
+}
+
+// DeleteCredential удаляет ключ пользователя. Возвращает false, если такого ключа у пользователя нет.
+// С keepLast последний ключ не удаляется и возвращается ErrLastCredential. Ключи пользователя
+// блокируются до конца транзакции, чтобы параллельные запросы не удалили два последних ключа.
+func (r *WebAuthnRepository) DeleteCredential(userID, id uint, keepLast bool) (bool, error) {
+	deleted := false
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		err := tx.Model(&models.WEBAUTHNCREDENTIALS{}).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ?", userID).
+			Order("id_webauthncredentials").
+			Pluck("id_webauthncredentials", &ids).Error
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(ids, id) {
+			return nil
+		}
+		if keepLast && len(ids) == 1 {
+			return models.ErrLastCredential
+		}
+
+		result := tx.Where("user_id = ? AND id_webauthncredentials = ?", userID, id).Delete(&models.WEBAUTHNCREDENTIALS{})
+		deleted = result.RowsAffected > 0
+		return result.Error
+	})
+	return deleted, err
+}
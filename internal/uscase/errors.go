@@ -0,0 +1,69 @@
+package service
+
+import (
+	"errors"
+	"time"
+)
+
+// Ошибки предметной области. HTTP-слой сопоставляет их с кодами ответа,
+// поэтому текст ошибок не должен раскрывать внутренние детали.
+var (
+	ErrUserNotFound           = errors.New("user not found")
+	ErrDeletedUserNotFound    = errors.New("deleted user not found")
+	ErrUserExists             = errors.New("user already exists")
+	ErrInvalidCredentials     = errors.New("invalid login or password")
+	ErrTooManyAttempts        = errors.New("too many failed login attempts")
+	ErrInvalidCurrentPassword = errors.New("invalid current password")
+	ErrVersionConflict        = errors.New("user was modified concurrently")
+
+	ErrEmailNotVerified         = errors.New("email is not verified")
+	ErrEmailAlreadyVerified     = errors.New("email is already verified")
+	ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+	ErrInvalidResetToken        = errors.New("invalid or expired password reset token")
+
+	ErrMFAAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnabled     = errors.New("two-factor authentication is not enabled")
+	ErrInvalidMFACode    = errors.New("invalid two-factor authentication code")
+	ErrInvalidMFAToken   = errors.New("invalid or expired mfa token")
+
+	ErrInvalidWebAuthnCeremony    = errors.New("invalid or expired webauthn ceremony")
+	ErrInvalidWebAuthnAttestation = errors.New("webauthn registration could not be verified")
+	ErrInvalidWebAuthnAssertion   = errors.New("webauthn assertion could not be verified")
+	ErrCredentialExists           = errors.New("webauthn credential is already registered")
+	ErrCredentialNotFound         = errors.New("webauthn credential not found")
+	ErrLastSecondFactor           = errors.New("the last second factor of an administrator cannot be removed")
+	ErrConfirmationRequired       = errors.New("confirm with a security key, a two-factor code or the password")
+
+	ErrInvalidAccessToken  = errors.New("invalid access token")
+	ErrAccessTokenRevoked  = errors.New("access token revoked")
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+// ConflictError - значение уникального поля (login, email) уже занято другим пользователем
+type ConflictError struct {
+	Field string
+}
+
+func (e *ConflictError) Error() string {
+	return e.Field + " is already taken"
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrUserExists
+}
+
+// TooManyAttemptsError - вход временно запрещён после неудачных попыток. По ответу нельзя
+// отличить задержку от блокировки и существующий логин от несуществующего.
+type TooManyAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyAttemptsError) Error() string {
+	return ErrTooManyAttempts.Error()
+}
+
+func (e *TooManyAttemptsError) Is(target error) bool {
+	return target == ErrTooManyAttempts
+}
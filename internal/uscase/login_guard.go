@@ -0,0 +1,228 @@
+package service
+
+import (
+	"UserServiceAuth/internal/config"
+	models "UserServiceAuth/storage"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	loginAttemptPrefix        = "login:"
+	ipAttemptPrefix           = "ip:"
+	secondFactorAttemptPrefix = "mfa:"
+
+	// Сколько раз попытка пробует занять место, если одновременно с ней счётчик меняют другие
+	reserveRetries = 5
+)
+
+type ILoginAttemptRepository interface {
+	GetLoginAttempts(keys []string) ([]models.LOGINATTEMPTS, error)
+	ReserveLoginAttempt(key string, observed *models.LOGINATTEMPTS, now, staleBefore int64) (bool, error)
+	ReleaseLoginAttempt(key string) error
+	LockLoginAttempts(key string, threshold int, until int64) (bool, error)
+	ResetLoginAttempts(key string) error
+	PurgeLoginAttempts(staleBefore, now int64) (int64, error)
+}
+
+type IAuditLog interface {
+	Record(event *models.AUDITEVENTS) error
+}
+
+// LoginGuard защищает вход по паролю от перебора. Неудачные попытки считаются по логину
+// и по IP-адресу: после нескольких неудач каждая следующая попытка возможна только после
+// удваивающейся задержки, а после LockoutThreshold неудач по логину аккаунт блокируется.
+// Попытка учитывается как неудачная ещё до проверки пароля и списывается только при успехе,
+// поэтому пачка параллельных запросов не получает больше попыток, чем последовательные.
+type LoginGuard struct {
+	repo  ILoginAttemptRepository
+	audit IAuditLog
+	cfg   config.BruteForceConfig
+}
+
+func NewLoginGuard(repo ILoginAttemptRepository, audit IAuditLog, cfg *config.Config) *LoginGuard {
+	return &LoginGuard{
+		repo:  repo,
+		audit: audit,
+		cfg:   cfg.BruteForce,
+	}
+}
+
+// Reserve занимает попытку входа по логину и IP-адресу или возвращает TooManyAttemptsError,
+// если пароль сейчас проверять нельзя. Занятая попытка считается неудачной, пока не вызван Succeeded.
+func (g *LoginGuard) Reserve(login, ip string) error {
+	if ip != "" {
+		if err := g.reserve(ipKey(ip), g.cfg.IPFreeAttempts); err != nil {
+			return err
+		}
+	}
+	if err := g.reserve(loginKey(login), g.cfg.FreeAttempts); err != nil {
+		if ip != "" {
+			if releaseErr := g.repo.ReleaseLoginAttempt(ipKey(ip)); releaseErr != nil {
+				return releaseErr
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// reserve увеличивает счётчик ключа, только если он не изменился с момента проверки задержки
+func (g *LoginGuard) reserve(key string, free int) error {
+	for i := 0; i < reserveRetries; i++ {
+		attempts, err := g.repo.GetLoginAttempts([]string{key})
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		var observed *models.LOGINATTEMPTS
+		if len(attempts) > 0 {
+			observed = &attempts[0]
+			if wait := g.retryAfter(*observed, free, now); wait > 0 {
+				return tooManyAttempts(wait)
+			}
+		}
+
+		reserved, err := g.repo.ReserveLoginAttempt(key, observed, now.Unix(), now.Add(-g.cfg.Window).Unix())
+		if err != nil {
+			return err
+		}
+		if reserved {
+			return nil
+		}
+	}
+	// Счётчик всё время меняют параллельные попытки - это уже перебор
+	return tooManyAttempts(time.Second)
+}
+
+// Failed завершает занятую попытку как неудачную и блокирует аккаунт, если неудач
+// набралось LockoutThreshold. user равен nil, если логин не найден.
+func (g *LoginGuard) Failed(login, ip string, user *models.USERS) error {
+	return g.lockIfExceeded(loginKey(login), login, ip, user)
+}
+
+// ReserveSecondFactor занимает попытку ввода второго фактора. Для кодов действуют те же
+// бесплатные попытки, задержки и блокировка, что и для пароля, но со своим счётчиком.
+func (g *LoginGuard) ReserveSecondFactor(userID uint) error {
+	return g.reserve(secondFactorKey(userID), g.cfg.FreeAttempts)
+}
+
+func (g *LoginGuard) SecondFactorFailed(user *models.USERS) error {
+	return g.lockIfExceeded(secondFactorKey(user.USERID), user.LOGIN, "", user)
+}
+
+func (g *LoginGuard) SecondFactorSucceeded(userID uint) error {
+	return g.repo.ResetLoginAttempts(secondFactorKey(userID))
+}
+
+// lockIfExceeded блокирует ключ, если по нему набралось LockoutThreshold неудач
+func (g *LoginGuard) lockIfExceeded(key, login, ip string, user *models.USERS) error {
+	attempts, err := g.repo.GetLoginAttempts([]string{key})
+	if err != nil || len(attempts) == 0 {
+		return err
+	}
+	attempt := attempts[0]
+	if attempt.FAILURES < g.cfg.LockoutThreshold {
+		return nil
+	}
+
+	until := time.Now().Add(g.cfg.LockoutDuration)
+	// Блокирует только одна из параллельных неудач, остальные видят уже сброшенный счётчик
+	locked, err := g.repo.LockLoginAttempts(attempt.ATTEMPTKEY, g.cfg.LockoutThreshold, until.Unix())
+	if err != nil || !locked {
+		return err
+	}
+	event := &models.AUDITEVENTS{
+		EVENT:   models.AuditAccountLocked,
+		LOGIN:   models.NormalizeIdentifier(login),
+		IP:      ip,
+		DETAILS: fmt.Sprintf("%d failed %s attempts, locked until %s", attempt.FAILURES, attemptKind(key), until.UTC().Format(time.RFC3339)),
+	}
+	if user != nil {
+		event.USERID = &user.USERID
+	}
+	return g.audit.Record(event)
+}
+
+// Succeeded сбрасывает счётчик логина и возвращает попытку, занятую на IP-адресе. Остальные
+// неудачи с адреса не прощаются: иначе перебор чужих паролей можно было бы чередовать со входом в свой аккаунт.
+func (g *LoginGuard) Succeeded(login, ip string) error {
+	if err := g.repo.ResetLoginAttempts(loginKey(login)); err != nil {
+		return err
+	}
+	if ip == "" {
+		return nil
+	}
+	return g.repo.ReleaseLoginAttempt(ipKey(ip))
+}
+
+// Unlock снимает блокировку и задержку с аккаунта по решению администратора
+func (g *LoginGuard) Unlock(user *models.USERS, adminID uint) error {
+	if err := g.repo.ResetLoginAttempts(loginKey(user.LOGIN)); err != nil {
+		return err
+	}
+	if err := g.repo.ResetLoginAttempts(secondFactorKey(user.USERID)); err != nil {
+		return err
+	}
+	return g.audit.Record(&models.AUDITEVENTS{
+		EVENT:   models.AuditAccountUnlocked,
+		USERID:  &user.USERID,
+		ACTORID: &adminID,
+		LOGIN:   user.LOGIN,
+	})
+}
+
+// PurgeStale удаляет записи, которые уже не влияют на вход
+func (g *LoginGuard) PurgeStale() (int64, error) {
+	now := time.Now()
+	return g.repo.PurgeLoginAttempts(now.Add(-g.cfg.Window).Unix(), now.Unix())
+}
+
+// retryAfter - сколько ещё ждать до следующей попытки по этому ключу
+func (g *LoginGuard) retryAfter(attempt models.LOGINATTEMPTS, free int, now time.Time) time.Duration {
+	var wait time.Duration
+	if locked := time.Unix(attempt.LOCKEDUNTIL, 0); locked.After(now) {
+		wait = locked.Sub(now)
+	}
+
+	last := time.Unix(attempt.LASTFAILURE, 0)
+	if attempt.FAILURES <= free || now.Sub(last) > g.cfg.Window {
+		return wait
+	}
+	delay := g.cfg.BaseDelay
+	for i := free + 1; i < attempt.FAILURES && delay < g.cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, g.cfg.MaxDelay)
+	if next := last.Add(delay); next.After(now) {
+		wait = max(wait, next.Sub(now))
+	}
+	return wait
+}
+
+// tooManyAttempts сообщает клиенту целые секунды ожидания, округлённые вверх
+func tooManyAttempts(wait time.Duration) error {
+	return &TooManyAttemptsError{RetryAfter: (wait + time.Second - 1).Truncate(time.Second)}
+}
+
+func loginKey(login string) string {
+	return loginAttemptPrefix + models.NormalizeIdentifier(login)
+}
+
+func ipKey(ip string) string {
+	return ipAttemptPrefix + ip
+}
+
+func secondFactorKey(userID uint) string {
+	return secondFactorAttemptPrefix + strconv.FormatUint(uint64(userID), 10)
+}
+
+func attemptKind(key string) string {
+	if strings.HasPrefix(key, secondFactorAttemptPrefix) {
+		return "second factor"
+	}
+	return "password"
+}
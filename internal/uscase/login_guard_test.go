@@ -0,0 +1,338 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"UserServiceAuth/internal/config"
+	models "UserServiceAuth/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryLoginAttemptRepository struct {
+	mu       sync.Mutex
+	attempts map[string]*models.LOGINATTEMPTS
+}
+
+func (r *memoryLoginAttemptRepository) GetLoginAttempts(keys []string) ([]models.LOGINATTEMPTS, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var attempts []models.LOGINATTEMPTS
+	for _, key := range keys {
+		if attempt, ok := r.attempts[key]; ok {
+			attempts = append(attempts, *attempt)
+		}
+	}
+	return attempts, nil
+}
+
+func (r *memoryLoginAttemptRepository) ReserveLoginAttempt(key string, observed *models.LOGINATTEMPTS, now, staleBefore int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	attempt, ok := r.attempts[key]
+	if observed == nil {
+		if ok {
+			return false, nil
+		}
+		r.attempts[key] = &models.LOGINATTEMPTS{ATTEMPTKEY: key, FAILURES: 1, LASTFAILURE: now}
+		return true, nil
+	}
+	if !ok || *attempt != *observed {
+		return false, nil
+	}
+
+	if attempt.LASTFAILURE < staleBefore {
+		attempt.FAILURES = 0
+	}
+	attempt.FAILURES++
+	attempt.LASTFAILURE = now
+	return true, nil
+}
+
+func (r *memoryLoginAttemptRepository) ReleaseLoginAttempt(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if attempt, ok := r.attempts[key]; ok && attempt.FAILURES > 0 {
+		attempt.FAILURES--
+	}
+	return nil
+}
+
+func (r *memoryLoginAttemptRepository) LockLoginAttempts(key string, threshold int, until int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	attempt, ok := r.attempts[key]
+	if !ok || attempt.FAILURES < threshold {
+		return false, nil
+	}
+	attempt.FAILURES = 0
+	attempt.LOCKEDUNTIL = until
+	return true, nil
+}
+
+func (r *memoryLoginAttemptRepository) ResetLoginAttempts(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.attempts, key)
+	return nil
+}
+
+func (r *memoryLoginAttemptRepository) PurgeLoginAttempts(staleBefore, now int64) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var purged int64
+	for key, attempt := range r.attempts {
+		if attempt.LASTFAILURE < staleBefore && attempt.LOCKEDUNTIL < now {
+			delete(r.attempts, key)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+type memoryAuditLog struct {
+	events []models.AUDITEVENTS
+}
+
+func (l *memoryAuditLog) Record(event *models.AUDITEVENTS) error {
+	l.events = append(l.events, *event)
+	return nil
+}
+
+func newTestLoginGuard(cfg config.BruteForceConfig) (*LoginGuard, *memoryAuditLog) {
+	repo := &memoryLoginAttemptRepository{attempts: make(map[string]*models.LOGINATTEMPTS)}
+	audit := &memoryAuditLog{}
+	return NewLoginGuard(repo, audit, &config.Config{BruteForce: cfg}), audit
+}
+
+func newGuardedUserService(t *testing.T, cfg config.BruteForceConfig) (*UserService, *models.USERS, *memoryAuditLog) {
+	s, users := newTestUserService(t)
+	guard, audit := newTestLoginGuard(cfg)
+	s.guard = guard
+
+	registerTestUser(t, s, "johndoe", "securePwd123", Profile{})
+	user, err := users.GetUserByLogin("johndoe")
+	require.NoError(t, err)
+	return s, user, audit
+}
+
+func retryAfter(t *testing.T, err error) time.Duration {
+	var tooMany *TooManyAttemptsError
+	require.ErrorAs(t, err, &tooMany)
+	return tooMany.RetryAfter
+}
+
+func TestAuthenticateUser_ExponentialBackoff(t *testing.T) {
+	s, _, _ := newGuardedUserService(t, config.BruteForceConfig{
+		FreeAttempts:     2,
+		IPFreeAttempts:   100,
+		BaseDelay:        time.Minute,
+		MaxDelay:         3 * time.Minute,
+		LockoutThreshold: 100,
+		Window:           time.Hour,
+	})
+	client := ClientInfo{IP: "192.0.2.1"}
+	repo := s.guard.(*LoginGuard).repo.(*memoryLoginAttemptRepository)
+
+	for i := 0; i < 3; i++ {
+		_, err := s.AuthenticateUser("johndoe", "wrong", client)
+		require.ErrorIs(t, err, ErrInvalidCredentials)
+	}
+
+	// Во время задержки не принимается даже верный пароль
+	_, err := s.AuthenticateUser("johndoe", "securePwd123", client)
+	assert.InDelta(t, time.Minute, retryAfter(t, err), float64(2*time.Second))
+
+	// Каждая следующая неудача удваивает задержку, но не больше MaxDelay
+	for _, want := range []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		repo.attempts[loginKey("johndoe")].LASTFAILURE -= int64(time.Hour.Seconds() / 2)
+		_, err = s.AuthenticateUser("johndoe", "wrong", client)
+		require.ErrorIs(t, err, ErrInvalidCredentials)
+		_, err = s.AuthenticateUser("johndoe", "wrong", client)
+		assert.InDelta(t, want, retryAfter(t, err), float64(2*time.Second))
+	}
+
+	// Успешный вход сбрасывает счётчик логина
+	repo.attempts[loginKey("johndoe")].LASTFAILURE -= int64(time.Hour.Seconds() / 2)
+	_, err = s.AuthenticateUser("johndoe", "securePwd123", client)
+	require.NoError(t, err)
+	_, err = s.AuthenticateUser("johndoe", "wrong", client)
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestAuthenticateUser_LockoutAndUnlock(t *testing.T) {
+	s, user, audit := newGuardedUserService(t, config.BruteForceConfig{
+		FreeAttempts:     100,
+		IPFreeAttempts:   100,
+		LockoutThreshold: 3,
+		LockoutDuration:  30 * time.Minute,
+		Window:           time.Hour,
+	})
+	client := ClientInfo{IP: "192.0.2.1"}
+
+	for i := 0; i < 3; i++ {
+		_, err := s.AuthenticateUser("JohnDoe", "wrong", client)
+		require.ErrorIs(t, err, ErrInvalidCredentials)
+	}
+	_, err := s.AuthenticateUser("johndoe", "securePwd123", client)
+	assert.InDelta(t, 30*time.Minute, retryAfter(t, err), float64(2*time.Second))
+
+	require.Len(t, audit.events, 1)
+	assert.Equal(t, models.AuditAccountLocked, audit.events[0].EVENT)
+	assert.Equal(t, "johndoe", audit.events[0].LOGIN)
+	assert.Equal(t, "192.0.2.1", audit.events[0].IP)
+	require.NotNil(t, audit.events[0].USERID)
+	assert.Equal(t, user.USERID, *audit.events[0].USERID)
+
+	require.NoError(t, s.UnlockUser(user.USERID, 99))
+	_, err = s.AuthenticateUser("johndoe", "securePwd123", client)
+	require.NoError(t, err)
+
+	require.Len(t, audit.events, 2)
+	assert.Equal(t, models.AuditAccountUnlocked, audit.events[1].EVENT)
+	assert.Equal(t, uint(99), *audit.events[1].ACTORID)
+
+	assert.ErrorIs(t, s.UnlockUser(user.USERID+1, 99), ErrUserNotFound)
+}
+
+func TestChangePassword_LocksOutAfterFailures(t *testing.T) {
+	s, user, audit := newGuardedUserService(t, config.BruteForceConfig{
+		FreeAttempts:     100,
+		IPFreeAttempts:   100,
+		LockoutThreshold: 3,
+		LockoutDuration:  30 * time.Minute,
+		Window:           time.Hour,
+	})
+	client := ClientInfo{IP: "192.0.2.1"}
+
+	for i := 0; i < 3; i++ {
+		require.ErrorIs(t, s.ChangePassword(user.USERID, "wrong", "newPwd456", client), ErrInvalidCurrentPassword)
+	}
+
+	// Перебор через смену пароля блокирует и смену пароля, и вход
+	err := s.ChangePassword(user.USERID, "securePwd123", "newPwd456", client)
+	assert.InDelta(t, 30*time.Minute, retryAfter(t, err), float64(2*time.Second))
+	_, err = s.AuthenticateUser("johndoe", "securePwd123", client)
+	assert.ErrorIs(t, err, ErrTooManyAttempts)
+	if assert.Len(t, audit.events, 1) {
+		assert.Equal(t, models.AuditAccountLocked, audit.events[0].EVENT)
+	}
+}
+
+func TestAuthenticateUser_UnknownLoginBehavesTheSame(t *testing.T) {
+	s, _, audit := newGuardedUserService(t, config.BruteForceConfig{
+		FreeAttempts:     100,
+		IPFreeAttempts:   100,
+		LockoutThreshold: 2,
+		LockoutDuration:  30 * time.Minute,
+		Window:           time.Hour,
+	})
+
+	var errs []error
+	for _, login := range []string{"johndoe", "nobody"} {
+		for i := 0; i < 3; i++ {
+			_, err := s.AuthenticateUser(login, "wrong", ClientInfo{})
+			errs = append(errs, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		assert.ErrorIs(t, errs[i], ErrInvalidCredentials)
+		assert.ErrorIs(t, errs[i+3], ErrInvalidCredentials)
+	}
+	assert.InDelta(t, retryAfter(t, errs[2]), retryAfter(t, errs[5]), float64(time.Second))
+
+	require.Len(t, audit.events, 2)
+	assert.NotNil(t, audit.events[0].USERID)
+	assert.Nil(t, audit.events[1].USERID)
+	assert.Equal(t, "nobody", audit.events[1].LOGIN)
+}
+
+func TestAuthenticateUser_IPBackoff(t *testing.T) {
+	s, _, _ := newGuardedUserService(t, config.BruteForceConfig{
+		FreeAttempts:     100,
+		IPFreeAttempts:   2,
+		BaseDelay:        time.Minute,
+		MaxDelay:         time.Hour,
+		LockoutThreshold: 100,
+		Window:           time.Hour,
+	})
+	attacker := ClientInfo{IP: "198.51.100.7"}
+
+	// Перебор разных логинов с одного адреса тоже замедляется
+	for _, login := range []string{"alice", "bob", "carol"} {
+		_, err := s.AuthenticateUser(login, "wrong", attacker)
+		require.ErrorIs(t, err, ErrInvalidCredentials)
+	}
+	_, err := s.AuthenticateUser("johndoe", "securePwd123", attacker)
+	assert.ErrorIs(t, err, ErrTooManyAttempts)
+
+	// С другого адреса владелец аккаунта входит без задержки
+	_, err = s.AuthenticateUser("johndoe", "securePwd123", ClientInfo{IP: "192.0.2.1"})
+	assert.NoError(t, err)
+}
+
+func TestAuthenticateUser_ParallelBurstGetsNoExtraAttempts(t *testing.T) {
+	s, _, _ := newGuardedUserService(t, config.BruteForceConfig{
+		FreeAttempts:     3,
+		IPFreeAttempts:   100,
+		BaseDelay:        time.Minute,
+		MaxDelay:         time.Hour,
+		LockoutThreshold: 100,
+		Window:           time.Hour,
+	})
+
+	const burst = 20
+	errs := make(chan error, burst)
+	var wg sync.WaitGroup
+	for i := 0; i < burst; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.AuthenticateUser("johndoe", "wrong", ClientInfo{IP: "198.51.100.7"})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// Пароль проверяется столько же раз, сколько при последовательных попытках
+	var checked int
+	for err := range errs {
+		if errors.Is(err, ErrInvalidCredentials) {
+			checked++
+			continue
+		}
+		assert.ErrorIs(t, err, ErrTooManyAttempts)
+	}
+	assert.Equal(t, 4, checked)
+}
+
+func TestLoginGuard_SuccessReleasesIPReservation(t *testing.T) {
+	s, _, _ := newGuardedUserService(t, config.BruteForceConfig{
+		FreeAttempts:     100,
+		IPFreeAttempts:   2,
+		BaseDelay:        time.Minute,
+		MaxDelay:         time.Hour,
+		LockoutThreshold: 100,
+		Window:           time.Hour,
+	})
+	office := ClientInfo{IP: "192.0.2.1"}
+
+	// Успешные входы с общего адреса не копят задержку для него
+	for i := 0; i < 5; i++ {
+		_, err := s.AuthenticateUser("johndoe", "securePwd123", office)
+		require.NoError(t, err)
+	}
+	repo := s.guard.(*LoginGuard).repo.(*memoryLoginAttemptRepository)
+	assert.Equal(t, 0, repo.attempts[ipKey(office.IP)].FAILURES)
+}
@@ -0,0 +1,341 @@
+package service
+
+import (
+	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/keys"
+	"UserServiceAuth/internal/totp"
+	models "UserServiceAuth/storage"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+const (
+	// Отдельная аудитория не даёт использовать MFA-токен как access-токен
+	mfaChallengeAudience = "mfa-challenge"
+	// Допустимое расхождение часов - один интервал TOTP в каждую сторону
+	totpSkew = 1
+
+	recoveryCodeCount = 10
+)
+
+// ISecondFactorGuard ограничивает перебор кодов второго фактора. Попытки считаются по пользователю,
+// а не по токену второго шага: новый токен, полученный повторным вводом пароля, счётчик не сбрасывает.
+type ISecondFactorGuard interface {
+	ReserveSecondFactor(userID uint) error
+	SecondFactorFailed(user *models.USERS) error
+	SecondFactorSucceeded(userID uint) error
+}
+
+type IMFARepository interface {
+	SetPendingTOTP(userID uint, secret string) error
+	EnableTOTP(userID uint, step int64, codeHashes []string) error
+	DisableTOTP(userID uint) error
+	AdvanceTOTPStep(userID uint, step int64) (bool, error)
+	UseRecoveryCode(userID uint, codeHash string) (bool, error)
+}
+
+// TOTPEnrollment - данные для добавления аккаунта в приложение-аутентификатор
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
+}
+
+// MFAChallenge - токен второго шага входа, выдаваемый после проверки пароля
+type MFAChallenge struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+// MFAService управляет вторым фактором (TOTP и коды восстановления) и вторым шагом входа
+type MFAService struct {
+	mfaRepo   IMFARepository
+	userRepo  IUserRepository
+	tokenRepo ITokenRepository
+	guard     ISecondFactorGuard
+	keys      ISigningKeys
+	issuer    string
+	totpName  string
+	ttl       time.Duration
+}
+
+func NewMFAService(mfaRepo IMFARepository, userRepo IUserRepository, tokenRepo ITokenRepository, guard ISecondFactorGuard, signingKeys ISigningKeys, cfg *config.Config) *MFAService {
+	return &MFAService{
+		mfaRepo:   mfaRepo,
+		userRepo:  userRepo,
+		tokenRepo: tokenRepo,
+		guard:     guard,
+		keys:      signingKeys,
+		issuer:    cfg.JWT.Issuer,
+		totpName:  cfg.MFA.Issuer,
+		ttl:       cfg.MFA.ChallengeTTL,
+	}
+}
+
+// BeginEnrollment создаёт новый секрет TOTP. Второй фактор включается только после ConfirmEnrollment.
+func (s *MFAService) BeginEnrollment(userID uint) (*TOTPEnrollment, error) {
+	user, err := s.user(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPENABLED {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mfaRepo.SetPendingTOTP(userID, secret); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMFAAlreadyEnabled
+		}
+		return nil, err
+	}
+
+	return &TOTPEnrollment{
+		Secret: secret,
+		URI:    totp.URI(s.totpName, user.LOGIN, secret),
+	}, nil
+}
+
+// ConfirmEnrollment включает второй фактор, если код подходит к новому секрету,
+// и возвращает коды восстановления. Они показываются пользователю только один раз.
+func (s *MFAService) ConfirmEnrollment(userID uint, code string) ([]string, error) {
+	user, err := s.user(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPENABLED {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if user.TOTPSECRET == "" {
+		return nil, ErrMFANotEnabled
+	}
+
+	step, ok := totp.Validate(user.TOTPSECRET, strings.TrimSpace(code), time.Now(), totpSkew, user.TOTPLASTSTEP)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mfaRepo.EnableTOTP(userID, step, hashes); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMFAAlreadyEnabled
+		}
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Disable выключает второй фактор. Нужен действующий код TOTP или код восстановления.
+func (s *MFAService) Disable(userID uint, code string) error {
+	if err := s.Confirm(userID, code); err != nil {
+		return err
+	}
+	return s.mfaRepo.DisableTOTP(userID)
+}
+
+// Confirm проверяет код TOTP или код восстановления перед изменением защиты аккаунта
+func (s *MFAService) Confirm(userID uint, code string) error {
+	user, err := s.user(userID)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPENABLED {
+		return ErrMFANotEnabled
+	}
+	return s.guarded(user, func(user *models.USERS) error { return s.verifyCode(user, code) })
+}
+
+// Challenge выдаёт токен второго шага входа для пользователя, прошедшего проверку пароля
+func (s *MFAService) Challenge(user *User) (*MFAChallenge, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(s.ttl)
+	token, err := sign(s.keys, jwt.RegisteredClaims{
+		ID:        jti,
+		Issuer:    s.issuer,
+		Subject:   strconv.FormatUint(uint64(user.ID), 10),
+		Audience:  jwt.ClaimStrings{mfaChallengeAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &MFAChallenge{Token: token, ExpiresAt: expiresAt}, nil
+}
+
+// CompleteChallenge проверяет токен второго шага и код TOTP или код восстановления
+func (s *MFAService) CompleteChallenge(token, code string) (*User, error) {
+	return s.completeChallenge(token, func(user *models.USERS) error {
+		if !user.TOTPENABLED {
+			return ErrInvalidMFACode
+		}
+		return s.verifyCode(user, code)
+	})
+}
+
+// CompleteChallengeWith гасит токен второго шага, если verify подтвердила второй фактор.
+// Токен одноразовый, а неудачные проверки замедляют следующие попытки пользователя.
+func (s *MFAService) CompleteChallengeWith(token string, verify func(user *User) error) (*User, error) {
+	return s.completeChallenge(token, func(user *models.USERS) error { return verify(newUser(user)) })
+}
+
+func (s *MFAService) completeChallenge(token string, verify func(user *models.USERS) error) (*User, error) {
+	claims, user, err := s.parseChallenge(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.guarded(user, verify); err != nil {
+		return nil, err
+	}
+
+	fresh, err := s.tokenRepo.UseToken(&models.USEDTOKENS{
+		JTI: claims.ID,
+		EXP: claims.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		// Токен успели погасить параллельным запросом
+		return nil, ErrInvalidMFAToken
+	}
+	return newUser(user), nil
+}
+
+// PendingUser возвращает пользователя, которому выдан токен второго шага, не погашая токен
+func (s *MFAService) PendingUser(token string) (*User, error) {
+	_, user, err := s.parseChallenge(token)
+	if err != nil {
+		return nil, err
+	}
+	return newUser(user), nil
+}
+
+func (s *MFAService) parseChallenge(token string) (*jwt.RegisteredClaims, *models.USERS, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		return publicKey(s.keys, t)
+	},
+		jwt.WithValidMethods([]string{keys.AlgRS256, keys.AlgES256, keys.AlgEdDSA}),
+		jwt.WithIssuer(s.issuer),
+		jwt.WithAudience(mfaChallengeAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, nil, ErrInvalidMFAToken
+	}
+	userID, err := strconv.ParseUint(claims.Subject, 10, 32)
+	if err != nil || claims.ID == "" {
+		return nil, nil, ErrInvalidMFAToken
+	}
+
+	used, err := s.tokenRepo.IsTokenUsed(claims.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if used {
+		return nil, nil, ErrInvalidMFAToken
+	}
+
+	user, err := s.userRepo.GetUserByID(uint(userID))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrInvalidMFAToken
+		}
+		return nil, nil, err
+	}
+	return claims, user, nil
+}
+
+// verifyCode принимает код TOTP из шести цифр или код восстановления
+func (s *MFAService) verifyCode(user *models.USERS, code string) error {
+	code = strings.TrimSpace(code)
+
+	if len(code) == totp.Digits {
+		step, ok := totp.Validate(user.TOTPSECRET, code, time.Now(), totpSkew, user.TOTPLASTSTEP)
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		advanced, err := s.mfaRepo.AdvanceTOTPStep(user.USERID, step)
+		if err != nil {
+			return err
+		}
+		if !advanced {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	ok, err := s.mfaRepo.UseRecoveryCode(user.USERID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// guarded проверяет второй фактор с учётом попыток пользователя в LoginGuard
+func (s *MFAService) guarded(user *models.USERS, verify func(user *models.USERS) error) error {
+	if err := s.guard.ReserveSecondFactor(user.USERID); err != nil {
+		return err
+	}
+	if err := verify(user); err != nil {
+		if guardErr := s.guard.SecondFactorFailed(user); guardErr != nil {
+			return guardErr
+		}
+		return err
+	}
+	return s.guard.SecondFactorSucceeded(user.USERID)
+}
+
+func (s *MFAService) user(userID uint) (*models.USERS, error) {
+	user, err := s.userRepo.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCodes создаёт коды вида "abcde-fghij" и их хэши для хранения
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(recoveryEncoding.EncodeToString(b))[:10]
+		codes = append(codes, raw[:5]+"-"+raw[5:])
+		hashes = append(hashes, hashToken(raw))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/totp"
+	models "UserServiceAuth/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+type memoryMFARepository struct {
+	users *memoryUserRepository
+	codes map[uint]map[string]bool
+}
+
+func (r *memoryMFARepository) SetPendingTOTP(userID uint, secret string) error {
+	user, ok := r.users.users[userID]
+	if !ok || user.TOTPENABLED {
+		return gorm.ErrRecordNotFound
+	}
+	user.TOTPSECRET = secret
+	user.TOTPLASTSTEP = 0
+	return nil
+}
+
+func (r *memoryMFARepository) EnableTOTP(userID uint, step int64, codeHashes []string) error {
+	user, ok := r.users.users[userID]
+	if !ok || user.TOTPENABLED {
+		return gorm.ErrRecordNotFound
+	}
+	user.TOTPENABLED = true
+	user.TOTPLASTSTEP = step
+	r.codes[userID] = make(map[string]bool)
+	for _, hash := range codeHashes {
+		r.codes[userID][hash] = false
+	}
+	return nil
+}
+
+func (r *memoryMFARepository) DisableTOTP(userID uint) error {
+	user := r.users.users[userID]
+	user.TOTPSECRET = ""
+	user.TOTPENABLED = false
+	user.TOTPLASTSTEP = 0
+	delete(r.codes, userID)
+	return nil
+}
+
+func (r *memoryMFARepository) AdvanceTOTPStep(userID uint, step int64) (bool, error) {
+	user := r.users.users[userID]
+	if user.TOTPLASTSTEP >= step {
+		return false, nil
+	}
+	user.TOTPLASTSTEP = step
+	return true, nil
+}
+
+func (r *memoryMFARepository) UseRecoveryCode(userID uint, codeHash string) (bool, error) {
+	used, ok := r.codes[userID][codeHash]
+	if !ok || used {
+		return false, nil
+	}
+	r.codes[userID][codeHash] = true
+	return true, nil
+}
+
+func newTestMFAService(t *testing.T) (*MFAService, *TokenService, *models.USERS) {
+	tokens, tokenRepo, user := newTestTokenService(t)
+	users := tokens.userRepo.(*memoryUserRepository)
+	repo := &memoryMFARepository{users: users, codes: make(map[uint]map[string]bool)}
+
+	cfg := &config.Config{
+		JWT: config.JWTConfig{Issuer: "test-issuer", Audience: "test-audience"},
+		MFA: config.MFAConfig{Issuer: "UserServiceAuth", ChallengeTTL: time.Minute},
+	}
+	guard, _ := newTestLoginGuard(config.BruteForceConfig{
+		FreeAttempts:     3,
+		BaseDelay:        time.Minute,
+		MaxDelay:         time.Hour,
+		LockoutThreshold: 10,
+		LockoutDuration:  30 * time.Minute,
+		Window:           time.Hour,
+	})
+	return NewMFAService(repo, users, tokenRepo, guard, tokens.keys, cfg), tokens, user
+}
+
+// currentCode возвращает код для следующего ещё не использованного интервала
+func currentCode(t *testing.T, user *models.USERS) string {
+	step := totp.Step(time.Now())
+	if step <= user.TOTPLASTSTEP {
+		step = user.TOTPLASTSTEP + 1
+	}
+	code, err := totp.Code(user.TOTPSECRET, step)
+	require.NoError(t, err)
+	return code
+}
+
+func enableMFA(t *testing.T, s *MFAService, user *models.USERS) []string {
+	enrollment, err := s.BeginEnrollment(user.USERID)
+	require.NoError(t, err)
+	assert.Contains(t, enrollment.URI, "otpauth://totp/UserServiceAuth:johndoe?")
+
+	_, err = s.ConfirmEnrollment(user.USERID, "000000")
+	require.ErrorIs(t, err, ErrInvalidMFACode)
+
+	codes, err := s.ConfirmEnrollment(user.USERID, currentCode(t, user))
+	require.NoError(t, err)
+	require.Len(t, codes, recoveryCodeCount)
+	require.True(t, user.TOTPENABLED)
+	return codes
+}
+
+func TestMFA_EnrollAndLogin(t *testing.T) {
+	s, _, user := newTestMFAService(t)
+	enableMFA(t, s, user)
+
+	_, err := s.BeginEnrollment(user.USERID)
+	assert.ErrorIs(t, err, ErrMFAAlreadyEnabled)
+
+	challenge, err := s.Challenge(newUser(user))
+	require.NoError(t, err)
+
+	// Код из уже использованного при подтверждении интервала не подходит
+	used, err := totp.Code(user.TOTPSECRET, user.TOTPLASTSTEP)
+	require.NoError(t, err)
+	_, err = s.CompleteChallenge(challenge.Token, used)
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+
+	got, err := s.CompleteChallenge(challenge.Token, currentCode(t, user))
+	require.NoError(t, err)
+	assert.Equal(t, user.USERID, got.ID)
+
+	// Токен второго шага одноразовый
+	_, err = s.CompleteChallenge(challenge.Token, currentCode(t, user))
+	assert.ErrorIs(t, err, ErrInvalidMFAToken)
+}
+
+func TestMFA_RecoveryCodeIsSingleUse(t *testing.T) {
+	s, _, user := newTestMFAService(t)
+	codes := enableMFA(t, s, user)
+
+	challenge, err := s.Challenge(newUser(user))
+	require.NoError(t, err)
+	_, err = s.CompleteChallenge(challenge.Token, codes[0])
+	require.NoError(t, err)
+
+	challenge, err = s.Challenge(newUser(user))
+	require.NoError(t, err)
+	_, err = s.CompleteChallenge(challenge.Token, codes[0])
+	assert.ErrorIs(t, err, ErrInvalidMFACode)
+
+	// Регистр и дефис в коде восстановления не важны
+	_, err = s.CompleteChallenge(challenge.Token, " "+strings.ToUpper(strings.ReplaceAll(codes[1], "-", ""))+" ")
+	assert.NoError(t, err)
+}
+
+func TestMFA_ChallengeAttemptsLimitedPerUser(t *testing.T) {
+	s, _, user := newTestMFAService(t)
+	enableMFA(t, s, user)
+
+	// Первые попытки бесплатные и не зависят от того, сколько токенов второго шага получено
+	for i := 0; i < 4; i++ {
+		challenge, err := s.Challenge(newUser(user))
+		require.NoError(t, err)
+		_, err = s.CompleteChallenge(challenge.Token, "wrong-code")
+		assert.ErrorIs(t, err, ErrInvalidMFACode)
+	}
+
+	// Свежий токен не даёт обойти задержку, даже с верным кодом
+	challenge, err := s.Challenge(newUser(user))
+	require.NoError(t, err)
+	_, err = s.CompleteChallenge(challenge.Token, currentCode(t, user))
+	assert.InDelta(t, time.Minute, retryAfter(t, err), float64(2*time.Second))
+
+	// Проверка кода при отключении MFA учитывается в том же счётчике
+	assert.ErrorIs(t, s.Disable(user.USERID, "wrong-code"), ErrTooManyAttempts)
+}
+
+func TestMFA_Disable(t *testing.T) {
+	s, _, user := newTestMFAService(t)
+	codes := enableMFA(t, s, user)
+
+	assert.ErrorIs(t, s.Disable(user.USERID, "wrong-code"), ErrInvalidMFACode)
+	require.NoError(t, s.Disable(user.USERID, codes[0]))
+	assert.False(t, user.TOTPENABLED)
+	assert.Empty(t, user.TOTPSECRET)
+
+	assert.ErrorIs(t, s.Disable(user.USERID, codes[1]), ErrMFANotEnabled)
+}
+
+func TestIssueTokens_AdminRoleRequiresMFA(t *testing.T) {
+	s, _, user := newTestTokenService(t)
+	s.adminRequiresMFA = true
+	user.ROLE = models.RoleAdmin
+
+	pair, err := s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+	claims, err := s.ParseAccessToken(pair.Access.Token)
+	require.NoError(t, err)
+	assert.Equal(t, []string{models.RoleUser}, claims.Roles)
+	assert.Equal(t, []string{"pwd"}, claims.AMR)
+
+	pair, err = s.IssueMFATokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+	claims, err = s.ParseAccessToken(pair.Access.Token)
+	require.NoError(t, err)
+	assert.Equal(t, []string{models.RoleAdmin}, claims.Roles)
+	assert.Equal(t, []string{"pwd", "otp"}, claims.AMR)
+
+	// Обновлённый токен сохраняет второй фактор сессии
+	pair, err = s.Refresh(pair.RefreshToken, ClientInfo{})
+	require.NoError(t, err)
+	claims, err = s.ParseAccessToken(pair.Access.Token)
+	require.NoError(t, err)
+	assert.Equal(t, []string{models.RoleAdmin}, claims.Roles)
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/mailer"
+	models "UserServiceAuth/storage"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type IPasswordResetRepository interface {
+	CreatePasswordReset(reset *models.PASSWORDRESETS) error
+	ConsumePasswordReset(tokenHash string, now int64) (*models.PASSWORDRESETS, error)
+	DeletePasswordResetsByUserID(userID uint) error
+}
+
+type ISessionRevoker interface {
+	LogoutAll(userID uint) error
+}
+
+// PasswordResetService восстанавливает доступ по ссылке из письма
+type PasswordResetService struct {
+	resetRepo IPasswordResetRepository
+	userRepo  IUserRepository
+	hasher    IPasswordHasher
+	sessions  ISessionRevoker
+	mailer    IMailer
+	ttl       time.Duration
+	url       string
+}
+
+func NewPasswordResetService(resetRepo IPasswordResetRepository, userRepo IUserRepository, hasher IPasswordHasher, sessions ISessionRevoker, m IMailer, cfg *config.Config) *PasswordResetService {
+	return &PasswordResetService{
+		resetRepo: resetRepo,
+		userRepo:  userRepo,
+		hasher:    hasher,
+		sessions:  sessions,
+		mailer:    m,
+		ttl:       cfg.PasswordReset.TokenTTL,
+		url:       cfg.PasswordReset.URL,
+	}
+}
+
+// ForgotPassword отправляет письмо со ссылкой для смены пароля. Для неизвестного email
+// ничего не происходит и ошибка не возвращается, чтобы по ответу нельзя было перебирать адреса.
+// Действует только последняя выданная ссылка.
+func (s *PasswordResetService) ForgotPassword(email string) error {
+	user, err := s.userRepo.GetUserByEmail(email)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	secret, err := newRefreshSecret()
+	if err != nil {
+		return err
+	}
+	if err := s.resetRepo.DeletePasswordResetsByUserID(user.USERID); err != nil {
+		return err
+	}
+	err = s.resetRepo.CreatePasswordReset(&models.PASSWORDRESETS{
+		USERID:    user.USERID,
+		TOKENHASH: hashToken(secret),
+		EXP:       time.Now().Add(s.ttl).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(mailer.Message{
+		To:      user.EMAIL,
+		Subject: "Восстановление пароля",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+			"Чтобы задать новый пароль, перейдите по ссылке:\n%s\n\n"+
+			"Ссылка действует %s и может быть использована один раз. "+
+			"Если вы не запрашивали смену пароля, просто проигнорируйте это письмо.\n",
+			user.USERNAME, linkWithToken(s.url, secret), s.ttl),
+	})
+}
+
+// ResetPassword задаёт новый пароль по токену из письма и завершает все сессии пользователя
+func (s *PasswordResetService) ResetPassword(token, newPassword string) error {
+	reset, err := s.resetRepo.ConsumePasswordReset(hashToken(token), time.Now().Unix())
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidResetToken
+		}
+		return err
+	}
+
+	hash, err := s.hasher.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	if err := s.userRepo.UpdatePasswordByID(reset.USERID, hash); err != nil {
+		return err
+	}
+	if err := s.resetRepo.DeletePasswordResetsByUserID(reset.USERID); err != nil {
+		return err
+	}
+
+	// Пароль могли сбросить из-за утечки, поэтому все выданные токены перестают действовать
+	return s.sessions.LogoutAll(reset.USERID)
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/hasher"
+	"UserServiceAuth/internal/mailer"
+	models "UserServiceAuth/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+type memoryPasswordResetRepository struct {
+	resets map[string]*models.PASSWORDRESETS
+}
+
+func (r *memoryPasswordResetRepository) CreatePasswordReset(reset *models.PASSWORDRESETS) error {
+	stored := *reset
+	r.resets[reset.TOKENHASH] = &stored
+	return nil
+}
+
+func (r *memoryPasswordResetRepository) ConsumePasswordReset(tokenHash string, now int64) (*models.PASSWORDRESETS, error) {
+	reset, ok := r.resets[tokenHash]
+	if !ok || reset.USED || reset.EXP <= now {
+		return nil, gorm.ErrRecordNotFound
+	}
+	reset.USED = true
+	stored := *reset
+	return &stored, nil
+}
+
+func (r *memoryPasswordResetRepository) DeletePasswordResetsByUserID(userID uint) error {
+	for hash, reset := range r.resets {
+		if reset.USERID == userID {
+			delete(r.resets, hash)
+		}
+	}
+	return nil
+}
+
+type passwordResetFixture struct {
+	service *PasswordResetService
+	users   *memoryUserRepository
+	resets  *memoryPasswordResetRepository
+	tokens  *TokenService
+	mailer  *mailer.MemoryMailer
+}
+
+func newTestPasswordResetService(t *testing.T) *passwordResetFixture {
+	h, err := hasher.New(config.PasswordConfig{
+		Algorithm:     hasher.AlgArgon2id,
+		Argon2Time:    1,
+		Argon2Memory:  1024,
+		Argon2Threads: 1,
+	})
+	require.NoError(t, err)
+
+	tokens, _, user := newTestTokenService(t)
+	user.EMAIL = "john@example.com"
+	users := tokens.userRepo.(*memoryUserRepository)
+
+	f := &passwordResetFixture{
+		users:  users,
+		resets: &memoryPasswordResetRepository{resets: make(map[string]*models.PASSWORDRESETS)},
+		tokens: tokens,
+		mailer: mailer.NewMemoryMailer(),
+	}
+	cfg := &config.Config{PasswordReset: config.PasswordResetConfig{
+		TokenTTL: time.Hour,
+		URL:      "https://example.com/password/reset",
+	}}
+	f.service = NewPasswordResetService(f.resets, users, h, tokens, f.mailer, cfg)
+	return f
+}
+
+func (f *passwordResetFixture) sentToken(t *testing.T) string {
+	messages := f.mailer.Messages()
+	require.NotEmpty(t, messages)
+	body := messages[len(messages)-1].Body
+
+	start := strings.Index(body, "https://example.com/password/reset?")
+	require.GreaterOrEqual(t, start, 0)
+	link, _, _ := strings.Cut(body[start:], "\n")
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	return u.Query().Get("token")
+}
+
+func TestResetPassword(t *testing.T) {
+	f := newTestPasswordResetService(t)
+	user, _ := f.users.GetUserByID(1)
+	pair, err := f.tokens.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+
+	require.NoError(t, f.service.ForgotPassword("John@Example.com"))
+	token := f.sentToken(t)
+
+	// Хранится только хэш токена
+	for hash := range f.resets.resets {
+		assert.NotEqual(t, token, hash)
+	}
+
+	require.NoError(t, f.service.ResetPassword(token, "newPwd123"))
+	assert.Contains(t, user.PASSWORD, "$argon2id$")
+
+	// Все сессии завершены
+	_, err = f.tokens.Authenticate(pair.Access.Token)
+	assert.ErrorIs(t, err, ErrAccessTokenRevoked)
+	_, err = f.tokens.Refresh(pair.RefreshToken, ClientInfo{})
+	assert.Error(t, err)
+
+	// Токен одноразовый
+	assert.ErrorIs(t, f.service.ResetPassword(token, "otherPwd123"), ErrInvalidResetToken)
+}
+
+func TestForgotPassword_UnknownEmail(t *testing.T) {
+	f := newTestPasswordResetService(t)
+
+	require.NoError(t, f.service.ForgotPassword("nobody@example.com"))
+	assert.Empty(t, f.mailer.Messages())
+	assert.Empty(t, f.resets.resets)
+}
+
+func TestForgotPassword_OnlyLatestTokenWorks(t *testing.T) {
+	f := newTestPasswordResetService(t)
+
+	require.NoError(t, f.service.ForgotPassword("john@example.com"))
+	first := f.sentToken(t)
+	require.NoError(t, f.service.ForgotPassword("john@example.com"))
+	second := f.sentToken(t)
+
+	assert.ErrorIs(t, f.service.ResetPassword(first, "newPwd123"), ErrInvalidResetToken)
+	assert.NoError(t, f.service.ResetPassword(second, "newPwd123"))
+}
+
+func TestResetPassword_Expired(t *testing.T) {
+	f := newTestPasswordResetService(t)
+
+	require.NoError(t, f.service.ForgotPassword("john@example.com"))
+	token := f.sentToken(t)
+	for _, reset := range f.resets.resets {
+		reset.EXP = time.Now().Add(-time.Minute).Unix()
+	}
+
+	assert.ErrorIs(t, f.service.ResetPassword(token, "newPwd123"), ErrInvalidResetToken)
+}
@@ -3,6 +3,8 @@ package service
 import (
 	models "UserServiceAuth/storage"
 	"errors"
+	"sync"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -10,49 +12,294 @@ import (
 type IUserRepository interface {
 	CreateUser(user *models.USERS) error
 	GetUserByLogin(login string) (*models.USERS, error)
-	UpdateUserByID(id uint, updatedUser *models.USERS) error
+	GetUserByEmail(email string) (*models.USERS, error)
+	UpdateUserByID(id, version uint, updatedUser *models.USERS) error
 	GetUserByID(id uint) (*models.USERS, error)
+	UpdatePasswordByID(id uint, password string) error
+	PatchUserByID(id, version uint, patch models.UserPatch) error
+	UpdateRoleByID(id uint, role string) error
+	ListUsers(filter models.UserFilter) ([]models.USERS, int64, error)
+	DeleteUserByID(id uint) error
+	RestoreUserByID(id uint) error
+	PurgeDeletedUsers(before time.Time) (int64, error)
+	MarkEmailVerified(id uint, email string) error
+}
+
+type IPasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (ok bool, needsRehash bool, err error)
+}
+
+// ILoginGuard ограничивает перебор паролей
+type ILoginGuard interface {
+	Reserve(login, ip string) error
+	Failed(login, ip string, user *models.USERS) error
+	Succeeded(login, ip string) error
+	Unlock(user *models.USERS, adminID uint) error
 }
 
 type UserService struct {
 	userRepo IUserRepository
+	hasher   IPasswordHasher
+	guard    ILoginGuard
+
+	dummyOnce sync.Once
+	dummyHash string
+}
+
+func NewUserService(userRepo IUserRepository, hasher IPasswordHasher, guard ILoginGuard) *UserService {
+	return &UserService{
+		userRepo: userRepo,
+		hasher:   hasher,
+		guard:    guard,
+	}
+}
+
+func (s *UserService) RegisterUser(login, password string, profile Profile) (*User, error) {
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	user := &models.USERS{
+		LOGIN:    login,
+		PASSWORD: hash,
+		EMAIL:    profile.Email,
+		USERNAME: profile.Username,
+		SURNAME:  profile.Surname,
+		// Роль при регистрации не выбирается: администраторов назначает конфигурация
+		ROLE: models.RoleUser,
+	}
+
+	// Занятость login и email проверяет уникальный индекс, а не предварительное чтение:
+	// так два одновременных запроса не создадут дубликат
+	if err := conflictError(s.userRepo.CreateUser(user)); err != nil {
+		return nil, err
+	}
+	return newUser(user), nil
 }
 
-func NewUserService(userRepo IUserRepository) *UserService {
-	return &UserService{userRepo: userRepo}
+// conflictError переводит нарушение уникальности в ConflictError
+func conflictError(err error) error {
+	var violation *models.UniqueViolation
+	if errors.As(err, &violation) {
+		return &ConflictError{Field: violation.Field}
+	}
+	return err
 }
 
-func (s *UserService) RegisterUser(user *models.USERS) error {
-	existingUser, err := s.userRepo.GetUserByLogin(user.LOGIN)
-	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+// GrantAdmin назначает роль администратора пользователю с подтверждённым email.
+// Назначение идёт по ID, а не по логину: логин может занять кто угодно, пока он свободен.
+func (s *UserService) GrantAdmin(id uint) error {
+	user, err := s.userRepo.GetUserByID(id)
+	if err != nil {
 		return err
 	}
-	if existingUser != nil {
-		return errors.New("user with this login already exists")
+	if !user.EmailVerified() {
+		return ErrEmailNotVerified
 	}
-	return s.userRepo.CreateUser(user)
+	return s.userRepo.UpdateRoleByID(id, models.RoleAdmin)
 }
 
-func (s *UserService) AuthenticateUser(login, password string) (*models.USERS, error) {
+func (s *UserService) AuthenticateUser(login, password string, client ClientInfo) (*User, error) {
+	// Во время задержки или блокировки пароль не проверяется вовсе
+	if err := s.guard.Reserve(login, client.IP); err != nil {
+		return nil, err
+	}
+
 	user, err := s.userRepo.GetUserByLogin(login)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// Хэш всё равно считается, чтобы по времени ответа нельзя было узнать, существует ли логин
+			s.verifyDummy(password)
+			return nil, s.loginFailed(login, client, nil)
+		}
+		return nil, err
+	}
+
+	ok, needsRehash, err := s.hasher.Verify(password, user.PASSWORD)
 	if err != nil {
 		return nil, err
 	}
-	if user.PASSWORD != password {
-		return nil, errors.New("invalid login or password")
+	if !ok {
+		return nil, s.loginFailed(login, client, user)
 	}
-	return user, nil
+	if err := s.guard.Succeeded(login, client.IP); err != nil {
+		return nil, err
+	}
+
+	// Пароли в открытом виде и хэши с устаревшими параметрами пересчитываются при успешном входе
+	if needsRehash {
+		if hash, err := s.hasher.Hash(password); err == nil {
+			_ = s.userRepo.UpdatePasswordByID(user.USERID, hash)
+		}
+	}
+
+	return newUser(user), nil
 }
 
-func (s *UserService) UpdateUserByID(id uint, updatedUser *models.USERS) error {
-	existingID, err := s.userRepo.GetUserByID(id)
+func (s *UserService) loginFailed(login string, client ClientInfo, user *models.USERS) error {
+	if err := s.guard.Failed(login, client.IP, user); err != nil {
+		return err
+	}
+	return ErrInvalidCredentials
+}
 
-	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+// UnlockUser снимает блокировку входа, наложенную после неудачных попыток
+func (s *UserService) UnlockUser(id, adminID uint) error {
+	user, err := s.userRepo.GetUserByID(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
 		return err
 	}
-	if existingID == nil {
-		return errors.New("user with this id not exists")
+	return s.guard.Unlock(user, adminID)
+}
+
+// UpdateUserByID обновляет профиль и возвращает пользователя после изменения. emailChanged
+// означает, что адрес действительно сменился и его нужно подтвердить заново.
+func (s *UserService) UpdateUserByID(id, version uint, profile Profile) (user *User, emailChanged bool, err error) {
+	return s.updateUser(id, func() error {
+		return s.userRepo.UpdateUserByID(id, version, &models.USERS{
+			USERNAME: profile.Username,
+			SURNAME:  profile.Surname,
+			EMAIL:    profile.Email,
+		})
+	})
+}
+
+func (s *UserService) GetUserByID(id uint) (*User, error) {
+	user, err := s.user(id)
+	if err != nil {
+		return nil, err
 	}
+	return newUser(user), nil
+}
+
+func (s *UserService) ListUsers(filter models.UserFilter) ([]User, int64, error) {
+	rows, total, err := s.userRepo.ListUsers(filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	users := make([]User, 0, len(rows))
+	for i := range rows {
+		users = append(users, *newUser(&rows[i]))
+	}
+	return users, total, nil
+}
+
+func (s *UserService) DeleteUserByID(id uint) error {
+	if err := s.userRepo.DeleteUserByID(id); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *UserService) RestoreUserByID(id uint) error {
+	if err := s.userRepo.RestoreUserByID(id); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrDeletedUserNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// PurgeDeletedUsers окончательно удаляет пользователей, пролежавших удалёнными дольше retention
+func (s *UserService) PurgeDeletedUsers(retention time.Duration) (int64, error) {
+	return s.userRepo.PurgeDeletedUsers(time.Now().Add(-retention))
+}
+
+// PatchUserByID меняет только заданные поля. Результат такой же, как у UpdateUserByID.
+func (s *UserService) PatchUserByID(id, version uint, patch models.UserPatch) (user *User, emailChanged bool, err error) {
+	return s.updateUser(id, func() error {
+		return s.userRepo.PatchUserByID(id, version, patch)
+	})
+}
+
+// updateUser выполняет update и сравнивает email до и после. При проверке версии строку
+// между чтением и обновлением никто не меняет, иначе update вернёт ErrVersionConflict.
+func (s *UserService) updateUser(id uint, update func() error) (*User, bool, error) {
+	existing, err := s.user(id)
+	if err != nil {
+		return nil, false, err
+	}
+	previousEmail := existing.EMAIL
+
+	if err := update(); err != nil {
+		if errors.Is(err, models.ErrVersionConflict) {
+			return nil, false, ErrVersionConflict
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, ErrUserNotFound
+		}
+		return nil, false, conflictError(err)
+	}
+
+	user, err := s.user(id)
+	if err != nil {
+		return nil, false, err
+	}
+	return newUser(user), user.EMAIL != previousEmail, nil
+}
+
+// ChangePassword меняет пароль, только если текущий пароль указан верно. Проверка текущего
+// пароля защищена от перебора так же, как вход: украденный access-токен не должен давать
+// подбирать пароль без ограничений.
+func (s *UserService) ChangePassword(id uint, currentPassword, newPassword string, client ClientInfo) error {
+	if err := s.ConfirmPassword(id, currentPassword, client); err != nil {
+		return err
+	}
+
+	hash, err := s.hasher.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	return s.userRepo.UpdatePasswordByID(id, hash)
+}
+
+// ConfirmPassword проверяет текущий пароль пользователя перед изменением защиты аккаунта.
+// Неудачные попытки считаются в LoginGuard так же, как при входе.
+func (s *UserService) ConfirmPassword(id uint, password string, client ClientInfo) error {
+	user, err := s.user(id)
+	if err != nil {
+		return err
+	}
+
+	if err := s.guard.Reserve(user.LOGIN, client.IP); err != nil {
+		return err
+	}
+	ok, _, err := s.hasher.Verify(password, user.PASSWORD)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := s.guard.Failed(user.LOGIN, client.IP, user); err != nil {
+			return err
+		}
+		return ErrInvalidCurrentPassword
+	}
+	return s.guard.Succeeded(user.LOGIN, client.IP)
+}
+
+func (s *UserService) user(id uint) (*models.USERS, error) {
+	user, err := s.userRepo.GetUserByID(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return user, nil
+}
 
-	return s.userRepo.UpdateUserByID(id, updatedUser)
+// verifyDummy проверяет пароль по заранее посчитанному хэшу того же алгоритма
+func (s *UserService) verifyDummy(password string) {
+	s.dummyOnce.Do(func() {
+		s.dummyHash, _ = s.hasher.Hash("dummy password")
+	})
+	_, _, _ = s.hasher.Verify(password, s.dummyHash)
 }
@@ -0,0 +1,302 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/hasher"
+	models "UserServiceAuth/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestUserService(t *testing.T) (*UserService, *memoryUserRepository) {
+	h, err := hasher.New(config.PasswordConfig{
+		Algorithm:     hasher.AlgArgon2id,
+		Argon2Time:    1,
+		Argon2Memory:  1024,
+		Argon2Threads: 1,
+	})
+	require.NoError(t, err)
+
+	users := &memoryUserRepository{users: make(map[uint]*models.USERS)}
+	guard, _ := newTestLoginGuard(config.BruteForceConfig{
+		FreeAttempts:     100,
+		IPFreeAttempts:   100,
+		LockoutThreshold: 100,
+		Window:           time.Hour,
+	})
+	return NewUserService(users, h, guard), users
+}
+
+func registerTestUser(t *testing.T, s *UserService, login, password string, profile Profile) *User {
+	user, err := s.RegisterUser(login, password, profile)
+	require.NoError(t, err)
+	return user
+}
+
+func TestRegisterUser_HashesPassword(t *testing.T) {
+	s, users := newTestUserService(t)
+
+	registerTestUser(t, s, "johndoe", "securePwd123", Profile{})
+
+	stored, err := users.GetUserByLogin("johndoe")
+	require.NoError(t, err)
+	assert.NotEqual(t, "securePwd123", stored.PASSWORD)
+
+	user, err := s.AuthenticateUser("johndoe", "securePwd123", ClientInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, stored.USERID, user.ID)
+
+	_, err = s.AuthenticateUser("johndoe", "wrong", ClientInfo{})
+	assert.Error(t, err)
+}
+
+func TestAuthenticateUser_UpgradesPlaintextPassword(t *testing.T) {
+	s, users := newTestUserService(t)
+
+	// Строка, оставшаяся с тех времён, когда пароли хранились в открытом виде
+	require.NoError(t, users.CreateUser(&models.USERS{LOGIN: "legacy", PASSWORD: "plainPwd"}))
+
+	_, err := s.AuthenticateUser("legacy", "plainPwd", ClientInfo{})
+	require.NoError(t, err)
+
+	stored, err := users.GetUserByLogin("legacy")
+	require.NoError(t, err)
+	assert.Contains(t, stored.PASSWORD, "$argon2id$")
+
+	_, err = s.AuthenticateUser("legacy", "plainPwd", ClientInfo{})
+	assert.NoError(t, err)
+}
+
+func TestUpdateUserByID_KeepsPassword(t *testing.T) {
+	s, users := newTestUserService(t)
+	registerTestUser(t, s, "johndoe", "securePwd123", Profile{})
+
+	// Профиль обновляется без пароля: сменить его можно только с текущим паролем
+	_, _, err := s.UpdateUserByID(1, 1, Profile{Username: "John"})
+	require.NoError(t, err)
+
+	stored, err := users.GetUserByID(1)
+	require.NoError(t, err)
+	assert.Equal(t, "John", stored.USERNAME)
+
+	_, err = s.AuthenticateUser("johndoe", "newPwd123", ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = s.AuthenticateUser("johndoe", "securePwd123", ClientInfo{})
+	assert.NoError(t, err)
+}
+
+func TestRegisterUser_DuplicateFields(t *testing.T) {
+	s, _ := newTestUserService(t)
+	registerTestUser(t, s, "johndoe", "securePwd123", Profile{Email: "john@example.com"})
+
+	_, err := s.RegisterUser("johndoe", "securePwd123", Profile{Email: "other@example.com"})
+	var conflict *ConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, "login", conflict.Field)
+	assert.ErrorIs(t, err, ErrUserExists)
+
+	_, err = s.RegisterUser("janedoe", "securePwd123", Profile{Email: "john@example.com"})
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, "email", conflict.Field)
+}
+
+func TestRegisterUser_NormalizesIdentifiers(t *testing.T) {
+	s, _ := newTestUserService(t)
+	registerTestUser(t, s, " JohnDoe ", "securePwd123", Profile{Email: "John@Example.com"})
+
+	user, err := s.AuthenticateUser("johndoe", "securePwd123", ClientInfo{})
+	require.NoError(t, err)
+	assert.Equal(t, "johndoe", user.Login)
+	assert.Equal(t, "john@example.com", user.Email)
+
+	_, err = s.RegisterUser("other", "securePwd123", Profile{Email: "john@example.com"})
+	var conflict *ConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, "email", conflict.Field)
+}
+
+func TestPatchUserByID_DuplicateEmail(t *testing.T) {
+	s, _ := newTestUserService(t)
+	registerTestUser(t, s, "johndoe", "securePwd123", Profile{Email: "john@example.com"})
+	registerTestUser(t, s, "janedoe", "securePwd123", Profile{Email: "jane@example.com"})
+
+	email := "john@example.com"
+	_, _, err := s.PatchUserByID(2, 1, models.UserPatch{Email: &email})
+	var conflict *ConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, "email", conflict.Field)
+}
+
+func TestRegisterUser_AssignsUserRole(t *testing.T) {
+	s, users := newTestUserService(t)
+
+	user := registerTestUser(t, s, "johndoe", "securePwd123", Profile{Username: "John", Email: "john@example.com"})
+	assert.Equal(t, models.RoleUser, user.Role)
+	assert.Equal(t, "John", user.Username)
+	assert.False(t, user.EmailVerified)
+
+	stored, err := users.GetUserByLogin("johndoe")
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleUser, stored.ROLE)
+	assert.Equal(t, stored.USERID, user.ID)
+}
+
+func TestGrantAdmin(t *testing.T) {
+	s, users := newTestUserService(t)
+
+	registerTestUser(t, s, "root", "securePwd123", Profile{})
+	stored, err := users.GetUserByLogin("root")
+	require.NoError(t, err)
+
+	// Без подтверждённого email роль не выдаётся
+	assert.ErrorIs(t, s.GrantAdmin(stored.USERID), ErrEmailNotVerified)
+	assert.Equal(t, models.RoleUser, stored.ROLE)
+
+	verifiedAt := time.Now()
+	stored.EMAILVERIFIEDAT = &verifiedAt
+	require.NoError(t, s.GrantAdmin(stored.USERID))
+	assert.Equal(t, models.RoleAdmin, stored.ROLE)
+
+	assert.Error(t, s.GrantAdmin(stored.USERID+100))
+}
+
+func TestListUsers_Paginates(t *testing.T) {
+	s, _ := newTestUserService(t)
+
+	for _, login := range []string{"alice", "bob", "carol"} {
+		registerTestUser(t, s, login, "securePwd123", Profile{})
+	}
+
+	users, total, err := s.ListUsers(models.UserFilter{Limit: 2, Offset: 1})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), total)
+	if assert.Len(t, users, 2) {
+		assert.Equal(t, "bob", users[0].Login)
+		assert.Equal(t, "carol", users[1].Login)
+	}
+}
+
+func TestDeleteUserByID(t *testing.T) {
+	s, _ := newTestUserService(t)
+
+	registerTestUser(t, s, "johndoe", "securePwd123", Profile{})
+	user, err := s.GetUserByID(1)
+	require.NoError(t, err)
+
+	require.NoError(t, s.DeleteUserByID(user.ID))
+
+	_, err = s.GetUserByID(user.ID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	assert.ErrorIs(t, s.DeleteUserByID(user.ID), ErrUserNotFound)
+}
+
+func TestDeleteUserByID_RestoreAndPurge(t *testing.T) {
+	s, users := newTestUserService(t)
+
+	registerTestUser(t, s, "johndoe", "securePwd123", Profile{})
+	require.NoError(t, s.DeleteUserByID(1))
+
+	// Удалённый пользователь не может войти
+	_, err := s.AuthenticateUser("johndoe", "securePwd123", ClientInfo{})
+	assert.Error(t, err)
+
+	deleted, total, err := s.ListUsers(models.UserFilter{Deleted: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), total)
+	assert.NotNil(t, deleted[0].DeletedAt)
+
+	require.NoError(t, s.RestoreUserByID(1))
+	_, err = s.AuthenticateUser("johndoe", "securePwd123", ClientInfo{})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, s.RestoreUserByID(1), ErrDeletedUserNotFound)
+
+	// Пользователь, удалённый позже срока хранения, остаётся
+	require.NoError(t, s.DeleteUserByID(1))
+	purged, err := s.PurgeDeletedUsers(time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, purged)
+
+	users.deleted[1].DELETEDAT.Time = time.Now().Add(-2 * time.Hour)
+	purged, err = s.PurgeDeletedUsers(time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+	assert.Error(t, s.RestoreUserByID(1))
+}
+
+func TestPatchUserByID_OnlyGivenFields(t *testing.T) {
+	s, _ := newTestUserService(t)
+
+	registerTestUser(t, s, "johndoe", "securePwd123", Profile{Username: "John", Surname: "Doe"})
+
+	empty := ""
+	user, _, err := s.PatchUserByID(1, 1, models.UserPatch{Surname: &empty})
+	require.NoError(t, err)
+	assert.Equal(t, "John", user.Username)
+	assert.Empty(t, user.Surname)
+	assert.Equal(t, uint(2), user.Version)
+
+	_, _, err = s.PatchUserByID(2, 1, models.UserPatch{Surname: &empty})
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestPatchUserByID_ReportsEmailChange(t *testing.T) {
+	s, _ := newTestUserService(t)
+	registerTestUser(t, s, "johndoe", "securePwd123", Profile{Email: "john@example.com"})
+
+	// Тот же адрес в другом регистре - не смена email
+	same := "John@Example.com"
+	_, changed, err := s.PatchUserByID(1, 1, models.UserPatch{Email: &same})
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	other := "johnny@example.com"
+	user, changed, err := s.PatchUserByID(1, 2, models.UserPatch{Email: &other})
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "johnny@example.com", user.Email)
+}
+
+func TestChangePassword_RequiresCurrentPassword(t *testing.T) {
+	s, _ := newTestUserService(t)
+
+	registerTestUser(t, s, "johndoe", "securePwd123", Profile{})
+
+	assert.ErrorIs(t, s.ChangePassword(1, "wrong", "newPwd456", ClientInfo{}), ErrInvalidCurrentPassword)
+	require.NoError(t, s.ChangePassword(1, "securePwd123", "newPwd456", ClientInfo{}))
+
+	_, err := s.AuthenticateUser("johndoe", "securePwd123", ClientInfo{})
+	assert.Error(t, err)
+	_, err = s.AuthenticateUser("johndoe", "newPwd456", ClientInfo{})
+	assert.NoError(t, err)
+}
+
+func TestPatchUserByID_StaleVersion(t *testing.T) {
+	s, users := newTestUserService(t)
+
+	registerTestUser(t, s, "johndoe", "securePwd123", Profile{Username: "John"})
+
+	first, second := "Johnny", "Jack"
+	_, _, err := s.PatchUserByID(1, 1, models.UserPatch{Username: &first})
+	require.NoError(t, err)
+
+	// Второй администратор редактирует по устаревшей версии
+	_, _, err = s.PatchUserByID(1, 1, models.UserPatch{Username: &second})
+	assert.ErrorIs(t, err, ErrVersionConflict)
+	assert.Equal(t, "Johnny", users.users[1].USERNAME)
+}
+
+func TestAuthenticateUser_UnknownLogin(t *testing.T) {
+	s, _ := newTestUserService(t)
+
+	registerTestUser(t, s, "johndoe", "securePwd123", Profile{})
+
+	// Неизвестный логин и неверный пароль неразличимы для клиента
+	_, err := s.AuthenticateUser("unknown", "securePwd123", ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = s.AuthenticateUser("johndoe", "wrong", ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
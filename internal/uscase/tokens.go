@@ -0,0 +1,571 @@
+package service
+
+import (
+	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/keys"
+	models "UserServiceAuth/storage"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+type AccessClaims struct {
+	Login     string   `json:"login"`
+	Roles     []string `json:"roles"`
+	Scope     string   `json:"scope,omitempty"`
+	SessionID uint     `json:"sid"`
+	// Email не подтверждён, и политика restrict ограничивает доступ
+	Restricted bool `json:"restricted,omitempty"`
+	// Способы аутентификации по RFC 8176: pwd, otp, hwk, user
+	AMR []string `json:"amr,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// DefaultScope - права токена, выданного по логину и паролю
+const DefaultScope = "profile sessions"
+
+func (c *AccessClaims) UserID() (uint, error) {
+	id, err := strconv.ParseUint(c.Subject, 10, 32)
+	if err != nil {
+		return 0, ErrInvalidAccessToken
+	}
+	return uint(id), nil
+}
+
+func (c *AccessClaims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// ClientInfo - сведения об устройстве, с которого открыта сессия
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+type AccessToken struct {
+	Token     string
+	ID        string
+	ExpiresAt time.Time
+}
+
+type TokenPair struct {
+	Access           *AccessToken
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+}
+
+type ISigningKeys interface {
+	ActiveKey() *keys.Key
+	Key(id string) (*keys.Key, bool)
+	JWKS() (*keys.JWKS, error)
+}
+
+type ITokenRepository interface {
+	CreateToken(token *models.TOKENS) error
+	GetTokenByFamily(family string) (*models.TOKENS, error)
+	RotateToken(family, oldHash string, next *models.TOKENS) (bool, error)
+	RevokeFamily(family string) ([]models.TOKENS, error)
+	GetActiveTokensByUserID(userID uint, now int64) ([]models.TOKENS, error)
+	RevokeTokenByID(userID, id uint) ([]models.TOKENS, error)
+	RevokeTokensByUserID(userID uint) ([]models.TOKENS, error)
+	RevokeOtherTokensByUserID(userID, keepID uint) ([]models.TOKENS, error)
+	IsSessionActive(userID, id uint) (bool, error)
+	PurgeTokens(now, staleBefore int64) (int64, error)
+	CreateRevokedToken(token *models.REVOKEDTOKENS) error
+	IsTokenRevoked(jti string) (bool, error)
+	GetRevokedTokens(now int64) ([]models.REVOKEDTOKENS, error)
+	UseToken(token *models.USEDTOKENS) (bool, error)
+	IsTokenUsed(jti string) (bool, error)
+}
+
+type TokenService struct {
+	keys       ISigningKeys
+	tokenRepo  ITokenRepository
+	userRepo   IUserRepository
+	issuer     string
+	audience   string
+	ttl        time.Duration
+	refreshTTL time.Duration
+
+	unverifiedPolicy string
+	adminRequiresMFA bool
+}
+
+func NewTokenService(signingKeys ISigningKeys, tokenRepo ITokenRepository, userRepo IUserRepository, cfg *config.Config) *TokenService {
+	return &TokenService{
+		keys:       signingKeys,
+		tokenRepo:  tokenRepo,
+		userRepo:   userRepo,
+		issuer:     cfg.JWT.Issuer,
+		audience:   cfg.JWT.Audience,
+		ttl:        cfg.TokenTTL,
+		refreshTTL: cfg.RefreshTokenTTL,
+
+		unverifiedPolicy: cfg.Verification.UnverifiedPolicy,
+		adminRequiresMFA: cfg.MFA.RequireForAdmins,
+	}
+}
+
+// IssueTokens открывает новую сессию со своим семейством refresh-токенов и выдаёт первую пару токенов
+func (s *TokenService) IssueTokens(user *User, client ClientInfo) (*TokenPair, error) {
+	return s.issueTokens(user, client, []string{"pwd"}, false)
+}
+
+// IssueMFATokens открывает сессию после проверки второго фактора
+func (s *TokenService) IssueMFATokens(user *User, client ClientInfo) (*TokenPair, error) {
+	return s.issueTokens(user, client, []string{"pwd", "otp"}, true)
+}
+
+// IssueWebAuthnTokens открывает сессию после проверки ключа WebAuthn. Вход только по ключу
+// возможен лишь с проверкой пользователя и тоже считается многофакторным.
+func (s *TokenService) IssueWebAuthnTokens(user *User, client ClientInfo, passwordless bool) (*TokenPair, error) {
+	if passwordless {
+		return s.issueTokens(user, client, []string{"hwk", "user"}, true)
+	}
+	return s.issueTokens(user, client, []string{"pwd", "hwk"}, true)
+}
+
+func (s *TokenService) issueTokens(user *User, client ClientInfo, amr []string, mfa bool) (*TokenPair, error) {
+	if s.blocked(user) {
+		return nil, ErrEmailNotVerified
+	}
+
+	jti, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	family, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := newRefreshSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	refreshExpiresAt := now.Add(s.refreshTTL)
+	token := &models.TOKENS{
+		USERID:       user.ID,
+		FAMILY:       family,
+		ACCESSTOCKEN: jti,
+		REFRESHTOKEN: hashToken(secret),
+		USERAGENT:    client.UserAgent,
+		IP:           client.IP,
+		EXP:          refreshExpiresAt.Unix(),
+		LASTUSED:     now.Unix(),
+		MFA:          mfa,
+		AMR:          strings.Join(amr, " "),
+	}
+	if err := s.tokenRepo.CreateToken(token); err != nil {
+		return nil, err
+	}
+
+	access, err := s.issueAccessToken(user, token.IDTOKENS, jti, amr, mfa)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		Access:           access,
+		RefreshToken:     family + "." + secret,
+		RefreshExpiresAt: refreshExpiresAt,
+	}, nil
+}
+
+// Refresh обменивает refresh-токен на новую пару. Каждый refresh-токен одноразовый:
+// повторное предъявление уже обменянного токена отзывает всё семейство.
+func (s *TokenService) Refresh(refreshToken string, client ClientInfo) (*TokenPair, error) {
+	family, secret, ok := strings.Cut(refreshToken, ".")
+	if !ok || family == "" || secret == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	stored, err := s.tokenRepo.GetTokenByFamily(family)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+	if stored.REVOKED {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	oldHash := hashToken(secret)
+	if subtle.ConstantTimeCompare([]byte(oldHash), []byte(stored.REFRESHTOKEN)) != 1 {
+		if err := s.revokeFamily(family); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if time.Now().Unix() >= stored.EXP {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	row, err := s.userRepo.GetUserByID(stored.USERID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+	user := newUser(row)
+	if s.blocked(user) {
+		// Email сменили на неподтверждённый после входа
+		return nil, ErrEmailNotVerified
+	}
+
+	jti, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	newSecret, err := newRefreshSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	refreshExpiresAt := now.Add(s.refreshTTL)
+	rotated, err := s.tokenRepo.RotateToken(family, oldHash, &models.TOKENS{
+		ACCESSTOCKEN: jti,
+		REFRESHTOKEN: hashToken(newSecret),
+		USERAGENT:    client.UserAgent,
+		IP:           client.IP,
+		EXP:          refreshExpiresAt.Unix(),
+		LASTUSED:     now.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !rotated {
+		// Токен успели обменять параллельным запросом - считаем это повторным использованием
+		if err := s.revokeFamily(family); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	access, err := s.issueAccessToken(user, stored.IDTOKENS, jti, sessionAMR(stored), stored.MFA)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		Access:           access,
+		RefreshToken:     family + "." + newSecret,
+		RefreshExpiresAt: refreshExpiresAt,
+	}, nil
+}
+
+// ParseAccessToken проверяет подпись и стандартные поля access-токена
+func (s *TokenService) ParseAccessToken(token string) (*AccessClaims, error) {
+	claims := &AccessClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, s.verificationKey,
+		jwt.WithValidMethods([]string{keys.AlgRS256, keys.AlgES256, keys.AlgEdDSA}),
+		jwt.WithIssuer(s.issuer),
+		jwt.WithAudience(s.audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, ErrInvalidAccessToken
+	}
+	return claims, nil
+}
+
+// Authenticate проверяет access-токен, то, что он не был отозван, и то, что его сессия
+// ещё открыта. Иначе токены, выданные до последнего обновления, переживали бы выход.
+func (s *TokenService) Authenticate(token string) (*AccessClaims, error) {
+	claims, err := s.ParseAccessToken(token)
+	if err != nil {
+		return nil, err
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := s.tokenRepo.IsTokenRevoked(claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrAccessTokenRevoked
+	}
+
+	active, err := s.tokenRepo.IsSessionActive(userID, claims.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, ErrAccessTokenRevoked
+	}
+	return claims, nil
+}
+
+func (s *TokenService) Sessions(userID uint) ([]models.TOKENS, error) {
+	return s.tokenRepo.GetActiveTokensByUserID(userID, time.Now().Unix())
+}
+
+func (s *TokenService) RevokeSession(userID, sessionID uint) error {
+	revoked, err := s.tokenRepo.RevokeTokenByID(userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if len(revoked) == 0 {
+		return ErrSessionNotFound
+	}
+	return s.revokeAccessTokens(revoked)
+}
+
+// Logout завершает сессию, к которой относится access-токен, и отзывает сам токен
+func (s *TokenService) Logout(claims *AccessClaims) error {
+	userID, err := claims.UserID()
+	if err != nil {
+		return err
+	}
+
+	if err := s.RevokeSession(userID, claims.SessionID); err != nil && !errors.Is(err, ErrSessionNotFound) {
+		return err
+	}
+	return s.revokeAccessToken(claims.ID, claims.ExpiresAt.Time)
+}
+
+// LogoutAll завершает все сессии пользователя
+func (s *TokenService) LogoutAll(userID uint) error {
+	revoked, err := s.tokenRepo.RevokeTokensByUserID(userID)
+	if err != nil {
+		return err
+	}
+	return s.revokeAccessTokens(revoked)
+}
+
+// LogoutOthers завершает все сессии пользователя, кроме sessionID
+func (s *TokenService) LogoutOthers(userID, sessionID uint) error {
+	revoked, err := s.tokenRepo.RevokeOtherTokensByUserID(userID, sessionID)
+	if err != nil {
+		return err
+	}
+	return s.revokeAccessTokens(revoked)
+}
+
+// RevokeToken отзывает refresh- или access-токен по RFC 7009.
+// Неизвестные и уже недействительные токены молча игнорируются.
+func (s *TokenService) RevokeToken(token, tokenTypeHint string) error {
+	// Подсказка о типе токена влияет только на порядок проверки
+	if tokenTypeHint == "access_token" {
+		if claims, err := s.ParseAccessToken(token); err == nil {
+			return s.revokeAccessToken(claims.ID, claims.ExpiresAt.Time)
+		}
+		_, err := s.revokeRefreshToken(token)
+		return err
+	}
+
+	revoked, err := s.revokeRefreshToken(token)
+	if err != nil || revoked {
+		return err
+	}
+	if claims, err := s.ParseAccessToken(token); err == nil {
+		return s.revokeAccessToken(claims.ID, claims.ExpiresAt.Time)
+	}
+	return nil
+}
+
+func (s *TokenService) IsTokenRevoked(jti string) (bool, error) {
+	return s.tokenRepo.IsTokenRevoked(jti)
+}
+
+func (s *TokenService) RevokedTokens() ([]models.REVOKEDTOKENS, error) {
+	return s.tokenRepo.GetRevokedTokens(time.Now().Unix())
+}
+
+// PurgeExpired удаляет истёкшие записи об отозванных и использованных токенах и сессии, по которым
+// не действует уже ни один токен: ни refresh, ни выданный последним access-токен
+func (s *TokenService) PurgeExpired() (int64, error) {
+	now := time.Now()
+	return s.tokenRepo.PurgeTokens(now.Unix(), now.Add(-s.ttl).Unix())
+}
+
+func (s *TokenService) revokeRefreshToken(token string) (bool, error) {
+	family, secret, ok := strings.Cut(token, ".")
+	if !ok || family == "" || secret == "" {
+		return false, nil
+	}
+
+	stored, err := s.tokenRepo.GetTokenByFamily(family)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(stored.REFRESHTOKEN)) != 1 {
+		return false, nil
+	}
+
+	return true, s.revokeFamily(family)
+}
+
+func (s *TokenService) revokeFamily(family string) error {
+	revoked, err := s.tokenRepo.RevokeFamily(family)
+	if err != nil {
+		return err
+	}
+	return s.revokeAccessTokens(revoked)
+}
+
+// revokeAccessTokens отзывает последние access-токены отозванных сессий, чтобы о них узнали
+// сервисы, проверяющие токены сами. Более ранние токены сессии отклоняет Authenticate.
+// Точное время их истечения не хранится, поэтому берётся верхняя граница.
+func (s *TokenService) revokeAccessTokens(sessions []models.TOKENS) error {
+	for _, session := range sessions {
+		if session.ACCESSTOCKEN == "" {
+			continue
+		}
+		expiresAt := time.Unix(session.LASTUSED, 0).Add(s.ttl)
+		if err := s.revokeAccessToken(session.ACCESSTOCKEN, expiresAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *TokenService) revokeAccessToken(jti string, expiresAt time.Time) error {
+	if !time.Now().Before(expiresAt) {
+		return nil
+	}
+	return s.tokenRepo.CreateRevokedToken(&models.REVOKEDTOKENS{
+		JTI: jti,
+		EXP: expiresAt.Unix(),
+	})
+}
+
+func (s *TokenService) Issuer() string {
+	return s.issuer
+}
+
+func (s *TokenService) JWKS() (*keys.JWKS, error) {
+	return s.keys.JWKS()
+}
+
+func (s *TokenService) verificationKey(token *jwt.Token) (interface{}, error) {
+	return publicKey(s.keys, token)
+}
+
+// publicKey находит открытый ключ, которым подписан токен, по kid из заголовка
+func publicKey(signingKeys ISigningKeys, token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := signingKeys.Key(kid)
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, errors.New("signing method does not match key")
+	}
+	return key.Public(), nil
+}
+
+// sign подписывает claims активным ключом и указывает его kid в заголовке
+func sign(signingKeys ISigningKeys, claims jwt.Claims) (string, error) {
+	key := signingKeys.ActiveKey()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// blocked - политика block не пускает пользователя с неподтверждённым email
+func (s *TokenService) blocked(user *User) bool {
+	return s.unverifiedPolicy == UnverifiedBlock && !user.EmailVerified
+}
+
+func rolesOf(user *User) []string {
+	if user.Role == "" {
+		return []string{models.RoleUser}
+	}
+	return []string{user.Role}
+}
+
+// sessionRoles - роли, которые действуют в сессии. Если для администраторов обязателен
+// второй фактор, без него администратор получает права обычного пользователя.
+func (s *TokenService) sessionRoles(user *User, mfa bool) []string {
+	if user.Role == models.RoleAdmin && s.adminRequiresMFA && !mfa {
+		return []string{models.RoleUser}
+	}
+	return rolesOf(user)
+}
+
+// sessionAMR - способы аутентификации сессии. У сессий, открытых до появления
+// поля AMR, они восстанавливаются по флагу MFA.
+func sessionAMR(session *models.TOKENS) []string {
+	if amr := strings.Fields(session.AMR); len(amr) > 0 {
+		return amr
+	}
+	if session.MFA {
+		return []string{"pwd", "otp"}
+	}
+	return []string{"pwd"}
+}
+
+func (s *TokenService) issueAccessToken(user *User, sessionID uint, jti string, amr []string, mfa bool) (*AccessToken, error) {
+	now := time.Now()
+	expiresAt := now.Add(s.ttl)
+
+	claims := AccessClaims{
+		Login:      user.Login,
+		Roles:      s.sessionRoles(user, mfa),
+		AMR:        amr,
+		Scope:      DefaultScope,
+		SessionID:  sessionID,
+		Restricted: s.unverifiedPolicy == UnverifiedRestrict && !user.EmailVerified,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    s.issuer,
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			Audience:  jwt.ClaimStrings{s.audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	signed, err := sign(s.keys, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccessToken{
+		Token:     signed,
+		ID:        jti,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func newRefreshSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
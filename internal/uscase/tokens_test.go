@@ -0,0 +1,618 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/keys"
+	models "UserServiceAuth/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+type memoryTokenRepository struct {
+	tokens  map[string]*models.TOKENS
+	revoked map[string]models.REVOKEDTOKENS
+	used    map[string]models.USEDTOKENS
+}
+
+func newMemoryTokenRepository() *memoryTokenRepository {
+	return &memoryTokenRepository{
+		tokens:  make(map[string]*models.TOKENS),
+		revoked: make(map[string]models.REVOKEDTOKENS),
+		used:    make(map[string]models.USEDTOKENS),
+	}
+}
+
+func (r *memoryTokenRepository) CreateToken(token *models.TOKENS) error {
+	token.IDTOKENS = uint(len(r.tokens) + 1)
+	stored := *token
+	r.tokens[token.FAMILY] = &stored
+	return nil
+}
+
+func (r *memoryTokenRepository) GetTokenByFamily(family string) (*models.TOKENS, error) {
+	token, ok := r.tokens[family]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	stored := *token
+	return &stored, nil
+}
+
+func (r *memoryTokenRepository) RotateToken(family, oldHash string, next *models.TOKENS) (bool, error) {
+	token, ok := r.tokens[family]
+	if !ok || token.REFRESHTOKEN != oldHash || token.REVOKED {
+		return false, nil
+	}
+	token.REFRESHTOKEN = next.REFRESHTOKEN
+	token.ACCESSTOCKEN = next.ACCESSTOCKEN
+	token.USERAGENT = next.USERAGENT
+	token.IP = next.IP
+	token.EXP = next.EXP
+	token.LASTUSED = next.LASTUSED
+	return true, nil
+}
+
+func (r *memoryTokenRepository) GetActiveTokensByUserID(userID uint, now int64) ([]models.TOKENS, error) {
+	var tokens []models.TOKENS
+	for _, token := range r.tokens {
+		if token.USERID == userID && !token.REVOKED && token.EXP > now {
+			tokens = append(tokens, *token)
+		}
+	}
+	return tokens, nil
+}
+
+func (r *memoryTokenRepository) revokeWhere(match func(token *models.TOKENS) bool) []models.TOKENS {
+	var revoked []models.TOKENS
+	for _, token := range r.tokens {
+		if match(token) && !token.REVOKED {
+			token.REVOKED = true
+			revoked = append(revoked, *token)
+		}
+	}
+	return revoked
+}
+
+func (r *memoryTokenRepository) RevokeTokenByID(userID, id uint) ([]models.TOKENS, error) {
+	return r.revokeWhere(func(token *models.TOKENS) bool {
+		return token.IDTOKENS == id && token.USERID == userID
+	}), nil
+}
+
+func (r *memoryTokenRepository) RevokeTokensByUserID(userID uint) ([]models.TOKENS, error) {
+	return r.revokeWhere(func(token *models.TOKENS) bool {
+		return token.USERID == userID
+	}), nil
+}
+
+func (r *memoryTokenRepository) RevokeOtherTokensByUserID(userID, keepID uint) ([]models.TOKENS, error) {
+	return r.revokeWhere(func(token *models.TOKENS) bool {
+		return token.USERID == userID && token.IDTOKENS != keepID
+	}), nil
+}
+
+func (r *memoryTokenRepository) RevokeFamily(family string) ([]models.TOKENS, error) {
+	return r.revokeWhere(func(token *models.TOKENS) bool {
+		return token.FAMILY == family
+	}), nil
+}
+
+func (r *memoryTokenRepository) IsSessionActive(userID, id uint) (bool, error) {
+	for _, token := range r.tokens {
+		if token.IDTOKENS == id && token.USERID == userID && !token.REVOKED {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *memoryTokenRepository) PurgeTokens(now, staleBefore int64) (int64, error) {
+	var purged int64
+	for jti, token := range r.revoked {
+		if token.EXP <= now {
+			delete(r.revoked, jti)
+			purged++
+		}
+	}
+	for jti, token := range r.used {
+		if token.EXP <= now {
+			delete(r.used, jti)
+			purged++
+		}
+	}
+	for family, token := range r.tokens {
+		if (token.REVOKED || token.EXP <= now) && token.LASTUSED <= staleBefore {
+			delete(r.tokens, family)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (r *memoryTokenRepository) CreateRevokedToken(token *models.REVOKEDTOKENS) error {
+	r.revoked[token.JTI] = *token
+	return nil
+}
+
+func (r *memoryTokenRepository) IsTokenRevoked(jti string) (bool, error) {
+	_, ok := r.revoked[jti]
+	return ok, nil
+}
+
+func (r *memoryTokenRepository) UseToken(token *models.USEDTOKENS) (bool, error) {
+	if _, ok := r.used[token.JTI]; ok {
+		return false, nil
+	}
+	r.used[token.JTI] = *token
+	return true, nil
+}
+
+func (r *memoryTokenRepository) IsTokenUsed(jti string) (bool, error) {
+	_, ok := r.used[jti]
+	return ok, nil
+}
+
+func (r *memoryTokenRepository) GetRevokedTokens(now int64) ([]models.REVOKEDTOKENS, error) {
+	var tokens []models.REVOKEDTOKENS
+	for _, token := range r.revoked {
+		if token.EXP > now {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+type memoryUserRepository struct {
+	users   map[uint]*models.USERS
+	deleted map[uint]*models.USERS
+}
+
+func (r *memoryUserRepository) CreateUser(user *models.USERS) error {
+	user.LOGIN = models.NormalizeIdentifier(user.LOGIN)
+	user.EMAIL = models.NormalizeIdentifier(user.EMAIL)
+	if err := r.checkUnique(0, user.LOGIN, user.EMAIL); err != nil {
+		return err
+	}
+	user.USERID = uint(len(r.users) + len(r.deleted) + 1)
+	user.VERSION = 1
+	r.users[user.USERID] = user
+	return nil
+}
+
+func (r *memoryUserRepository) GetUserByLogin(login string) (*models.USERS, error) {
+	for _, user := range r.users {
+		if user.LOGIN == models.NormalizeIdentifier(login) {
+			return user, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *memoryUserRepository) GetUserByEmail(email string) (*models.USERS, error) {
+	for _, user := range r.users {
+		if user.EMAIL == models.NormalizeIdentifier(email) {
+			return user, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *memoryUserRepository) MarkEmailVerified(id uint, email string) error {
+	user, ok := r.users[id]
+	if !ok || user.EMAIL != models.NormalizeIdentifier(email) || user.EmailVerified() {
+		return gorm.ErrRecordNotFound
+	}
+	now := time.Now()
+	user.EMAILVERIFIEDAT = &now
+	user.VERSION++
+	return nil
+}
+
+func (r *memoryUserRepository) UpdateUserByID(id, version uint, updatedUser *models.USERS) error {
+	user, ok := r.users[id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	if version != 0 && user.VERSION != version {
+		return models.ErrVersionConflict
+	}
+	if updatedUser.USERNAME != "" {
+		user.USERNAME = updatedUser.USERNAME
+	}
+	if updatedUser.SURNAME != "" {
+		user.SURNAME = updatedUser.SURNAME
+	}
+	if updatedUser.EMAIL != "" {
+		user.EMAIL = models.NormalizeIdentifier(updatedUser.EMAIL)
+	}
+	user.VERSION++
+	return nil
+}
+
+func (r *memoryUserRepository) PatchUserByID(id, version uint, patch models.UserPatch) error {
+	user, ok := r.users[id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	if version != 0 && user.VERSION != version {
+		return models.ErrVersionConflict
+	}
+	user.VERSION++
+	if patch.Username != nil {
+		user.USERNAME = *patch.Username
+	}
+	if patch.Surname != nil {
+		user.SURNAME = *patch.Surname
+	}
+	if patch.Email != nil {
+		email := models.NormalizeIdentifier(*patch.Email)
+		if err := r.checkUnique(id, "", email); err != nil {
+			return err
+		}
+		if user.EMAIL != email {
+			user.EMAILVERIFIEDAT = nil
+		}
+		user.EMAIL = email
+	}
+	return nil
+}
+
+// checkUnique повторяет уникальные индексы login и email, включая удалённых пользователей
+func (r *memoryUserRepository) checkUnique(id uint, login, email string) error {
+	for _, set := range []map[uint]*models.USERS{r.users, r.deleted} {
+		for _, user := range set {
+			if user.USERID == id {
+				continue
+			}
+			if login != "" && user.LOGIN == login {
+				return &models.UniqueViolation{Field: "login"}
+			}
+			if email != "" && user.EMAIL == email {
+				return &models.UniqueViolation{Field: "email"}
+			}
+		}
+	}
+	return nil
+}
+
+func (r *memoryUserRepository) UpdatePasswordByID(id uint, password string) error {
+	r.users[id].PASSWORD = password
+	return nil
+}
+
+func (r *memoryUserRepository) UpdateRoleByID(id uint, role string) error {
+	user, err := r.GetUserByID(id)
+	if err != nil {
+		return err
+	}
+	user.ROLE = role
+	return nil
+}
+
+func (r *memoryUserRepository) ListUsers(filter models.UserFilter) ([]models.USERS, int64, error) {
+	var users []models.USERS
+	source := r.users
+	if filter.Deleted {
+		source = r.deleted
+	}
+	for id := uint(1); id <= uint(len(r.users)+len(r.deleted)); id++ {
+		if user, ok := source[id]; ok && strings.Contains(user.LOGIN, filter.Login) {
+			users = append(users, *user)
+		}
+	}
+	total := int64(len(users))
+	if filter.Offset < len(users) {
+		users = users[filter.Offset:]
+	} else {
+		users = nil
+	}
+	if filter.Limit > 0 && filter.Limit < len(users) {
+		users = users[:filter.Limit]
+	}
+	return users, total, nil
+}
+
+func (r *memoryUserRepository) DeleteUserByID(id uint) error {
+	user, ok := r.users[id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	if r.deleted == nil {
+		r.deleted = make(map[uint]*models.USERS)
+	}
+	user.DELETEDAT = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	r.deleted[id] = user
+	delete(r.users, id)
+	return nil
+}
+
+func (r *memoryUserRepository) RestoreUserByID(id uint) error {
+	user, ok := r.deleted[id]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	user.DELETEDAT = gorm.DeletedAt{}
+	r.users[id] = user
+	delete(r.deleted, id)
+	return nil
+}
+
+func (r *memoryUserRepository) PurgeDeletedUsers(before time.Time) (int64, error) {
+	var purged int64
+	for id, user := range r.deleted {
+		if user.DELETEDAT.Time.Before(before) {
+			delete(r.deleted, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (r *memoryUserRepository) GetUserByID(id uint) (*models.USERS, error) {
+	user, ok := r.users[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return user, nil
+}
+
+func newTestTokenService(t *testing.T) (*TokenService, *memoryTokenRepository, *models.USERS) {
+	keyManager, err := keys.NewManager(t.TempDir(), keys.AlgEdDSA, time.Hour, 0)
+	require.NoError(t, err)
+
+	user := &models.USERS{USERID: 1, LOGIN: "johndoe"}
+	users := &memoryUserRepository{users: map[uint]*models.USERS{1: user}}
+	tokens := newMemoryTokenRepository()
+
+	cfg := &config.Config{
+		TokenTTL:        time.Hour,
+		RefreshTokenTTL: 24 * time.Hour,
+		JWT:             config.JWTConfig{Issuer: "test-issuer", Audience: "test-audience"},
+	}
+	return NewTokenService(keyManager, tokens, users, cfg), tokens, user
+}
+
+func TestRefresh_RotatesRefreshToken(t *testing.T) {
+	s, _, user := newTestTokenService(t)
+
+	first, err := s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+
+	second, err := s.Refresh(first.RefreshToken, ClientInfo{})
+	require.NoError(t, err)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	assert.NotEqual(t, first.Access.ID, second.Access.ID)
+
+	third, err := s.Refresh(second.RefreshToken, ClientInfo{})
+	require.NoError(t, err)
+	assert.NotEmpty(t, third.RefreshToken)
+}
+
+func TestRefresh_ReuseRevokesFamily(t *testing.T) {
+	s, tokens, user := newTestTokenService(t)
+
+	first, err := s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+	second, err := s.Refresh(first.RefreshToken, ClientInfo{})
+	require.NoError(t, err)
+
+	// Повторное использование уже обменянного токена
+	_, err = s.Refresh(first.RefreshToken, ClientInfo{})
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+
+	// После этого не работает и последний выданный токен
+	_, err = s.Refresh(second.RefreshToken, ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	for _, token := range tokens.tokens {
+		assert.True(t, token.REVOKED)
+	}
+}
+
+func TestRefresh_InvalidToken(t *testing.T) {
+	s, _, _ := newTestTokenService(t)
+
+	_, err := s.Refresh("garbage", ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	_, err = s.Refresh("unknown.secret", ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
+
+func TestSessions_IndependentPerDevice(t *testing.T) {
+	s, _, user := newTestTokenService(t)
+
+	laptop, err := s.IssueTokens(newUser(user), ClientInfo{UserAgent: "laptop", IP: "10.0.0.1"})
+	require.NoError(t, err)
+	phone, err := s.IssueTokens(newUser(user), ClientInfo{UserAgent: "phone", IP: "10.0.0.2"})
+	require.NoError(t, err)
+
+	sessions, err := s.Sessions(user.USERID)
+	require.NoError(t, err)
+	assert.Len(t, sessions, 2)
+
+	phoneClaims, err := s.ParseAccessToken(phone.Access.Token)
+	require.NoError(t, err)
+	require.NoError(t, s.RevokeSession(user.USERID, phoneClaims.SessionID))
+
+	// Сессия на ноутбуке продолжает работать
+	_, err = s.Refresh(laptop.RefreshToken, ClientInfo{UserAgent: "laptop"})
+	assert.NoError(t, err)
+	_, err = s.Refresh(phone.RefreshToken, ClientInfo{UserAgent: "phone"})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	assert.ErrorIs(t, s.RevokeSession(user.USERID+1, phoneClaims.SessionID), ErrSessionNotFound)
+}
+
+func TestParseAccessToken(t *testing.T) {
+	s, _, user := newTestTokenService(t)
+
+	tokens, err := s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+
+	claims, err := s.ParseAccessToken(tokens.Access.Token)
+	require.NoError(t, err)
+	userID, err := claims.UserID()
+	require.NoError(t, err)
+	assert.Equal(t, user.USERID, userID)
+	assert.Equal(t, "johndoe", claims.Login)
+	assert.Equal(t, tokens.Access.ID, claims.ID)
+	assert.Equal(t, []string{models.RoleUser}, claims.Roles)
+
+	_, err = s.ParseAccessToken(tokens.Access.Token + "x")
+	assert.ErrorIs(t, err, ErrInvalidAccessToken)
+}
+
+func TestLogout_RevokesSessionAndAccessToken(t *testing.T) {
+	s, _, user := newTestTokenService(t)
+
+	tokens, err := s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+	claims, err := s.Authenticate(tokens.Access.Token)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Logout(claims))
+
+	_, err = s.Authenticate(tokens.Access.Token)
+	assert.ErrorIs(t, err, ErrAccessTokenRevoked)
+	_, err = s.Refresh(tokens.RefreshToken, ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	revoked, err := s.IsTokenRevoked(claims.ID)
+	require.NoError(t, err)
+	assert.True(t, revoked)
+}
+
+func TestLogout_RejectsTokensIssuedBeforeRefresh(t *testing.T) {
+	s, _, user := newTestTokenService(t)
+
+	first, err := s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+	second, err := s.Refresh(first.RefreshToken, ClientInfo{})
+	require.NoError(t, err)
+
+	claims, err := s.Authenticate(second.Access.Token)
+	require.NoError(t, err)
+	_, err = s.Authenticate(first.Access.Token)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Logout(claims))
+
+	// Токен до обновления не попал в список отозванных, но его сессия закрыта
+	_, err = s.Authenticate(first.Access.Token)
+	assert.ErrorIs(t, err, ErrAccessTokenRevoked)
+}
+
+func TestPurgeExpired(t *testing.T) {
+	s, tokens, user := newTestTokenService(t)
+
+	active, err := s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+	recent, err := s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+	stale, err := s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+	for _, pair := range []*TokenPair{recent, stale} {
+		require.NoError(t, s.RevokeToken(pair.RefreshToken, "refresh_token"))
+	}
+
+	// Последний access-токен сессии истёк, и запись об его отзыве больше не нужна
+	staleFamily, _, _ := strings.Cut(stale.RefreshToken, ".")
+	tokens.tokens[staleFamily].LASTUSED = time.Now().Add(-2 * time.Hour).Unix()
+	tokens.revoked["expired"] = models.REVOKEDTOKENS{JTI: "expired", EXP: time.Now().Add(-time.Minute).Unix()}
+
+	purged, err := s.PurgeExpired()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), purged)
+	assert.Len(t, tokens.tokens, 2)
+	assert.NotContains(t, tokens.tokens, staleFamily)
+	assert.NotContains(t, tokens.revoked, "expired")
+
+	_, err = s.Authenticate(active.Access.Token)
+	assert.NoError(t, err)
+	_, err = s.Authenticate(recent.Access.Token)
+	assert.ErrorIs(t, err, ErrAccessTokenRevoked)
+}
+
+func TestLogoutAll_RevokesEverySession(t *testing.T) {
+	s, _, user := newTestTokenService(t)
+
+	laptop, err := s.IssueTokens(newUser(user), ClientInfo{UserAgent: "laptop"})
+	require.NoError(t, err)
+	phone, err := s.IssueTokens(newUser(user), ClientInfo{UserAgent: "phone"})
+	require.NoError(t, err)
+
+	require.NoError(t, s.LogoutAll(user.USERID))
+
+	for _, pair := range []*TokenPair{laptop, phone} {
+		_, err = s.Authenticate(pair.Access.Token)
+		assert.ErrorIs(t, err, ErrAccessTokenRevoked)
+		_, err = s.Refresh(pair.RefreshToken, ClientInfo{})
+		assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+	}
+
+	revoked, err := s.RevokedTokens()
+	require.NoError(t, err)
+	assert.Len(t, revoked, 2)
+}
+
+func TestLogoutOthers_KeepsCurrentSession(t *testing.T) {
+	s, _, user := newTestTokenService(t)
+
+	current, err := s.IssueTokens(newUser(user), ClientInfo{UserAgent: "laptop"})
+	require.NoError(t, err)
+	other, err := s.IssueTokens(newUser(user), ClientInfo{UserAgent: "phone"})
+	require.NoError(t, err)
+	claims, err := s.Authenticate(current.Access.Token)
+	require.NoError(t, err)
+
+	require.NoError(t, s.LogoutOthers(user.USERID, claims.SessionID))
+
+	_, err = s.Authenticate(current.Access.Token)
+	assert.NoError(t, err)
+	_, err = s.Authenticate(other.Access.Token)
+	assert.ErrorIs(t, err, ErrAccessTokenRevoked)
+	_, err = s.Refresh(other.RefreshToken, ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+}
+
+func TestRevokeToken(t *testing.T) {
+	s, _, user := newTestTokenService(t)
+
+	tokens, err := s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+
+	// Неизвестный токен не считается ошибкой
+	assert.NoError(t, s.RevokeToken("unknown", ""))
+
+	require.NoError(t, s.RevokeToken(tokens.RefreshToken, "refresh_token"))
+	_, err = s.Refresh(tokens.RefreshToken, ClientInfo{})
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	other, err := s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+	require.NoError(t, s.RevokeToken(other.Access.Token, "access_token"))
+	_, err = s.Authenticate(other.Access.Token)
+	assert.ErrorIs(t, err, ErrAccessTokenRevoked)
+}
+
+func TestRefresh_PicksUpRoleChange(t *testing.T) {
+	s, _, user := newTestTokenService(t)
+
+	first, err := s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+
+	user.ROLE = models.RoleAdmin
+	second, err := s.Refresh(first.RefreshToken, ClientInfo{})
+	require.NoError(t, err)
+
+	claims, err := s.ParseAccessToken(second.Access.Token)
+	require.NoError(t, err)
+	assert.Equal(t, []string{models.RoleAdmin}, claims.Roles)
+}
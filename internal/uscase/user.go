@@ -0,0 +1,54 @@
+package service
+
+import (
+	models "UserServiceAuth/storage"
+	"time"
+)
+
+// User - пользователь, каким его видят сценарии и HTTP-слой. Модель хранения models.USERS
+// с хэшем пароля и секретом TOTP за пределы сервисов не выходит.
+type User struct {
+	ID       uint
+	Email    string
+	Login    string
+	Username string
+	Surname  string
+	Role     string
+	// Увеличивается при каждом изменении, отдаётся клиентам как ETag
+	Version       uint
+	EmailVerified bool
+	MFAEnabled    bool
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// nil, если пользователь не удалён
+	DeletedAt *time.Time
+}
+
+// Profile - поля профиля, которые пользователь задаёт сам
+type Profile struct {
+	Username string
+	Surname  string
+	Email    string
+}
+
+func newUser(user *models.USERS) *User {
+	u := &User{
+		ID:            user.USERID,
+		Email:         user.EMAIL,
+		Login:         user.LOGIN,
+		Username:      user.USERNAME,
+		Surname:       user.SURNAME,
+		Role:          user.ROLE,
+		Version:       user.VERSION,
+		EmailVerified: user.EmailVerified(),
+		MFAEnabled:    user.TOTPENABLED,
+		CreatedAt:     time.Unix(user.TIMECREATE, 0).UTC(),
+		UpdatedAt:     time.Unix(user.TIMEUPDATE, 0).UTC(),
+	}
+	if user.DELETEDAT.Valid {
+		deletedAt := user.DELETEDAT.Time.UTC()
+		u.DeletedAt = &deletedAt
+	}
+	return u
+}
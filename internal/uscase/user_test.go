@@ -0,0 +1,48 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	models "UserServiceAuth/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestNewUser(t *testing.T) {
+	verifiedAt := time.Now()
+	deletedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("MSK", 3*60*60))
+	user := newUser(&models.USERS{
+		USERID:          7,
+		LOGIN:           "johndoe",
+		EMAIL:           "john@example.com",
+		PASSWORD:        "$argon2id$v=19$m=65536,t=3,p=2$c2FsdA$a2V5",
+		ROLE:            models.RoleAdmin,
+		VERSION:         3,
+		TOTPENABLED:     true,
+		TOTPSECRET:      "secret",
+		EMAILVERIFIEDAT: &verifiedAt,
+		TIMECREATE:      1700000000,
+		TIMEUPDATE:      1700000600,
+		DELETEDAT:       gorm.DeletedAt{Time: deletedAt, Valid: true},
+	})
+
+	require.NotNil(t, user.DeletedAt)
+	assert.Equal(t, deletedAt.UTC(), *user.DeletedAt)
+	user.DeletedAt = nil
+	assert.Equal(t, &User{
+		ID:            7,
+		Email:         "john@example.com",
+		Login:         "johndoe",
+		Role:          models.RoleAdmin,
+		Version:       3,
+		EmailVerified: true,
+		MFAEnabled:    true,
+		CreatedAt:     time.Unix(1700000000, 0).UTC(),
+		UpdatedAt:     time.Unix(1700000600, 0).UTC(),
+	}, user)
+
+	assert.Nil(t, newUser(&models.USERS{USERID: 8}).DeletedAt)
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/keys"
+	"UserServiceAuth/internal/mailer"
+	models "UserServiceAuth/storage"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// Политики доступа для пользователей с неподтверждённым email
+const (
+	UnverifiedAllow    = "allow"
+	UnverifiedRestrict = "restrict"
+	UnverifiedBlock    = "block"
+)
+
+// Отдельная аудитория не даёт выдать токен подтверждения за access-токен и наоборот
+const verificationAudience = "email-verification"
+
+type verificationClaims struct {
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+type IMailer interface {
+	Send(msg mailer.Message) error
+}
+
+// VerificationService подтверждает владение email подписанными одноразовыми токенами
+type VerificationService struct {
+	keys      ISigningKeys
+	tokenRepo ITokenRepository
+	userRepo  IUserRepository
+	mailer    IMailer
+	issuer    string
+	ttl       time.Duration
+	url       string
+}
+
+func NewVerificationService(signingKeys ISigningKeys, tokenRepo ITokenRepository, userRepo IUserRepository, m IMailer, cfg *config.Config) (*VerificationService, error) {
+	switch cfg.Verification.UnverifiedPolicy {
+	case UnverifiedAllow, UnverifiedRestrict, UnverifiedBlock:
+	default:
+		return nil, fmt.Errorf("unsupported unverified email policy %q", cfg.Verification.UnverifiedPolicy)
+	}
+
+	return &VerificationService{
+		keys:      signingKeys,
+		tokenRepo: tokenRepo,
+		userRepo:  userRepo,
+		mailer:    m,
+		issuer:    cfg.JWT.Issuer,
+		ttl:       cfg.Verification.TokenTTL,
+		url:       cfg.Verification.URL,
+	}, nil
+}
+
+// SendVerification отправляет на текущий email пользователя письмо со ссылкой подтверждения
+func (s *VerificationService) SendVerification(user *User) error {
+	if user.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+
+	token, err := s.issueToken(user)
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Подтверждение адреса электронной почты",
+		Body: fmt.Sprintf("Здравствуйте, %s!\n\n"+
+			"Чтобы подтвердить адрес электронной почты, перейдите по ссылке:\n%s\n\n"+
+			"Ссылка действует %s. Если вы не регистрировались, просто проигнорируйте это письмо.\n",
+			user.Username, linkWithToken(s.url, token), s.ttl),
+	})
+}
+
+// ResendVerification повторно отправляет письмо. Неизвестные и уже подтверждённые адреса
+// молча пропускаются, чтобы по ответу нельзя было узнать, зарегистрирован ли email.
+func (s *VerificationService) ResendVerification(email string) error {
+	user, err := s.userRepo.GetUserByEmail(email)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if user.EmailVerified() {
+		return nil
+	}
+	return s.SendVerification(newUser(user))
+}
+
+// VerifyEmail подтверждает email по токену из письма. Токен принимается один раз и только
+// пока email пользователя не менялся.
+func (s *VerificationService) VerifyEmail(token string) error {
+	claims := &verificationClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		return publicKey(s.keys, t)
+	},
+		jwt.WithValidMethods([]string{keys.AlgRS256, keys.AlgES256, keys.AlgEdDSA}),
+		jwt.WithIssuer(s.issuer),
+		jwt.WithAudience(verificationAudience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return ErrInvalidVerificationToken
+	}
+	userID, err := strconv.ParseUint(claims.Subject, 10, 32)
+	if err != nil || claims.ID == "" {
+		return ErrInvalidVerificationToken
+	}
+
+	used, err := s.tokenRepo.IsTokenUsed(claims.ID)
+	if err != nil {
+		return err
+	}
+	if used {
+		return ErrInvalidVerificationToken
+	}
+
+	if err := s.userRepo.MarkEmailVerified(uint(userID), claims.Email); err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		user, err := s.userRepo.GetUserByID(uint(userID))
+		if err == nil && user.EmailVerified() && user.EMAIL == models.NormalizeIdentifier(claims.Email) {
+			return ErrEmailAlreadyVerified
+		}
+		return ErrInvalidVerificationToken
+	}
+
+	_, err = s.tokenRepo.UseToken(&models.USEDTOKENS{
+		JTI: claims.ID,
+		EXP: claims.ExpiresAt.Unix(),
+	})
+	return err
+}
+
+func (s *VerificationService) issueToken(user *User) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	return sign(s.keys, verificationClaims{
+		Email: user.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    s.issuer,
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			Audience:  jwt.ClaimStrings{verificationAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.ttl)),
+		},
+	})
+}
+
+// linkWithToken строит ссылку на страницу с токеном в параметре token.
+// Без настроенного адреса в письмо попадает сам токен.
+func linkWithToken(base, token string) string {
+	if base == "" {
+		return token
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return base + "?token=" + url.QueryEscape(token)
+	}
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/keys"
+	"UserServiceAuth/internal/mailer"
+	models "UserServiceAuth/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestVerificationService(t *testing.T) (*VerificationService, *memoryUserRepository, *mailer.MemoryMailer) {
+	keyManager, err := keys.NewManager(t.TempDir(), keys.AlgEdDSA, time.Hour, 0)
+	require.NoError(t, err)
+
+	users := &memoryUserRepository{users: make(map[uint]*models.USERS)}
+	require.NoError(t, users.CreateUser(&models.USERS{LOGIN: "johndoe", EMAIL: "john@example.com", USERNAME: "John"}))
+
+	m := mailer.NewMemoryMailer()
+	cfg := &config.Config{
+		JWT: config.JWTConfig{Issuer: "test-issuer", Audience: "test-audience"},
+		Verification: config.VerificationConfig{
+			TokenTTL:         time.Hour,
+			URL:              "https://example.com/verify-email",
+			UnverifiedPolicy: UnverifiedRestrict,
+		},
+	}
+	s, err := NewVerificationService(keyManager, newMemoryTokenRepository(), users, m, cfg)
+	require.NoError(t, err)
+	return s, users, m
+}
+
+// sentToken извлекает токен из ссылки в последнем письме
+func sentToken(t *testing.T, m *mailer.MemoryMailer) string {
+	messages := m.Messages()
+	require.NotEmpty(t, messages)
+	body := messages[len(messages)-1].Body
+
+	start := strings.Index(body, "https://example.com/verify-email?")
+	require.GreaterOrEqual(t, start, 0)
+	link, _, _ := strings.Cut(body[start:], "\n")
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	return u.Query().Get("token")
+}
+
+func TestVerifyEmail(t *testing.T) {
+	s, users, m := newTestVerificationService(t)
+	user, _ := users.GetUserByID(1)
+
+	require.NoError(t, s.SendVerification(newUser(user)))
+	require.Len(t, m.Messages(), 1)
+	assert.Equal(t, "john@example.com", m.Messages()[0].To)
+
+	token := sentToken(t, m)
+	require.NoError(t, s.VerifyEmail(token))
+
+	user, _ = users.GetUserByID(1)
+	assert.True(t, user.EmailVerified())
+
+	// Повторное предъявление токена отклоняется
+	assert.ErrorIs(t, s.VerifyEmail(token), ErrInvalidVerificationToken)
+	assert.ErrorIs(t, s.SendVerification(newUser(user)), ErrEmailAlreadyVerified)
+
+	// Использованный токен не попадает в публичный список отозванных
+	tokens := s.tokenRepo.(*memoryTokenRepository)
+	assert.Empty(t, tokens.revoked)
+	assert.Len(t, tokens.used, 1)
+}
+
+func TestVerifyEmail_EmailChanged(t *testing.T) {
+	s, users, m := newTestVerificationService(t)
+	user, _ := users.GetUserByID(1)
+	require.NoError(t, s.SendVerification(newUser(user)))
+
+	email := "new@example.com"
+	require.NoError(t, users.PatchUserByID(1, 0, models.UserPatch{Email: &email}))
+
+	assert.ErrorIs(t, s.VerifyEmail(sentToken(t, m)), ErrInvalidVerificationToken)
+	assert.ErrorIs(t, s.VerifyEmail("not-a-token"), ErrInvalidVerificationToken)
+}
+
+func TestResendVerification_DoesNotRevealUnknownEmail(t *testing.T) {
+	s, _, m := newTestVerificationService(t)
+
+	require.NoError(t, s.ResendVerification("nobody@example.com"))
+	assert.Empty(t, m.Messages())
+
+	require.NoError(t, s.ResendVerification("John@Example.com"))
+	assert.Len(t, m.Messages(), 1)
+}
+
+func TestNewVerificationService_UnknownPolicy(t *testing.T) {
+	cfg := &config.Config{Verification: config.VerificationConfig{UnverifiedPolicy: "sometimes"}}
+
+	_, err := NewVerificationService(nil, nil, nil, nil, cfg)
+	assert.Error(t, err)
+}
+
+func TestIssueTokens_UnverifiedPolicy(t *testing.T) {
+	s, _, user := newTestTokenService(t)
+
+	s.unverifiedPolicy = UnverifiedBlock
+	_, err := s.IssueTokens(newUser(user), ClientInfo{})
+	assert.ErrorIs(t, err, ErrEmailNotVerified)
+
+	s.unverifiedPolicy = UnverifiedRestrict
+	pair, err := s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+	claims, err := s.ParseAccessToken(pair.Access.Token)
+	require.NoError(t, err)
+	assert.True(t, claims.Restricted)
+
+	verifiedAt := time.Now()
+	user.EMAILVERIFIEDAT = &verifiedAt
+	pair, err = s.IssueTokens(newUser(user), ClientInfo{})
+	require.NoError(t, err)
+	claims, err = s.ParseAccessToken(pair.Access.Token)
+	require.NoError(t, err)
+	assert.False(t, claims.Restricted)
+}
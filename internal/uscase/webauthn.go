@@ -0,0 +1,425 @@
+package service
+
+import (
+	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/keys"
+	"UserServiceAuth/internal/webauthn"
+	models "UserServiceAuth/storage"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// Отдельные аудитории не дают использовать токен одной церемонии в другой
+const (
+	webAuthnRegistrationAudience = "webauthn-registration"
+	webAuthnLoginAudience        = "webauthn-login"
+	webAuthnConfirmAudience      = "webauthn-confirmation"
+
+	defaultCredentialName = "Ключ безопасности"
+)
+
+type IWebAuthnRepository interface {
+	CreateCredential(cred *models.WEBAUTHNCREDENTIALS) error
+	GetCredentialsByUserID(userID uint) ([]models.WEBAUTHNCREDENTIALS, error)
+	GetCredentialByCredentialID(credentialID string) (*models.WEBAUTHNCREDENTIALS, error)
+	CountCredentialsByUserID(userID uint) (int64, error)
+	UpdateSignCount(id uint, old, next uint32, lastUsed int64) (bool, error)
+	DeleteCredential(userID, id uint, keepLast bool) (bool, error)
+}
+
+// ceremonyClaims - токен церемонии WebAuthn. Вызов хранится в самом токене,
+// поэтому между началом и завершением церемонии сервису не нужно состояние.
+type ceremonyClaims struct {
+	Challenge string `json:"challenge"`
+	jwt.RegisteredClaims
+}
+
+// WebAuthnRegistration - параметры для navigator.credentials.create() и токен церемонии
+type WebAuthnRegistration struct {
+	Options *webauthn.CreationOptions
+	Token   string
+}
+
+// WebAuthnLogin - параметры для navigator.credentials.get() и токен церемонии
+type WebAuthnLogin struct {
+	Options *webauthn.RequestOptions
+	Token   string
+}
+
+// WebAuthnService регистрирует ключи WebAuthn (passkey) и проверяет вход по ним:
+// без пароля или вторым фактором после него
+type WebAuthnService struct {
+	credRepo  IWebAuthnRepository
+	userRepo  IUserRepository
+	tokenRepo ITokenRepository
+	keys      ISigningKeys
+	rp        *webauthn.RelyingParty
+	issuer    string
+	// Проверка пользователя для ключа как второго фактора
+	userVerification string
+	adminRequiresMFA bool
+}
+
+func NewWebAuthnService(credRepo IWebAuthnRepository, userRepo IUserRepository, tokenRepo ITokenRepository, signingKeys ISigningKeys, cfg *config.Config) (*WebAuthnService, error) {
+	switch cfg.WebAuthn.UserVerification {
+	case webauthn.UserVerificationRequired, webauthn.UserVerificationPreferred, webauthn.UserVerificationDiscouraged:
+	default:
+		return nil, fmt.Errorf("unsupported webauthn user verification %q", cfg.WebAuthn.UserVerification)
+	}
+	if cfg.WebAuthn.RPID == "" || len(cfg.WebAuthn.Origins) == 0 {
+		return nil, errors.New("webauthn rp id and origins are required")
+	}
+
+	return &WebAuthnService{
+		credRepo:  credRepo,
+		userRepo:  userRepo,
+		tokenRepo: tokenRepo,
+		keys:      signingKeys,
+		rp: &webauthn.RelyingParty{
+			ID:      cfg.WebAuthn.RPID,
+			Name:    cfg.WebAuthn.RPName,
+			Origins: cfg.WebAuthn.Origins,
+			Timeout: cfg.WebAuthn.Timeout,
+		},
+		issuer:           cfg.JWT.Issuer,
+		userVerification: cfg.WebAuthn.UserVerification,
+		adminRequiresMFA: cfg.MFA.RequireForAdmins,
+	}, nil
+}
+
+// BeginRegistration начинает регистрацию нового ключа для пользователя
+func (s *WebAuthnService) BeginRegistration(userID uint) (*WebAuthnRegistration, error) {
+	user, err := s.userRepo.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	exclude, err := s.credentialIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, token, err := s.newCeremony(webAuthnRegistrationAudience, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	options := s.rp.CreationOptions(challenge, webauthn.UserEntity{
+		ID:          userHandle(userID),
+		Name:        user.LOGIN,
+		DisplayName: user.USERNAME + " " + user.SURNAME,
+	}, exclude, s.userVerification)
+	return &WebAuthnRegistration{Options: options, Token: token}, nil
+}
+
+// FinishRegistration проверяет ответ аутентификатора и сохраняет новый ключ
+func (s *WebAuthnService) FinishRegistration(userID uint, token, name string, cred *webauthn.CredentialCreation) (*models.WEBAUTHNCREDENTIALS, error) {
+	challenge, subject, err := s.consumeCeremony(token, webAuthnRegistrationAudience)
+	if err != nil {
+		return nil, err
+	}
+	if subject != userID {
+		return nil, ErrInvalidWebAuthnCeremony
+	}
+
+	verified, err := s.rp.VerifyRegistration(challenge, cred, s.userVerification == webauthn.UserVerificationRequired)
+	if err != nil {
+		return nil, ErrInvalidWebAuthnAttestation
+	}
+
+	if name == "" {
+		name = defaultCredentialName
+	}
+	stored := &models.WEBAUTHNCREDENTIALS{
+		USERID:         userID,
+		CREDENTIALID:   webauthn.Base64URL(verified.ID).String(),
+		PUBLICKEY:      verified.PublicKey,
+		ALGORITHM:      verified.Algorithm,
+		SIGNCOUNT:      verified.SignCount,
+		AAGUID:         verified.AAGUID,
+		BACKUPELIGIBLE: verified.BackupEligible,
+		NAME:           name,
+	}
+	if err := s.credRepo.CreateCredential(stored); err != nil {
+		var violation *models.UniqueViolation
+		if errors.As(err, &violation) {
+			return nil, ErrCredentialExists
+		}
+		return nil, err
+	}
+	return stored, nil
+}
+
+// BeginLogin начинает вход по ключу. Для user == nil это вход без пароля: браузер
+// предложит любой ключ, сохранённый для сервиса. Иначе принимаются только ключи user.
+func (s *WebAuthnService) BeginLogin(user *User) (*WebAuthnLogin, error) {
+	var (
+		allow   [][]byte
+		subject uint
+	)
+	userVerification := webauthn.UserVerificationRequired
+	if user != nil {
+		ids, err := s.credentialIDs(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, ErrCredentialNotFound
+		}
+		allow, subject, userVerification = ids, user.ID, s.userVerification
+	}
+
+	challenge, token, err := s.newCeremony(webAuthnLoginAudience, subject)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnLogin{
+		Options: s.rp.RequestOptions(challenge, allow, userVerification),
+		Token:   token,
+	}, nil
+}
+
+// FinishLogin проверяет подпись ключа и возвращает его владельца. user должен совпадать
+// с тем, что передавался в BeginLogin.
+func (s *WebAuthnService) FinishLogin(token string, assertion *webauthn.CredentialAssertion, user *User) (*User, error) {
+	challenge, subject, err := s.consumeCeremony(token, webAuthnLoginAudience)
+	if err != nil {
+		return nil, err
+	}
+	passwordless := user == nil
+	if (passwordless && subject != 0) || (!passwordless && subject != user.ID) {
+		return nil, ErrInvalidWebAuthnCeremony
+	}
+
+	stored, err := s.credRepo.GetCredentialByCredentialID(assertion.ID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidWebAuthnAssertion
+		}
+		return nil, err
+	}
+	if !passwordless && stored.USERID != user.ID {
+		return nil, ErrInvalidWebAuthnAssertion
+	}
+	// Без пароля владелец определяется по ключу, и аутентификатор должен назвать того же пользователя
+	if passwordless && string(assertion.Response.UserHandle) != string(userHandle(stored.USERID)) {
+		return nil, ErrInvalidWebAuthnAssertion
+	}
+
+	requireUV := passwordless || s.userVerification == webauthn.UserVerificationRequired
+	if err := s.verifyAssertion(challenge, assertion, stored, requireUV); err != nil {
+		return nil, err
+	}
+
+	if !passwordless {
+		return user, nil
+	}
+	owner, err := s.userRepo.GetUserByID(stored.USERID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidWebAuthnAssertion
+		}
+		return nil, err
+	}
+	return newUser(owner), nil
+}
+
+func (s *WebAuthnService) Credentials(userID uint) ([]models.WEBAUTHNCREDENTIALS, error) {
+	return s.credRepo.GetCredentialsByUserID(userID)
+}
+
+// HasCredentials - есть ли у пользователя ключи. С ними вход по паролю требует второго фактора.
+func (s *WebAuthnService) HasCredentials(userID uint) (bool, error) {
+	count, err := s.credRepo.CountCredentialsByUserID(userID)
+	return count > 0, err
+}
+
+// BeginConfirmation начинает проверку ключом перед изменением защиты аккаунта
+func (s *WebAuthnService) BeginConfirmation(userID uint) (*WebAuthnLogin, error) {
+	ids, err := s.credentialIDs(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, ErrCredentialNotFound
+	}
+
+	challenge, token, err := s.newCeremony(webAuthnConfirmAudience, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnLogin{
+		Options: s.rp.RequestOptions(challenge, ids, s.userVerification),
+		Token:   token,
+	}, nil
+}
+
+// Confirm проверяет подпись одного из ключей пользователя по вызову из BeginConfirmation
+func (s *WebAuthnService) Confirm(userID uint, token string, assertion *webauthn.CredentialAssertion) error {
+	challenge, subject, err := s.consumeCeremony(token, webAuthnConfirmAudience)
+	if err != nil {
+		return err
+	}
+	if subject != userID {
+		return ErrInvalidWebAuthnCeremony
+	}
+
+	stored, err := s.credRepo.GetCredentialByCredentialID(assertion.ID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidWebAuthnAssertion
+		}
+		return err
+	}
+	if stored.USERID != userID {
+		return ErrInvalidWebAuthnAssertion
+	}
+	return s.verifyAssertion(challenge, assertion, stored, s.userVerification == webauthn.UserVerificationRequired)
+}
+
+// DeleteCredential удаляет ключ пользователя. Если администратору второй фактор обязателен
+// и TOTP не включён, последний ключ не удаляется: иначе администратор потерял бы свои права.
+func (s *WebAuthnService) DeleteCredential(userID, id uint) error {
+	user, err := s.userRepo.GetUserByID(userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	keepLast := s.adminRequiresMFA && user.ROLE == models.RoleAdmin && !user.TOTPENABLED
+
+	deleted, err := s.credRepo.DeleteCredential(userID, id, keepLast)
+	if err != nil {
+		if errors.Is(err, models.ErrLastCredential) {
+			return ErrLastSecondFactor
+		}
+		return err
+	}
+	if !deleted {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
+
+// verifyAssertion проверяет подпись ключа и сохраняет новый счётчик подписей
+func (s *WebAuthnService) verifyAssertion(challenge []byte, assertion *webauthn.CredentialAssertion, stored *models.WEBAUTHNCREDENTIALS, requireUV bool) error {
+	result, err := s.rp.VerifyAssertion(challenge, assertion, stored.PUBLICKEY, requireUV)
+	if err != nil {
+		return ErrInvalidWebAuthnAssertion
+	}
+
+	// Аутентификаторы без счётчика всегда присылают 0. Если счётчик есть, он должен расти.
+	if (result.SignCount != 0 || stored.SIGNCOUNT != 0) && result.SignCount <= stored.SIGNCOUNT {
+		return ErrInvalidWebAuthnAssertion
+	}
+	updated, err := s.credRepo.UpdateSignCount(stored.IDWEBAUTHNCREDENTIALS, stored.SIGNCOUNT, result.SignCount, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return ErrInvalidWebAuthnAssertion
+	}
+	return nil
+}
+
+func (s *WebAuthnService) credentialIDs(userID uint) ([][]byte, error) {
+	creds, err := s.credRepo.GetCredentialsByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([][]byte, 0, len(creds))
+	for _, cred := range creds {
+		id, err := base64.RawURLEncoding.DecodeString(cred.CREDENTIALID)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// newCeremony создаёт вызов и подписанный токен церемонии. subject 0 - пользователь ещё не известен.
+func (s *WebAuthnService) newCeremony(audience string, subject uint) ([]byte, string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, "", err
+	}
+	jti, err := newTokenID()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	claims := ceremonyClaims{
+		Challenge: webauthn.Base64URL(challenge).String(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    s.issuer,
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.rp.Timeout)),
+		},
+	}
+	if subject != 0 {
+		claims.Subject = strconv.FormatUint(uint64(subject), 10)
+	}
+
+	token, err := sign(s.keys, claims)
+	if err != nil {
+		return nil, "", err
+	}
+	return challenge, token, nil
+}
+
+// consumeCeremony проверяет токен церемонии и гасит его: каждый вызов принимается один раз
+func (s *WebAuthnService) consumeCeremony(token, audience string) ([]byte, uint, error) {
+	claims := &ceremonyClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		return publicKey(s.keys, t)
+	},
+		jwt.WithValidMethods([]string{keys.AlgRS256, keys.AlgES256, keys.AlgEdDSA}),
+		jwt.WithIssuer(s.issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || claims.ID == "" {
+		return nil, 0, ErrInvalidWebAuthnCeremony
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(claims.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return nil, 0, ErrInvalidWebAuthnCeremony
+	}
+	var subject uint64
+	if claims.Subject != "" {
+		if subject, err = strconv.ParseUint(claims.Subject, 10, 32); err != nil {
+			return nil, 0, ErrInvalidWebAuthnCeremony
+		}
+	}
+
+	fresh, err := s.tokenRepo.UseToken(&models.USEDTOKENS{
+		JTI: claims.ID,
+		EXP: claims.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if !fresh {
+		return nil, 0, ErrInvalidWebAuthnCeremony
+	}
+	return challenge, uint(subject), nil
+}
+
+// userHandle - идентификатор пользователя для аутентификатора. Логин и email в него не входят.
+func userHandle(userID uint) []byte {
+	return []byte(strconv.FormatUint(uint64(userID), 10))
+}
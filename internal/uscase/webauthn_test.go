@@ -0,0 +1,306 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"UserServiceAuth/internal/config"
+	"UserServiceAuth/internal/webauthn"
+	"UserServiceAuth/internal/webauthn/webauthntest"
+	models "UserServiceAuth/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+const testOrigin = "https://auth.example.com"
+
+type memoryWebAuthnRepository struct {
+	creds  map[uint]*models.WEBAUTHNCREDENTIALS
+	nextID uint
+}
+
+func (r *memoryWebAuthnRepository) CreateCredential(cred *models.WEBAUTHNCREDENTIALS) error {
+	for _, existing := range r.creds {
+		if existing.CREDENTIALID == cred.CREDENTIALID {
+			return &models.UniqueViolation{Field: "credential_id"}
+		}
+	}
+	r.nextID++
+	cred.IDWEBAUTHNCREDENTIALS = r.nextID
+	stored := *cred
+	r.creds[cred.IDWEBAUTHNCREDENTIALS] = &stored
+	return nil
+}
+
+func (r *memoryWebAuthnRepository) GetCredentialsByUserID(userID uint) ([]models.WEBAUTHNCREDENTIALS, error) {
+	var creds []models.WEBAUTHNCREDENTIALS
+	for _, cred := range r.creds {
+		if cred.USERID == userID {
+			creds = append(creds, *cred)
+		}
+	}
+	return creds, nil
+}
+
+func (r *memoryWebAuthnRepository) GetCredentialByCredentialID(credentialID string) (*models.WEBAUTHNCREDENTIALS, error) {
+	for _, cred := range r.creds {
+		if cred.CREDENTIALID == credentialID {
+			stored := *cred
+			return &stored, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *memoryWebAuthnRepository) CountCredentialsByUserID(userID uint) (int64, error) {
+	creds, _ := r.GetCredentialsByUserID(userID)
+	return int64(len(creds)), nil
+}
+
+func (r *memoryWebAuthnRepository) UpdateSignCount(id uint, old, next uint32, lastUsed int64) (bool, error) {
+	cred, ok := r.creds[id]
+	if !ok || cred.SIGNCOUNT != old {
+		return false, nil
+	}
+	cred.SIGNCOUNT = next
+	cred.LASTUSED = lastUsed
+	return true, nil
+}
+
+func (r *memoryWebAuthnRepository) DeleteCredential(userID, id uint, keepLast bool) (bool, error) {
+	cred, ok := r.creds[id]
+	if !ok || cred.USERID != userID {
+		return false, nil
+	}
+	if count, _ := r.CountCredentialsByUserID(userID); keepLast && count == 1 {
+		return false, models.ErrLastCredential
+	}
+	delete(r.creds, id)
+	return true, nil
+}
+
+func newTestWebAuthnService(t *testing.T) (*WebAuthnService, *MFAService, *TokenService, *models.USERS) {
+	mfa, tokens, user := newTestMFAService(t)
+	users := tokens.userRepo.(*memoryUserRepository)
+
+	cfg := &config.Config{
+		JWT: config.JWTConfig{Issuer: "test-issuer", Audience: "test-audience"},
+		WebAuthn: config.WebAuthnConfig{
+			RPID:             "auth.example.com",
+			RPName:           "UserServiceAuth",
+			Origins:          []string{testOrigin},
+			Timeout:          time.Minute,
+			UserVerification: webauthn.UserVerificationPreferred,
+		},
+		MFA: config.MFAConfig{RequireForAdmins: true},
+	}
+	repo := &memoryWebAuthnRepository{creds: make(map[uint]*models.WEBAUTHNCREDENTIALS)}
+	s, err := NewWebAuthnService(repo, users, mfa.tokenRepo, tokens.keys, cfg)
+	require.NoError(t, err)
+	return s, mfa, tokens, user
+}
+
+func registerKey(t *testing.T, s *WebAuthnService, user *models.USERS, authenticator *webauthntest.Authenticator) *models.WEBAUTHNCREDENTIALS {
+	registration, err := s.BeginRegistration(user.USERID)
+	require.NoError(t, err)
+	creation, err := authenticator.Create(registration.Options)
+	require.NoError(t, err)
+
+	cred, err := s.FinishRegistration(user.USERID, registration.Token, "", creation)
+	require.NoError(t, err)
+	return cred
+}
+
+func loginWithKey(t *testing.T, s *WebAuthnService, user *User, authenticator *webauthntest.Authenticator) (string, *webauthn.CredentialAssertion) {
+	login, err := s.BeginLogin(user)
+	require.NoError(t, err)
+	assertion, err := authenticator.Get(login.Options)
+	require.NoError(t, err)
+	return login.Token, assertion
+}
+
+func TestWebAuthn_RegisterAndPasswordlessLogin(t *testing.T) {
+	s, _, tokens, user := newTestWebAuthnService(t)
+	authenticator := webauthntest.New(testOrigin)
+
+	cred := registerKey(t, s, user, authenticator)
+	assert.Equal(t, defaultCredentialName, cred.NAME)
+	has, err := s.HasCredentials(user.USERID)
+	require.NoError(t, err)
+	assert.True(t, has)
+
+	token, assertion := loginWithKey(t, s, nil, authenticator)
+	got, err := s.FinishLogin(token, assertion, nil)
+	require.NoError(t, err)
+	assert.Equal(t, user.USERID, got.ID)
+
+	// Токен церемонии одноразовый
+	_, err = s.FinishLogin(token, assertion, nil)
+	assert.ErrorIs(t, err, ErrInvalidWebAuthnCeremony)
+
+	pair, err := tokens.IssueWebAuthnTokens(got, ClientInfo{}, true)
+	require.NoError(t, err)
+	claims, err := tokens.ParseAccessToken(pair.Access.Token)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hwk", "user"}, claims.AMR)
+
+	pair, err = tokens.Refresh(pair.RefreshToken, ClientInfo{})
+	require.NoError(t, err)
+	claims, err = tokens.ParseAccessToken(pair.Access.Token)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hwk", "user"}, claims.AMR)
+}
+
+func TestWebAuthn_RegistrationRejectsForeignResponses(t *testing.T) {
+	s, _, _, user := newTestWebAuthnService(t)
+
+	// Ответ, полученный на чужом сайте, не принимается
+	registration, err := s.BeginRegistration(user.USERID)
+	require.NoError(t, err)
+	creation, err := webauthntest.New("https://phishing.example.net").Create(registration.Options)
+	require.NoError(t, err)
+	_, err = s.FinishRegistration(user.USERID, registration.Token, "", creation)
+	assert.ErrorIs(t, err, ErrInvalidWebAuthnAttestation)
+
+	// Токен церемонии привязан к пользователю, который её начал
+	registration, err = s.BeginRegistration(user.USERID)
+	require.NoError(t, err)
+	creation, err = webauthntest.New(testOrigin).Create(registration.Options)
+	require.NoError(t, err)
+	_, err = s.FinishRegistration(user.USERID+1, registration.Token, "", creation)
+	assert.ErrorIs(t, err, ErrInvalidWebAuthnCeremony)
+}
+
+func TestWebAuthn_PasswordlessRequiresUserVerification(t *testing.T) {
+	s, mfa, _, user := newTestWebAuthnService(t)
+	authenticator := webauthntest.New(testOrigin)
+	authenticator.UserVerification = false
+	registerKey(t, s, user, authenticator)
+
+	token, assertion := loginWithKey(t, s, nil, authenticator)
+	_, err := s.FinishLogin(token, assertion, nil)
+	assert.ErrorIs(t, err, ErrInvalidWebAuthnAssertion)
+
+	// Как второй фактор ключ без проверки пользователя подходит при политике preferred
+	challenge, err := mfa.Challenge(newUser(user))
+	require.NoError(t, err)
+	pending, err := mfa.PendingUser(challenge.Token)
+	require.NoError(t, err)
+	token, assertion = loginWithKey(t, s, pending, authenticator)
+
+	got, err := mfa.CompleteChallengeWith(challenge.Token, func(u *User) error {
+		_, err := s.FinishLogin(token, assertion, u)
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, user.USERID, got.ID)
+
+	_, err = mfa.PendingUser(challenge.Token)
+	assert.ErrorIs(t, err, ErrInvalidMFAToken)
+}
+
+func TestWebAuthn_SecondFactorOnlyAcceptsOwnKeys(t *testing.T) {
+	s, _, _, user := newTestWebAuthnService(t)
+	users := s.userRepo.(*memoryUserRepository)
+	other := &models.USERS{USERID: 2, LOGIN: "janedoe"}
+	users.users[other.USERID] = other
+
+	authenticator := webauthntest.New(testOrigin)
+	registerKey(t, s, user, authenticator)
+
+	_, err := s.BeginLogin(newUser(other))
+	assert.ErrorIs(t, err, ErrCredentialNotFound)
+
+	otherAuthenticator := webauthntest.New(testOrigin)
+	registerKey(t, s, other, otherAuthenticator)
+
+	token, assertion := loginWithKey(t, s, newUser(other), otherAuthenticator)
+	_, err = s.FinishLogin(token, assertion, newUser(user))
+	assert.ErrorIs(t, err, ErrInvalidWebAuthnCeremony)
+
+	login, err := s.BeginLogin(newUser(user))
+	require.NoError(t, err)
+	login.Options.AllowCredentials = nil
+	assertion, err = otherAuthenticator.Get(login.Options)
+	require.NoError(t, err)
+	_, err = s.FinishLogin(login.Token, assertion, newUser(user))
+	assert.ErrorIs(t, err, ErrInvalidWebAuthnAssertion)
+}
+
+func TestWebAuthn_ClonedAuthenticatorRejected(t *testing.T) {
+	s, _, _, user := newTestWebAuthnService(t)
+	authenticator := webauthntest.New(testOrigin)
+	registerKey(t, s, user, authenticator)
+
+	token, assertion := loginWithKey(t, s, newUser(user), authenticator)
+	_, err := s.FinishLogin(token, assertion, newUser(user))
+	require.NoError(t, err)
+
+	// Копия ключа со старым значением счётчика
+	authenticator.SetSignCount(1)
+	token, assertion = loginWithKey(t, s, newUser(user), authenticator)
+	_, err = s.FinishLogin(token, assertion, newUser(user))
+	assert.ErrorIs(t, err, ErrInvalidWebAuthnAssertion)
+}
+
+func TestWebAuthn_ExcludeAndDelete(t *testing.T) {
+	s, _, _, user := newTestWebAuthnService(t)
+	authenticator := webauthntest.New(testOrigin)
+	cred := registerKey(t, s, user, authenticator)
+
+	registration, err := s.BeginRegistration(user.USERID)
+	require.NoError(t, err)
+	_, err = authenticator.Create(registration.Options)
+	assert.ErrorIs(t, err, webauthntest.ErrExcluded)
+
+	other := &models.USERS{USERID: user.USERID + 1, LOGIN: "janedoe"}
+	s.userRepo.(*memoryUserRepository).users[other.USERID] = other
+	assert.ErrorIs(t, s.DeleteCredential(other.USERID, cred.IDWEBAUTHNCREDENTIALS), ErrCredentialNotFound)
+	require.NoError(t, s.DeleteCredential(user.USERID, cred.IDWEBAUTHNCREDENTIALS))
+
+	has, err := s.HasCredentials(user.USERID)
+	require.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestWebAuthn_Confirm(t *testing.T) {
+	s, _, _, user := newTestWebAuthnService(t)
+	authenticator := webauthntest.New(testOrigin)
+	registerKey(t, s, user, authenticator)
+
+	confirmation, err := s.BeginConfirmation(user.USERID)
+	require.NoError(t, err)
+	assertion, err := authenticator.Get(confirmation.Options)
+	require.NoError(t, err)
+
+	// Токен подтверждения выдан другому пользователю
+	assert.ErrorIs(t, s.Confirm(user.USERID+1, confirmation.Token, assertion), ErrInvalidWebAuthnCeremony)
+
+	confirmation, err = s.BeginConfirmation(user.USERID)
+	require.NoError(t, err)
+	assertion, err = authenticator.Get(confirmation.Options)
+	require.NoError(t, err)
+	require.NoError(t, s.Confirm(user.USERID, confirmation.Token, assertion))
+	// Вызов принимается один раз
+	assert.ErrorIs(t, s.Confirm(user.USERID, confirmation.Token, assertion), ErrInvalidWebAuthnCeremony)
+
+	// Токен входа не подходит для подтверждения, и наоборот
+	token, assertion := loginWithKey(t, s, newUser(user), authenticator)
+	assert.ErrorIs(t, s.Confirm(user.USERID, token, assertion), ErrInvalidWebAuthnCeremony)
+}
+
+func TestWebAuthn_AdminKeepsLastSecondFactor(t *testing.T) {
+	s, mfa, _, user := newTestWebAuthnService(t)
+	user.ROLE = models.RoleAdmin
+	first := registerKey(t, s, user, webauthntest.New(testOrigin))
+	second := registerKey(t, s, user, webauthntest.New(testOrigin))
+
+	require.NoError(t, s.DeleteCredential(user.USERID, first.IDWEBAUTHNCREDENTIALS))
+	assert.ErrorIs(t, s.DeleteCredential(user.USERID, second.IDWEBAUTHNCREDENTIALS), ErrLastSecondFactor)
+
+	// С включённым TOTP у администратора остаётся второй фактор
+	enableMFA(t, mfa, user)
+	require.NoError(t, s.DeleteCredential(user.USERID, second.IDWEBAUTHNCREDENTIALS))
+}
@@ -0,0 +1,404 @@
+// Package webauthn связывает сервис с go-webauthn: строит параметры церемоний
+// регистрации и входа WebAuthn Level 2 и проверяет ответы аутентификатора.
+// Разбор CBOR и COSE, проверку подписей и заявлений об аттестации выполняет библиотека.
+//
+// Доверие к производителю аутентификатора не оценивается: сервис запрашивает
+// attestation "none", а у присланной всё же цепочки x5c проверяется только целостность.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+const (
+	challengeSize = 32
+
+	credentialType = "public-key"
+)
+
+// Алгоритмы COSE, которыми могут быть подписаны учётные данные
+const (
+	AlgES256 = int64(webauthncose.AlgES256)
+	AlgEdDSA = int64(webauthncose.AlgEdDSA)
+	AlgRS256 = int64(webauthncose.AlgRS256)
+)
+
+// SupportedAlgorithms - алгоритмы в порядке предпочтения для pubKeyCredParams
+var SupportedAlgorithms = []int64{AlgEdDSA, AlgES256, AlgRS256}
+
+// Значения userVerification в параметрах церемоний
+const (
+	UserVerificationRequired    = "required"
+	UserVerificationPreferred   = "preferred"
+	UserVerificationDiscouraged = "discouraged"
+)
+
+// ErrInvalidResponse - ответ аутентификатора не прошёл проверку. Подробности добавляются к ошибке.
+var ErrInvalidResponse = errors.New("invalid webauthn response")
+
+func invalid(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidResponse, reason)
+}
+
+// RelyingParty - сервис, для которого создаются учётные данные
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+	Timeout time.Duration
+}
+
+// NewChallenge создаёт случайный вызов для церемонии
+func NewChallenge() ([]byte, error) {
+	b := make([]byte, challengeSize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Base64URL - байты, которые в JSON передаются строкой base64url.
+// При разборе допускается выравнивание знаками "=".
+type Base64URL []byte
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+func (b Base64URL) String() string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Параметры navigator.credentials.create() и navigator.credentials.get()
+
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          Base64URL `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type string    `json:"type"`
+	ID   Base64URL `json:"id"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey,omitempty"`
+	UserVerification string `json:"userVerification,omitempty"`
+}
+
+type CreationOptions struct {
+	RP                     RelyingPartyEntity     `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Challenge              Base64URL              `json:"challenge"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout,omitempty"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+type RequestOptions struct {
+	Challenge        Base64URL              `json:"challenge"`
+	Timeout          int64                  `json:"timeout,omitempty"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CreationOptions строит параметры регистрации. Уже зарегистрированные учётные данные
+// передаются в exclude, чтобы аутентификатор не создавал вторые для того же пользователя.
+func (rp *RelyingParty) CreationOptions(challenge []byte, user UserEntity, exclude [][]byte, userVerification string) *CreationOptions {
+	params := make([]CredentialParameter, 0, len(SupportedAlgorithms))
+	for _, alg := range SupportedAlgorithms {
+		params = append(params, CredentialParameter{Type: credentialType, Alg: alg})
+	}
+
+	return &CreationOptions{
+		RP:                 RelyingPartyEntity{ID: rp.ID, Name: rp.Name},
+		User:               user,
+		Challenge:          challenge,
+		PubKeyCredParams:   params,
+		Timeout:            rp.Timeout.Milliseconds(),
+		ExcludeCredentials: descriptors(exclude),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: userVerification,
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions строит параметры входа. Пустой allow - вход без логина
+// по учётным данным, сохранённым в аутентификаторе (passkey).
+func (rp *RelyingParty) RequestOptions(challenge []byte, allow [][]byte, userVerification string) *RequestOptions {
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          rp.Timeout.Milliseconds(),
+		RPID:             rp.ID,
+		AllowCredentials: descriptors(allow),
+		UserVerification: userVerification,
+	}
+}
+
+func descriptors(ids [][]byte) []CredentialDescriptor {
+	list := make([]CredentialDescriptor, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, CredentialDescriptor{Type: credentialType, ID: id})
+	}
+	return list
+}
+
+// Ответы аутентификатора в том виде, в каком их отдаёт PublicKeyCredential.toJSON()
+
+type AttestationResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON" validate:"required"`
+	AttestationObject Base64URL `json:"attestationObject" validate:"required"`
+}
+
+type CredentialCreation struct {
+	ID       string              `json:"id" validate:"required"`
+	RawID    Base64URL           `json:"rawId" validate:"required"`
+	Type     string              `json:"type" validate:"required"`
+	Response AttestationResponse `json:"response"`
+}
+
+type AssertionResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON" validate:"required"`
+	AuthenticatorData Base64URL `json:"authenticatorData" validate:"required"`
+	Signature         Base64URL `json:"signature" validate:"required"`
+	UserHandle        Base64URL `json:"userHandle,omitempty"`
+}
+
+type CredentialAssertion struct {
+	ID       string            `json:"id" validate:"required"`
+	RawID    Base64URL         `json:"rawId" validate:"required"`
+	Type     string            `json:"type" validate:"required"`
+	Response AssertionResponse `json:"response"`
+}
+
+// Credential - проверенные учётные данные из церемонии регистрации
+type Credential struct {
+	ID             []byte
+	PublicKey      []byte
+	Algorithm      int64
+	SignCount      uint32
+	AAGUID         []byte
+	UserVerified   bool
+	BackupEligible bool
+}
+
+// Assertion - результат проверенной церемонии входа
+type Assertion struct {
+	SignCount    uint32
+	UserVerified bool
+	BackedUp     bool
+}
+
+// VerifyRegistration проверяет ответ navigator.credentials.create() (WebAuthn §7.1)
+func (rp *RelyingParty) VerifyRegistration(challenge []byte, cred *CredentialCreation, requireUV bool) (*Credential, error) {
+	if err := checkCredentialID(cred.ID, cred.RawID, cred.Type); err != nil {
+		return nil, err
+	}
+	if err := checkCrossOrigin(cred.Response.ClientDataJSON); err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.CredentialCreationResponse{
+		PublicKeyCredential: publicKeyCredential(cred.ID, cred.RawID, cred.Type),
+		AttestationResponse: protocol.AuthenticatorAttestationResponse{
+			AuthenticatorResponse: protocol.AuthenticatorResponse{ClientDataJSON: protocol.URLEncodedBase64(cred.Response.ClientDataJSON)},
+			AttestationObject:     protocol.URLEncodedBase64(cred.Response.AttestationObject),
+		},
+	}.Parse()
+	if err != nil {
+		return nil, rejected(err)
+	}
+	if err := parsed.Verify(Base64URL(challenge).String(), requireUV, rp.ID, rp.Origins); err != nil {
+		return nil, rejected(err)
+	}
+
+	attestation := parsed.Response.AttestationObject
+	authData := attestation.AuthData
+	if !bytes.Equal(authData.AttData.CredentialID, cred.RawID) {
+		return nil, invalid("credential id does not match authenticator data")
+	}
+	if chain, ok := attestation.AttStatement["x5c"]; ok {
+		if err := verifyCertificateChain(chain); err != nil {
+			return nil, err
+		}
+	}
+
+	alg, err := publicKeyAlgorithm(authData.AttData.CredentialPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:             authData.AttData.CredentialID,
+		PublicKey:      authData.AttData.CredentialPublicKey,
+		Algorithm:      alg,
+		SignCount:      authData.Counter,
+		AAGUID:         authData.AttData.AAGUID,
+		UserVerified:   authData.Flags.HasUserVerified(),
+		BackupEligible: authData.Flags.HasBackupEligible(),
+	}, nil
+}
+
+// VerifyAssertion проверяет ответ navigator.credentials.get() открытым ключом
+// зарегистрированных учётных данных (WebAuthn §7.2). Счётчик подписей сверяет вызывающий.
+func (rp *RelyingParty) VerifyAssertion(challenge []byte, cred *CredentialAssertion, publicKey []byte, requireUV bool) (*Assertion, error) {
+	if err := checkCredentialID(cred.ID, cred.RawID, cred.Type); err != nil {
+		return nil, err
+	}
+	if err := checkCrossOrigin(cred.Response.ClientDataJSON); err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.CredentialAssertionResponse{
+		PublicKeyCredential: publicKeyCredential(cred.ID, cred.RawID, cred.Type),
+		AssertionResponse: protocol.AuthenticatorAssertionResponse{
+			AuthenticatorResponse: protocol.AuthenticatorResponse{ClientDataJSON: protocol.URLEncodedBase64(cred.Response.ClientDataJSON)},
+			AuthenticatorData:     protocol.URLEncodedBase64(cred.Response.AuthenticatorData),
+			Signature:             protocol.URLEncodedBase64(cred.Response.Signature),
+			UserHandle:            protocol.URLEncodedBase64(cred.Response.UserHandle),
+		},
+	}.Parse()
+	if err != nil {
+		return nil, rejected(err)
+	}
+	if err := parsed.Verify(Base64URL(challenge).String(), rp.ID, rp.Origins, "", requireUV, publicKey); err != nil {
+		return nil, rejected(err)
+	}
+
+	flags := parsed.Response.AuthenticatorData.Flags
+	return &Assertion{
+		SignCount:    parsed.Response.AuthenticatorData.Counter,
+		UserVerified: flags.HasUserVerified(),
+		BackedUp:     flags.HasBackupState(),
+	}, nil
+}
+
+func publicKeyCredential(id string, rawID []byte, typ string) protocol.PublicKeyCredential {
+	return protocol.PublicKeyCredential{
+		Credential: protocol.Credential{ID: id, Type: typ},
+		RawID:      protocol.URLEncodedBase64(rawID),
+	}
+}
+
+// rejected переводит ошибку библиотеки в ErrInvalidResponse
+func rejected(err error) error {
+	var problem *protocol.Error
+	if errors.As(err, &problem) {
+		reason := problem.Details
+		if problem.DevInfo != "" {
+			reason += ": " + strings.TrimSpace(problem.DevInfo)
+		}
+		return invalid(reason)
+	}
+	return invalid(err.Error())
+}
+
+func checkCredentialID(id string, rawID []byte, typ string) error {
+	if typ != credentialType {
+		return invalid("unsupported credential type")
+	}
+	if len(rawID) == 0 || id != Base64URL(rawID).String() {
+		return invalid("credential id does not match raw id")
+	}
+	return nil
+}
+
+// checkCrossOrigin отклоняет церемонии из чужого iframe. go-webauthn не читает поле crossOrigin.
+func checkCrossOrigin(clientDataJSON []byte) error {
+	var data struct {
+		CrossOrigin bool `json:"crossOrigin"`
+	}
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return invalid("malformed client data")
+	}
+	if data.CrossOrigin {
+		return invalid("cross-origin ceremonies are not allowed")
+	}
+	return nil
+}
+
+// verifyCertificateChain проверяет, что каждый сертификат x5c подписан следующим за ним.
+// Подпись аттестации и требования к первому сертификату проверяет библиотека, а корень
+// цепочки не сверяется с доверенными: сервис не делает выводов из аттестации.
+func verifyCertificateChain(value interface{}) error {
+	chain, ok := value.([]interface{})
+	if !ok || len(chain) == 0 {
+		return invalid("malformed attestation certificate chain")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(chain))
+	for _, item := range chain {
+		der, ok := item.([]byte)
+		if !ok {
+			return invalid("malformed attestation certificate chain")
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return invalid("malformed attestation certificate")
+		}
+		certs = append(certs, cert)
+	}
+	for i := 0; i+1 < len(certs); i++ {
+		if err := certs[i].CheckSignatureFrom(certs[i+1]); err != nil {
+			return invalid("attestation certificate chain is broken")
+		}
+	}
+	return nil
+}
+
+// publicKeyAlgorithm разбирает ключ COSE и возвращает его алгоритм, если сервис его поддерживает
+func publicKeyAlgorithm(coseKey []byte) (int64, error) {
+	if _, err := webauthncose.ParsePublicKey(coseKey); err != nil {
+		return 0, invalid("malformed credential public key")
+	}
+	var key webauthncose.PublicKeyData
+	if err := webauthncbor.Unmarshal(coseKey, &key); err != nil {
+		return 0, invalid("malformed credential public key")
+	}
+	if !slices.Contains(SupportedAlgorithms, key.Algorithm) {
+		return 0, invalid("unsupported public key algorithm")
+	}
+	return key.Algorithm, nil
+}
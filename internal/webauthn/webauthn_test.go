@@ -0,0 +1,208 @@
+package webauthn_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"UserServiceAuth/internal/webauthn"
+	"UserServiceAuth/internal/webauthn/webauthntest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const origin = "https://auth.example.com"
+
+func testRP() *webauthn.RelyingParty {
+	return &webauthn.RelyingParty{
+		ID:      "auth.example.com",
+		Name:    "Example",
+		Origins: []string{origin},
+		Timeout: time.Minute,
+	}
+}
+
+func register(t *testing.T, rp *webauthn.RelyingParty, authenticator *webauthntest.Authenticator) ([]byte, *webauthn.CredentialCreation) {
+	t.Helper()
+	challenge, err := webauthn.NewChallenge()
+	require.NoError(t, err)
+
+	opts := rp.CreationOptions(challenge, webauthn.UserEntity{ID: []byte("7"), Name: "john", DisplayName: "John"}, nil, webauthn.UserVerificationPreferred)
+	creation, err := authenticator.Create(opts)
+	require.NoError(t, err)
+	return challenge, creation
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	for _, format := range []string{webauthntest.AttestationNone, webauthntest.AttestationPacked} {
+		t.Run(format, func(t *testing.T) {
+			assert := assert.New(t)
+			rp := testRP()
+			authenticator := webauthntest.New(origin)
+			authenticator.Attestation = format
+
+			challenge, creation := register(t, rp, authenticator)
+			cred, err := rp.VerifyRegistration(challenge, creation, true)
+			require.NoError(t, err)
+			assert.Equal([]byte(creation.RawID), cred.ID)
+			assert.Equal(webauthn.AlgES256, cred.Algorithm)
+			assert.True(cred.UserVerified)
+
+			challenge, err = webauthn.NewChallenge()
+			require.NoError(t, err)
+			assertion, err := authenticator.Get(rp.RequestOptions(challenge, [][]byte{cred.ID}, webauthn.UserVerificationRequired))
+			require.NoError(t, err)
+
+			result, err := rp.VerifyAssertion(challenge, assertion, cred.PublicKey, true)
+			require.NoError(t, err)
+			assert.Greater(result.SignCount, cred.SignCount)
+			assert.Equal([]byte("7"), []byte(assertion.Response.UserHandle))
+		})
+	}
+}
+
+func TestVerifyRegistration_Rejects(t *testing.T) {
+	rp := testRP()
+
+	challenge, creation := register(t, rp, webauthntest.New(origin))
+	_, err := rp.VerifyRegistration([]byte("another challenge"), creation, false)
+	assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+
+	challenge, creation = register(t, rp, webauthntest.New("https://phishing.example.net"))
+	_, err = rp.VerifyRegistration(challenge, creation, false)
+	assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+
+	other := testRP()
+	other.ID = "example.net"
+	challenge, creation = register(t, other, webauthntest.New(origin))
+	_, err = rp.VerifyRegistration(challenge, creation, false)
+	assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+
+	noUV := webauthntest.New(origin)
+	noUV.UserVerification = false
+	challenge, creation = register(t, rp, noUV)
+	_, err = rp.VerifyRegistration(challenge, creation, true)
+	assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+	_, err = rp.VerifyRegistration(challenge, creation, false)
+	assert.NoError(t, err)
+
+	framed := webauthntest.New(origin)
+	framed.CrossOrigin = true
+	challenge, creation = register(t, rp, framed)
+	_, err = rp.VerifyRegistration(challenge, creation, false)
+	assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+}
+
+// certificate выпускает сертификат ECDSA. Без parent сертификат самоподписанный (корень).
+func certificate(t *testing.T, subject pkix.Name, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func TestVerifyRegistration_PackedCertificateChain(t *testing.T) {
+	rp := testRP()
+	root, rootKey := certificate(t, pkix.Name{CommonName: "Example Root CA"}, nil, nil)
+	other, _ := certificate(t, pkix.Name{CommonName: "Other Root CA"}, nil, nil)
+	leaf, leafKey := certificate(t, pkix.Name{
+		Country:            []string{"US"},
+		Organization:       []string{"Example Vendor"},
+		OrganizationalUnit: []string{"Authenticator Attestation"},
+		CommonName:         "Example Authenticator",
+	}, root, rootKey)
+
+	authenticator := webauthntest.New(origin)
+	authenticator.Attestation = webauthntest.AttestationPacked
+	authenticator.AttestationKey = leafKey
+
+	authenticator.AttestationCertificates = [][]byte{leaf.Raw, root.Raw}
+	challenge, creation := register(t, rp, authenticator)
+	_, err := rp.VerifyRegistration(challenge, creation, false)
+	require.NoError(t, err)
+
+	// Сертификат аттестации не подписан следующим сертификатом цепочки
+	authenticator.AttestationCertificates = [][]byte{leaf.Raw, other.Raw}
+	challenge, creation = register(t, rp, authenticator)
+	_, err = rp.VerifyRegistration(challenge, creation, false)
+	assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+
+	// Подпись аттестации должна сходиться с ключом первого сертификата
+	authenticator.AttestationCertificates = [][]byte{root.Raw}
+	challenge, creation = register(t, rp, authenticator)
+	_, err = rp.VerifyRegistration(challenge, creation, false)
+	assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+}
+
+func TestVerifyAssertion_Rejects(t *testing.T) {
+	rp := testRP()
+	authenticator := webauthntest.New(origin)
+	challenge, creation := register(t, rp, authenticator)
+	cred, err := rp.VerifyRegistration(challenge, creation, false)
+	require.NoError(t, err)
+
+	challenge, _ = webauthn.NewChallenge()
+	assertion, err := authenticator.Get(rp.RequestOptions(challenge, nil, webauthn.UserVerificationPreferred))
+	require.NoError(t, err)
+
+	// Подпись не сходится, если изменить подписанные данные
+	tampered := *assertion
+	tampered.Response.AuthenticatorData = append([]byte{}, assertion.Response.AuthenticatorData...)
+	tampered.Response.AuthenticatorData[len(tampered.Response.AuthenticatorData)-1]++
+	_, err = rp.VerifyAssertion(challenge, &tampered, cred.PublicKey, false)
+	assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+
+	// Ответ на вызов регистрации не принимается как вход
+	_, err = rp.VerifyAssertion(challenge, &webauthn.CredentialAssertion{
+		ID:    creation.ID,
+		RawID: creation.RawID,
+		Type:  creation.Type,
+		Response: webauthn.AssertionResponse{
+			ClientDataJSON:    creation.Response.ClientDataJSON,
+			AuthenticatorData: assertion.Response.AuthenticatorData,
+			Signature:         assertion.Response.Signature,
+		},
+	}, cred.PublicKey, false)
+	assert.ErrorIs(t, err, webauthn.ErrInvalidResponse)
+
+	_, err = rp.VerifyAssertion(challenge, assertion, cred.PublicKey, false)
+	assert.NoError(t, err)
+}
+
+func TestCredentialJSON(t *testing.T) {
+	assert := assert.New(t)
+	rp := testRP()
+	_, creation := register(t, rp, webauthntest.New(origin))
+
+	data, err := json.Marshal(creation)
+	require.NoError(t, err)
+	assert.NotContains(string(data), "=")
+
+	var decoded webauthn.CredentialCreation
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(creation.RawID, decoded.RawID)
+	assert.Equal(creation.Response.AttestationObject, decoded.Response.AttestationObject)
+}
@@ -0,0 +1,232 @@
+// Package webauthntest содержит программный аутентификатор, которым тесты
+// проходят церемонии регистрации и входа WebAuthn без браузера.
+package webauthntest
+
+import (
+	"UserServiceAuth/internal/webauthn"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+// Форматы аттестации, которые умеет выдавать аутентификатор
+const (
+	AttestationNone   = "none"
+	AttestationPacked = "packed"
+)
+
+var (
+	ErrExcluded     = errors.New("webauthntest: credential already registered")
+	ErrNoCredential = errors.New("webauthntest: no matching credential")
+)
+
+// Authenticator - аутентификатор с ключами ES256 в памяти
+type Authenticator struct {
+	// Origin, который браузер подставил бы в clientDataJSON
+	Origin string
+	// Выставлять ли флаг проверки пользователя (PIN, биометрия)
+	UserVerification bool
+	// Формат аттестации при регистрации
+	Attestation string
+	// Ключ и цепочка x5c для аттестации packed. Без ключа используется самоаттестация.
+	AttestationKey          *ecdsa.PrivateKey
+	AttestationCertificates [][]byte
+	// Выставлять ли crossOrigin в clientDataJSON, как в чужом iframe
+	CrossOrigin bool
+
+	credentials []*credential
+}
+
+type credential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+func New(origin string) *Authenticator {
+	return &Authenticator{
+		Origin:           origin,
+		UserVerification: true,
+		Attestation:      AttestationNone,
+	}
+}
+
+// Create создаёт учётные данные по параметрам navigator.credentials.create()
+func (a *Authenticator) Create(opts *webauthn.CreationOptions) (*webauthn.CredentialCreation, error) {
+	for _, excluded := range opts.ExcludeCredentials {
+		if a.find(opts.RP.ID, excluded.ID) != nil {
+			return nil, ErrExcluded
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	cred := &credential{id: id, rpID: opts.RP.ID, userHandle: opts.User.ID, key: key, signCount: 1}
+	a.credentials = append(a.credentials, cred)
+
+	clientDataJSON := a.clientData("webauthn.create", opts.Challenge)
+
+	attested := make([]byte, 16, 16+2+len(id))
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(id)))
+	attested = append(attested, id...)
+	pub, err := publicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	attested = append(attested, pub...)
+	authData := a.authData(cred, protocol.FlagAttestedCredentialData, attested)
+
+	statement := map[string]interface{}{}
+	if a.Attestation == AttestationPacked {
+		signer := key
+		if a.AttestationKey != nil {
+			signer = a.AttestationKey
+		}
+		sig, err := sign(signer, authData, clientDataJSON)
+		if err != nil {
+			return nil, err
+		}
+		statement = map[string]interface{}{"alg": webauthn.AlgES256, "sig": sig}
+		if a.AttestationKey != nil {
+			statement["x5c"] = a.AttestationCertificates
+		}
+	}
+	attestationObject, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      a.Attestation,
+		"attStmt":  statement,
+		"authData": authData,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &webauthn.CredentialCreation{
+		ID:    webauthn.Base64URL(id).String(),
+		RawID: id,
+		Type:  "public-key",
+		Response: webauthn.AttestationResponse{
+			ClientDataJSON:    clientDataJSON,
+			AttestationObject: attestationObject,
+		},
+	}, nil
+}
+
+// Get подписывает вызов по параметрам navigator.credentials.get(). При пустом
+// списке allowCredentials используются учётные данные, сохранённые для rpId.
+func (a *Authenticator) Get(opts *webauthn.RequestOptions) (*webauthn.CredentialAssertion, error) {
+	var cred *credential
+	if len(opts.AllowCredentials) == 0 {
+		for _, c := range a.credentials {
+			if c.rpID == opts.RPID {
+				cred = c
+				break
+			}
+		}
+	}
+	for _, allowed := range opts.AllowCredentials {
+		if cred = a.find(opts.RPID, allowed.ID); cred != nil {
+			break
+		}
+	}
+	if cred == nil {
+		return nil, ErrNoCredential
+	}
+
+	cred.signCount++
+	clientDataJSON := a.clientData("webauthn.get", opts.Challenge)
+	authData := a.authData(cred, 0, nil)
+	sig, err := sign(cred.key, authData, clientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webauthn.CredentialAssertion{
+		ID:    webauthn.Base64URL(cred.id).String(),
+		RawID: cred.id,
+		Type:  "public-key",
+		Response: webauthn.AssertionResponse{
+			ClientDataJSON:    clientDataJSON,
+			AuthenticatorData: authData,
+			Signature:         sig,
+			UserHandle:        cred.userHandle,
+		},
+	}, nil
+}
+
+// SetSignCount подменяет счётчик подписей, чтобы изобразить клон аутентификатора
+func (a *Authenticator) SetSignCount(n uint32) {
+	for _, c := range a.credentials {
+		c.signCount = n
+	}
+}
+
+func (a *Authenticator) find(rpID string, id []byte) *credential {
+	for _, c := range a.credentials {
+		if c.rpID == rpID && bytes.Equal(c.id, id) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (a *Authenticator) clientData(ceremony string, challenge []byte) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      a.Origin,
+		"crossOrigin": a.CrossOrigin,
+	})
+	return data
+}
+
+func (a *Authenticator) authData(cred *credential, flags protocol.AuthenticatorFlags, attested []byte) []byte {
+	flags |= protocol.FlagUserPresent
+	if a.UserVerification {
+		flags |= protocol.FlagUserVerified
+	}
+
+	rpIDHash := sha256.Sum256([]byte(cred.rpID))
+	data := append(rpIDHash[:], byte(flags))
+	data = binary.BigEndian.AppendUint32(data, cred.signCount)
+	return append(data, attested...)
+}
+
+func publicKey(pub *ecdsa.PublicKey) ([]byte, error) {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+	return webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: webauthn.AlgES256,
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: x,
+		YCoord: y,
+	})
+}
+
+func sign(key *ecdsa.PrivateKey, authData, clientDataJSON []byte) ([]byte, error) {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	return ecdsa.SignASN1(rand.Reader, key, digest[:])
+}
@@ -41,10 +41,31 @@ func InitDB(cfg *config.Config) *gorm.DB {
 		log.Fatalf("Failed to connect to database after %d attempts: %v", maxAttempts, err)
 	}
 
-	err = db.AutoMigrate(&TOKENS{}, &USERS{})
+	// Пользователи, зарегистрированные до появления подтверждения email, считаются подтверждёнными
+	grandfatherVerified := db.Migrator().HasTable(&USERS{}) && !db.Migrator().HasColumn(&USERS{}, "EMAILVERIFIEDAT")
+
+	err = db.AutoMigrate(&TOKENS{}, &REVOKEDTOKENS{}, &USEDTOKENS{}, &USERS{}, &PASSWORDRESETS{}, &RECOVERYCODES{}, &WEBAUTHNCREDENTIALS{}, &LOGINATTEMPTS{}, &AUDITEVENTS{})
 	if err != nil {
 		log.Fatalf("Failed to migrate database schema: %v", err)
 	}
 
+	if grandfatherVerified {
+		if err := markExistingUsersVerified(db); err != nil {
+			log.Fatalf("Failed to mark existing users as verified: %v", err)
+		}
+	}
+
+	// Коллизии разрешаются вручную. До этого сервис работает, а миграция повторяется при запуске.
+	if err := migrateUserIdentifiers(db); err != nil {
+		log.Printf("Some user logins and emails are left unnormalized: %v", err)
+	}
+
 	return db
 }
+
+// markExistingUsersVerified подтверждает email всех пользователей без отметки. Колонка timecreate
+// появилась позже первых регистраций, и у старых строк она пустая - им ставится текущее время.
+func markExistingUsersVerified(db *gorm.DB) error {
+	return db.Unscoped().Model(&USERS{}).Where("emailverifiedat IS NULL").
+		UpdateColumn("emailverifiedat", gorm.Expr("COALESCE(to_timestamp(timecreate), now())")).Error
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// sqlRecorder запоминает SQL, который GORM построил бы для PostgreSQL
+type sqlRecorder struct {
+	statements []string
+}
+
+func (r *sqlRecorder) LogMode(logger.LogLevel) logger.Interface      { return r }
+func (r *sqlRecorder) Info(context.Context, string, ...interface{})  {}
+func (r *sqlRecorder) Warn(context.Context, string, ...interface{})  {}
+func (r *sqlRecorder) Error(context.Context, string, ...interface{}) {}
+
+func (r *sqlRecorder) Trace(_ context.Context, _ time.Time, fc func() (string, int64), _ error) {
+	sql, _ := fc()
+	r.statements = append(r.statements, sql)
+}
+
+func newDryRunDB(t *testing.T) (*gorm.DB, *sqlRecorder) {
+	t.Helper()
+	recorder := &sqlRecorder{}
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost dbname=test"}), &gorm.Config{
+		DryRun:                 true,
+		DisableAutomaticPing:   true,
+		SkipDefaultTransaction: true,
+		Logger:                 recorder,
+	})
+	require.NoError(t, err)
+	return db, recorder
+}
+
+func TestMarkExistingUsersVerified_CoversRowsWithoutTimecreate(t *testing.T) {
+	db, recorder := newDryRunDB(t)
+
+	require.NoError(t, markExistingUsersVerified(db))
+
+	// У строк, созданных до появления timecreate, колонка NULL, и to_timestamp(NULL) тоже NULL
+	require.Len(t, recorder.statements, 1)
+	assert.Contains(t, recorder.statements[0], `SET "emailverifiedat"=COALESCE(to_timestamp(timecreate), now())`)
+	assert.Contains(t, recorder.statements[0], "WHERE emailverifiedat IS NULL")
+	assert.NotContains(t, recorder.statements[0], "deletedat")
+}
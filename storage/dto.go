@@ -1,21 +1,160 @@
 package storage
 
+import (
+	"UserServiceAuth/internal/webauthn"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TOKENS - сессия пользователя на одном устройстве и её семейство refresh-токенов:
+// при каждом обновлении токен в строке заменяется новым
 type TOKENS struct {
-	IDTOKENS     uint `gorm:"primary_key"`
-	USERID       uint `gorm:"unique"`
-	ACCESSTOCKEN string
-	REFRESHTOKEN string
+	IDTOKENS     uint   `gorm:"primary_key"`
+	USERID       uint   `gorm:"index"`
+	FAMILY       string `gorm:"uniqueIndex"`
+	ACCESSTOCKEN string // jti последнего выданного access-токена
+	REFRESHTOKEN string // SHA-256 от текущего refresh-токена
+	USERAGENT    string
+	IP           string
 	EXP          int64
+	REVOKED      bool
 	TIMECREATE   int64 `gorm:"autoCreateTime"`
+	LASTUSED     int64
+	// Вход в сессию подтверждён вторым фактором
+	MFA bool
+	// Способы аутентификации по RFC 8176 через пробел, попадают в claim amr
+	AMR string
+}
+
+// REVOKEDTOKENS - отозванные до истечения срока access-токены.
+// Запись нужна только до EXP, после этого токен отклоняется и так.
+type REVOKEDTOKENS struct {
+	JTI        string `gorm:"primary_key"`
+	EXP        int64  `gorm:"index"`
+	TIMECREATE int64  `gorm:"autoCreateTime"`
+}
+
+// USEDTOKENS - погашенные одноразовые токены: ссылки подтверждения email, токены второго
+// шага входа и церемоний WebAuthn. В отличие от REVOKEDTOKENS в публичный список не попадают.
+type USEDTOKENS struct {
+	JTI        string `gorm:"primary_key"`
+	EXP        int64  `gorm:"index"`
+	TIMECREATE int64  `gorm:"autoCreateTime"`
+}
+
+// PASSWORDRESETS - выданные токены сброса пароля. Хранится только SHA-256 от токена.
+type PASSWORDRESETS struct {
+	IDPASSWORDRESETS uint   `gorm:"primary_key"`
+	USERID           uint   `gorm:"index"`
+	TOKENHASH        string `gorm:"uniqueIndex"`
+	EXP              int64
+	USED             bool
+	TIMECREATE       int64 `gorm:"autoCreateTime"`
+}
+
+// RECOVERYCODES - одноразовые коды восстановления доступа при потере TOTP. Хранится только SHA-256 от кода.
+type RECOVERYCODES struct {
+	IDRECOVERYCODES uint   `gorm:"primary_key"`
+	USERID          uint   `gorm:"index"`
+	CODEHASH        string `gorm:"index"`
+	USED            bool
+}
+
+// WEBAUTHNCREDENTIALS - ключи WebAuthn (passkey) пользователя. Хранится только открытый ключ.
+type WEBAUTHNCREDENTIALS struct {
+	IDWEBAUTHNCREDENTIALS uint   `gorm:"primary_key"`
+	USERID                uint   `gorm:"index"`
+	CREDENTIALID          string `gorm:"uniqueIndex"` // base64url от идентификатора учётных данных
+	PUBLICKEY             []byte // открытый ключ в формате COSE_Key
+	ALGORITHM             int64
+	// Счётчик подписей аутентификатора: если он перестал расти, ключ, вероятно, скопирован
+	SIGNCOUNT      uint32
+	AAGUID         []byte
+	BACKUPELIGIBLE bool
+	NAME           string
+	TIMECREATE     int64 `gorm:"autoCreateTime"`
+	LASTUSED       int64
+}
+
+// LOGINATTEMPTS - неудачные попытки входа по одному ключу: логину, IP-адресу или
+// второму фактору пользователя.
+// Строки создаются и для несуществующих логинов, чтобы по поведению нельзя было
+// узнать, зарегистрирован ли логин.
+type LOGINATTEMPTS struct {
+	ATTEMPTKEY  string `gorm:"primary_key"` // "login:<логин>", "ip:<адрес>" или "mfa:<ID пользователя>"
+	FAILURES    int
+	LASTFAILURE int64 `gorm:"index"`
+	LOCKEDUNTIL int64
+}
+
+// AUDITEVENTS - журнал событий безопасности
+type AUDITEVENTS struct {
+	IDAUDITEVENTS uint   `gorm:"primary_key"`
+	EVENT         string `gorm:"index"`
+	USERID        *uint  `gorm:"index"` // nil, если логин не принадлежит ни одному пользователю
+	ACTORID       *uint  // кто выполнил действие, например администратор при разблокировке
+	LOGIN         string
+	IP            string
+	DETAILS       string
+	TIMECREATE    int64 `gorm:"autoCreateTime;index"`
 }
 
+// События журнала аудита
+const (
+	AuditAccountLocked   = "account_locked"
+	AuditAccountUnlocked = "account_unlocked"
+)
+
+// Роли пользователей
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// ErrVersionConflict - строка изменена с момента, когда клиент её прочитал
+var ErrVersionConflict = errors.New("version conflict")
+
+// ErrLastCredential - удаление оставило бы пользователя без ключей WebAuthn
+var ErrLastCredential = errors.New("last webauthn credential")
+
+// UniqueViolation - значение уникального поля уже занято другой строкой
+type UniqueViolation struct {
+	Field string
+}
+
+func (e *UniqueViolation) Error() string {
+	return "duplicate value for unique field " + e.Field
+}
+
+// USERS - модель хранения пользователя. Дальше репозиториев и сервисов она не уходит:
+// сервисы отдают наружу service.User.
 type USERS struct {
-	USERID   uint   `gorm:"primary_key" json:"user_id"`
-	EMAIL    string `gorm:"unique" json:"email"`
-	LOGIN    string `gorm:"unique" json:"login"`
-	USERNAME string `json:"username"`
-	SURNAME  string `json:"surname"`
-	PASSWORD string `json:"password" validate:"required"`
+	USERID     uint   `gorm:"primary_key" json:"-"`
+	EMAIL      string `gorm:"unique" json:"-"`
+	LOGIN      string `gorm:"unique" json:"-"`
+	USERNAME   string `json:"-"`
+	SURNAME    string `json:"-"`
+	PASSWORD   string `json:"-" validate:"required"`
+	ROLE       string `gorm:"not null;default:user" json:"-"`
+	TIMECREATE int64  `gorm:"autoCreateTime" json:"-"`
+	TIMEUPDATE int64  `gorm:"autoUpdateTime" json:"-"`
+	// Увеличивается при каждом изменении, отдаётся клиентам как ETag
+	VERSION uint `gorm:"not null;default:1" json:"-"`
+	// Удалённый пользователь хранится до окончательной очистки и может быть восстановлен
+	DELETEDAT gorm.DeletedAt `gorm:"index" json:"-"`
+	// Момент подтверждения текущего email, nil - адрес не подтверждён
+	EMAILVERIFIEDAT *time.Time `json:"-"`
+	// Секрет TOTP. До подтверждения настройки TOTPENABLED остаётся false.
+	TOTPSECRET  string `json:"-"`
+	TOTPENABLED bool   `json:"-"`
+	// Последний принятый интервал TOTP: код из него повторно не принимается
+	TOTPLASTSTEP int64 `json:"-"`
+}
+
+func (u *USERS) EmailVerified() bool {
+	return u.EMAILVERIFIEDAT != nil
 }
 
 type LoginRequest struct {
@@ -31,9 +170,119 @@ type RegisterRequest struct {
 	Password string `json:"password" validate:"required"`
 }
 
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type RevokeRequest struct {
+	Token         string `json:"token" form:"token" validate:"required"`
+	TokenTypeHint string `json:"token_type_hint" form:"token_type_hint"`
+}
+
 type UpdateRequest struct {
 	Username string `json:"username" validate:"required"`
 	Surname  string `json:"surname" validate:"required"`
 	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required"`
+	// Пароль меняется только через POST /users/me/password с текущим паролем,
+	// поле оставлено, чтобы старые клиенты получали ошибку, а не молчаливый отказ
+	Password string `json:"password" validate:"isdefault"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	Code     string `json:"code" validate:"required"`
+}
+
+// WebAuthnRegisterRequest - ответ navigator.credentials.create() и токен церемонии из /webauthn/register/begin
+type WebAuthnRegisterRequest struct {
+	CeremonyToken string                       `json:"ceremony_token" validate:"required"`
+	Name          string                       `json:"name" validate:"max=64"`
+	Credential    *webauthn.CredentialCreation `json:"credential" validate:"required"`
+}
+
+// WebAuthnLoginBeginRequest - без mfa_token начинается вход только по ключу (passkey),
+// с ним - проверка ключа как второго фактора после пароля
+type WebAuthnLoginBeginRequest struct {
+	MFAToken string `json:"mfa_token"`
+}
+
+type WebAuthnLoginRequest struct {
+	CeremonyToken string                        `json:"ceremony_token" validate:"required"`
+	MFAToken      string                        `json:"mfa_token"`
+	Credential    *webauthn.CredentialAssertion `json:"credential" validate:"required"`
+}
+
+// MFACodeRequest - код из приложения-аутентификатора или код восстановления
+// ConfirmationRequest подтверждает изменение вторых факторов одним из способов: ключом WebAuthn
+// (ceremony_token из /webauthn/confirm/begin и ответ navigator.credentials.get()),
+// кодом TOTP или кодом восстановления, либо паролем
+type ConfirmationRequest struct {
+	CeremonyToken string                        `json:"ceremony_token" validate:"required_with=Credential"`
+	Credential    *webauthn.CredentialAssertion `json:"credential" validate:"required_with=CeremonyToken"`
+	Code          string                        `json:"code"`
+	Password      string                        `json:"password"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// PatchUserRequest - частичное обновление пользователя: отсутствующие поля не меняются,
+// null очищает поле. Пароль меняется только через ChangePasswordRequest.
+type PatchUserRequest struct {
+	Username Optional[string] `json:"username"`
+	Surname  Optional[string] `json:"surname"`
+	Email    Optional[string] `json:"email"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,nefield=CurrentPassword"`
+}
+
+// UserPatch - изменяемые поля пользователя, nil означает "не менять"
+type UserPatch struct {
+	Username *string
+	Surname  *string
+	Email    *string
+}
+
+// ListUsersRequest - параметры постраничного списка пользователей.
+// Sort - имя поля, с префиксом "-" для сортировки по убыванию.
+type ListUsersRequest struct {
+	Page    int    `query:"page" validate:"omitempty,min=1"`
+	PerPage int    `query:"per_page" validate:"omitempty,min=1,max=100"`
+	Sort    string `query:"sort" validate:"omitempty,oneof=user_id -user_id login -login email -email username -username surname -surname created_at -created_at"`
+	Email   string `query:"email"`
+	Login   string `query:"login"`
+	Name    string `query:"name"`
+	Deleted bool   `query:"deleted"`
+}
+
+// UserFilter - условия выборки пользователей для репозитория
+type UserFilter struct {
+	Email   string
+	Login   string
+	Name    string
+	Deleted bool
+	Sort    string
+	Limit   int
+	Offset  int
 }
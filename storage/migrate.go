@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// IdentifierCollision - несколько пользователей, чьи login или email совпадают после нормализации
+type IdentifierCollision struct {
+	Field   string
+	Value   string
+	UserIDs []uint
+}
+
+// CollisionError сообщает о коллизиях, которые нужно разрешить вручную до включения уникальности без учёта регистра
+type CollisionError struct {
+	Collisions []IdentifierCollision
+}
+
+func (e *CollisionError) Error() string {
+	lines := make([]string, 0, len(e.Collisions))
+	for _, c := range e.Collisions {
+		lines = append(lines, fmt.Sprintf("%s %q: users %v", c.Field, c.Value, c.UserIDs))
+	}
+	return fmt.Sprintf("%d normalized login/email collisions: %s", len(e.Collisions), strings.Join(lines, "; "))
+}
+
+// normalizedSQL повторяет NormalizeIdentifier средствами PostgreSQL. Для ASCII результат
+// совпадает точно, остальные значения дополнительно проверяются в Go.
+func normalizedSQL(column string) string {
+	return fmt.Sprintf(`lower(normalize(btrim(%s, E' \t\n\v\f\r'), NFKC))`, column)
+}
+
+// migrateUserIdentifiers один раз нормализует login и email существующих пользователей и
+// создаёт уникальные индексы по lower(). Когда индексы созданы, миграция больше не выполняется.
+// Значения, которые после нормализации совпадают у разных пользователей, остаются как есть:
+// остальные пользователи нормализуются сразу, а индексы создаются только после того, как
+// коллизии разрешены вручную. Пока они есть, возвращается CollisionError со списком коллизий.
+func migrateUserIdentifiers(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if migrator.HasIndex(&USERS{}, "idx_users_login_lower") && migrator.HasIndex(&USERS{}, "idx_users_email_lower") {
+		return nil
+	}
+
+	collisions, err := identifierCollisions(db)
+	if err != nil {
+		return err
+	}
+
+	// Читаются только строки, которые могут измениться, а не вся таблица
+	var users []USERS
+	err = db.Unscoped().Select("user_id", "login", "email").
+		Where(fmt.Sprintf("login <> %s OR email <> %s OR login !~ '^[[:ascii:]]*$' OR email !~ '^[[:ascii:]]*$'",
+			normalizedSQL("login"), normalizedSQL("email"))).
+		Order("user_id").Find(&users).Error
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, user := range normalizedUsers(users, collisions) {
+			err := tx.Unscoped().Model(&USERS{}).Where("user_id = ?", user.USERID).
+				UpdateColumns(map[string]interface{}{"login": user.LOGIN, "email": user.EMAIL}).Error
+			if err != nil {
+				return err
+			}
+		}
+		if len(collisions) > 0 {
+			return nil
+		}
+
+		// Защищает от дубликатов и при записи в обход NormalizeIdentifier
+		for _, stmt := range []string{
+			"CREATE UNIQUE INDEX IF NOT EXISTS idx_users_login_lower ON users (lower(login))",
+			"CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users (lower(email))",
+		} {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(collisions) > 0 {
+		return &CollisionError{Collisions: collisions}
+	}
+	return nil
+}
+
+// normalizedUsers возвращает пользователей с изменившимися после нормализации login или email.
+// Значения из коллизий не меняются, чтобы не нарушить уникальность.
+func normalizedUsers(users []USERS, collisions []IdentifierCollision) []USERS {
+	colliding := make(map[string]bool, len(collisions))
+	for _, c := range collisions {
+		colliding[c.Field+":"+c.Value] = true
+	}
+	normalize := func(field, value string) string {
+		normalized := NormalizeIdentifier(value)
+		if colliding[field+":"+normalized] {
+			return value
+		}
+		return normalized
+	}
+
+	var changed []USERS
+	for _, user := range users {
+		login, email := normalize("login", user.LOGIN), normalize("email", user.EMAIL)
+		if login == user.LOGIN && email == user.EMAIL {
+			continue
+		}
+		changed = append(changed, USERS{USERID: user.USERID, LOGIN: login, EMAIL: email})
+	}
+	return changed
+}
+
+// identifierCollisions находит совпадающие после нормализации значения группировкой в базе
+// и загружает только пользователей из таких групп
+func identifierCollisions(db *gorm.DB) ([]IdentifierCollision, error) {
+	duplicates := func(column string) *gorm.DB {
+		return db.Unscoped().Model(&USERS{}).Select(normalizedSQL(column)).
+			Group(normalizedSQL(column)).Having("count(*) > 1")
+	}
+
+	var users []USERS
+	err := db.Unscoped().Select("user_id", "login", "email").
+		Where(fmt.Sprintf("%s IN (?) OR %s IN (?)", normalizedSQL("login"), normalizedSQL("email")),
+			duplicates("login"), duplicates("email")).
+		Order("user_id").Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return findIdentifierCollisions(users), nil
+}
+
+// findIdentifierCollisions группирует пользователей по нормализованным login и email
+func findIdentifierCollisions(users []USERS) []IdentifierCollision {
+	var collisions []IdentifierCollision
+	for _, field := range []string{"login", "email"} {
+		groups := make(map[string][]uint)
+		for _, user := range users {
+			value := user.LOGIN
+			if field == "email" {
+				value = user.EMAIL
+			}
+			key := NormalizeIdentifier(value)
+			groups[key] = append(groups[key], user.USERID)
+		}
+
+		keys := make([]string, 0, len(groups))
+		for key, ids := range groups {
+			if len(ids) > 1 {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			collisions = append(collisions, IdentifierCollision{Field: field, Value: key, UserIDs: groups[key]})
+		}
+	}
+	return collisions
+}
@@ -0,0 +1,13 @@
+package storage
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NormalizeIdentifier приводит login и email к единому виду перед записью и поиском,
+// чтобы "Alice@Example.com" и "alice@example.com" считались одним значением
+func NormalizeIdentifier(s string) string {
+	return strings.ToLower(norm.NFKC.String(strings.TrimSpace(s)))
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeIdentifier(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Alice@Example.com", "alice@example.com"},
+		{"  johndoe\t", "johndoe"},
+		{"ＪｏｈｎＤｏｅ", "johndoe"},
+		{"ﬁle", "file"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, NormalizeIdentifier(tt.in), tt.in)
+	}
+}
+
+func TestFindIdentifierCollisions(t *testing.T) {
+	users := []USERS{
+		{USERID: 1, LOGIN: "alice", EMAIL: "Alice@Example.com"},
+		{USERID: 2, LOGIN: "bob", EMAIL: "alice@example.com"},
+		{USERID: 3, LOGIN: " Bob", EMAIL: "bob@example.com"},
+		{USERID: 4, LOGIN: "carol", EMAIL: "carol@example.com"},
+	}
+
+	collisions := findIdentifierCollisions(users)
+
+	assert.Equal(t, []IdentifierCollision{
+		{Field: "login", Value: "bob", UserIDs: []uint{2, 3}},
+		{Field: "email", Value: "alice@example.com", UserIDs: []uint{1, 2}},
+	}, collisions)
+	assert.Contains(t, (&CollisionError{Collisions: collisions}).Error(), `email "alice@example.com": users [1 2]`)
+}
+
+func TestNormalizedUsers_SkipsOnlyCollidingValues(t *testing.T) {
+	users := []USERS{
+		{USERID: 1, LOGIN: "Alice", EMAIL: "Alice@Example.com"},
+		{USERID: 2, LOGIN: "bob", EMAIL: "alice@example.com"},
+		{USERID: 3, LOGIN: "Carol", EMAIL: "CAROL@example.com"},
+		{USERID: 4, LOGIN: "dave", EMAIL: "dave@example.com"},
+	}
+	collisions := findIdentifierCollisions(users)
+
+	// У первого пользователя email в коллизии и не трогается, а login нормализуется
+	assert.Equal(t, []USERS{
+		{USERID: 1, LOGIN: "alice", EMAIL: "Alice@Example.com"},
+		{USERID: 3, LOGIN: "carol", EMAIL: "carol@example.com"},
+	}, normalizedUsers(users, collisions))
+}
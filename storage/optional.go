@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Optional - поле тела PATCH-запроса. Отличает отсутствующее поле (Set == false)
+// от явно переданного null (Null == true) и обычного значения.
+type Optional[T any] struct {
+	Set   bool
+	Null  bool
+	Value T
+}
+
+// UnmarshalJSON вызывается только для присутствующих в теле полей
+func (o *Optional[T]) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		o.Null = true
+		return nil
+	}
+	return json.Unmarshal(data, &o.Value)
+}